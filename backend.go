@@ -0,0 +1,416 @@
+//
+// Copyright (c) 2019 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// backend is an rspamd instance, along with the state of its circuit
+// breaker: after too many consecutive failures, the circuit opens and
+// scans fail at once instead of waiting on an rspamd which is down.
+// Once the cooldown is over, a single scan is let through to probe it.
+// When health checks are enabled, the circuit also stays open for as
+// long as the backend fails them.  Once its circuit closes again, its
+// weight is ramped up over -slow-start.
+type backend struct {
+	url        string
+	socketPath string
+	weight     int
+
+	// current is the running weight of the smooth weighted round robin
+	current int
+
+	sync.Mutex
+	state       string
+	failures    int
+	openUntil   time.Time
+	healthy     bool
+	recoveredAt time.Time
+
+	clientOnce sync.Once
+	httpClient *http.Client
+}
+
+const (
+	circuitClosed   = "closed"
+	circuitOpen     = "open"
+	circuitHalfOpen = "half-open"
+)
+
+var backends []*backend
+var backendsMutex sync.Mutex
+
+// parseBackend parses an rspamd url, or unix socket path, optionally
+// followed by ,weight=<n>.
+func parseBackend(spec string) (*backend, error) {
+	fields := strings.Split(spec, ",")
+
+	b := &backend{url: fields[0], weight: 1, state: circuitClosed, healthy: true}
+	if !strings.HasPrefix(b.url, "http") {
+		b.socketPath = b.url
+		b.url = "http://localhost"
+	}
+
+	for _, field := range fields[1:] {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 || kv[0] != "weight" {
+			return nil, fmt.Errorf("unknown option: %s", field)
+		}
+		weight, err := strconv.Atoi(kv[1])
+		if err != nil || weight < 1 {
+			return nil, fmt.Errorf("invalid weight: %s", kv[1])
+		}
+		b.weight = weight
+	}
+	return b, nil
+}
+
+// pickBackend returns the backend the next request for a client IP should
+// go to, skipping those which are unhealthy or whose circuit is open, or
+// nil if there is none.  Backends are picked in turn, in proportion to
+// their weight with the weighted strategy, using the smooth weighted round
+// robin of nginx which interleaves them rather than sending bursts to the
+// heaviest one.
+func pickBackend(ip string) *backend {
+	if *lbStrategy == "hash-ip" {
+		return pickBackendByHash(ip)
+	}
+
+	backendsMutex.Lock()
+	defer backendsMutex.Unlock()
+
+	now := time.Now()
+	skip := make(map[*backend]bool)
+	for len(skip) < len(backends) {
+		var best *backend
+		total := 0
+		for _, b := range backends {
+			if skip[b] || !b.available() {
+				continue
+			}
+			weight := b.weight
+			if *lbStrategy == "round-robin" {
+				weight = 1
+			}
+			weight = b.rampedWeight(weight, now)
+			b.current += weight
+			total += weight
+			if best == nil || b.current > best.current {
+				best = b
+			}
+		}
+		if best == nil {
+			return nil
+		}
+		best.current -= total
+
+		if best.allow() {
+			return best
+		}
+		skip[best] = true
+	}
+	return nil
+}
+
+func (b *backend) String() string {
+	if b.socketPath != "" {
+		return b.socketPath
+	}
+	return b.url
+}
+
+// status returns a line describing the state of the backend.
+func (b *backend) status() string {
+	b.Lock()
+	defer b.Unlock()
+
+	return fmt.Sprintf("%s weight=%d healthy=%t circuit=%s failures=%d",
+		b, b.weight, b.healthy, b.state, b.failures)
+}
+
+func (b *backend) client() *http.Client {
+	b.clientOnce.Do(func() {
+		if len(b.socketPath) == 0 {
+			b.httpClient = &http.Client{}
+			return
+		}
+		b.httpClient = &http.Client{Transport: unixTransport(b.socketPath)}
+	})
+	return b.httpClient
+}
+
+// closeResponse reads what is left of the body of resp before closing
+// it, so that the connection can be reused.
+func closeResponse(resp *http.Response) {
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+}
+
+// acceptEncoding lists the compressions of the verdicts accepted from
+// rspamd, which responseBody decodes. Being set explicitly, it also applies
+// to unix sockets, whose transport never asks for compression.
+const acceptEncoding = "gzip"
+
+// responseBody returns the body of resp, decompressed if rspamd
+// compressed it.
+func responseBody(resp *http.Response) (io.Reader, error) {
+	switch encoding := strings.ToLower(resp.Header.Get("Content-Encoding")); encoding {
+	case "", "identity":
+		return resp.Body, nil
+	case "gzip", "x-gzip":
+		return gzip.NewReader(resp.Body)
+	default:
+		return nil, fmt.Errorf("unsupported content encoding: %s", encoding)
+	}
+}
+
+// unixDialAttempts is the number of times a unix socket is dialed before
+// giving up, waiting unixDialDelay, then twice as long, in between.
+const unixDialAttempts = 4
+const unixDialDelay = 50 * time.Millisecond
+
+// unixTransport returns a transport which keeps connections to the unix
+// socket at path open for reuse.
+func unixTransport(path string) *http.Transport {
+	return &http.Transport{
+		DisableCompression:  true,
+		MaxIdleConnsPerHost: 16,
+		IdleConnTimeout:     90 * time.Second,
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dialUnix(ctx, path)
+		},
+	}
+}
+
+// dialUnix connects to the unix socket at path.  While rspamd restarts,
+// the socket is briefly missing or refuses connections, so dialing is
+// retried a few times before failing.
+func dialUnix(ctx context.Context, path string) (net.Conn, error) {
+	var d net.Dialer
+	delay := unixDialDelay
+	for attempt := 1; ; attempt++ {
+		c, err := d.DialContext(ctx, "unix", path)
+		if err == nil || attempt == unixDialAttempts ||
+			!(errors.Is(err, syscall.ENOENT) || errors.Is(err, syscall.ECONNREFUSED)) {
+			return c, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// weightScale lets slow start give backends a fraction of their weight.
+const weightScale = 100
+
+// rampedWeight returns weight scaled by weightScale, ramped up linearly
+// over -slow-start since the backend recovered.
+func (b *backend) rampedWeight(weight int, now time.Time) int {
+	b.Lock()
+	recovered := b.recoveredAt
+	b.Unlock()
+
+	weight *= weightScale
+	if elapsed := now.Sub(recovered); elapsed < *slowStart {
+		weight = int(int64(weight) * int64(elapsed) / int64(*slowStart))
+		if weight < 1 {
+			weight = 1
+		}
+	}
+	return weight
+}
+
+func (b *backend) setState(state string) {
+	if b.state == state {
+		return
+	}
+	if state == circuitClosed {
+		b.recoveredAt = time.Now()
+	}
+	log.Printf("rspamd backend %s: circuit %s", b, state)
+	metricInc("breaker." + state)
+	b.state = state
+}
+
+// pickBackendByHash picks a backend by weighted rendezvous hashing of the
+// client IP, so that the per-IP state of rspamd stays on one instance and
+// only the clients of a backend which is down move to the other ones.
+func pickBackendByHash(ip string) *backend {
+	ranked := make([]*backend, len(backends))
+	copy(ranked, backends)
+
+	now := time.Now()
+	scores := make(map[*backend]float64, len(ranked))
+	for _, b := range ranked {
+		h := sha256.Sum256([]byte(b.String() + "\x00" + ip))
+
+		// a uniform value in (0, 1)
+		u := (float64(binary.BigEndian.Uint64(h[:])>>11) + 0.5) / (1 << 53)
+		scores[b] = float64(b.rampedWeight(b.weight, now)) / -math.Log(u)
+	}
+	sort.SliceStable(ranked, func(i, j int) bool {
+		return scores[ranked[i]] > scores[ranked[j]]
+	})
+
+	for _, b := range ranked {
+		if b.available() && b.allow() {
+			return b
+		}
+	}
+	return nil
+}
+
+// available returns whether a request could be sent to the backend,
+// without changing the state of its circuit.
+func (b *backend) available() bool {
+	b.Lock()
+	defer b.Unlock()
+
+	switch {
+	case !b.healthy:
+		return false
+	case b.state == circuitOpen:
+		return !time.Now().Before(b.openUntil)
+	case b.state == circuitHalfOpen:
+		return false
+	default:
+		return true
+	}
+}
+
+// allow returns whether a request may be sent to the backend.
+func (b *backend) allow() bool {
+	b.Lock()
+	defer b.Unlock()
+
+	if !b.healthy {
+		return false
+	}
+
+	switch b.state {
+	case circuitOpen:
+		if time.Now().Before(b.openUntil) {
+			return false
+		}
+		b.setState(circuitHalfOpen)
+		return true
+	case circuitHalfOpen:
+		// a probe is already in flight
+		return false
+	default:
+		return true
+	}
+}
+
+func (b *backend) success() {
+	b.Lock()
+	defer b.Unlock()
+
+	b.failures = 0
+	b.setState(circuitClosed)
+}
+
+func (b *backend) failure() {
+	b.Lock()
+	defer b.Unlock()
+
+	b.failures++
+	if *breakerThreshold == 0 {
+		return
+	}
+	if b.state == circuitHalfOpen || b.failures >= *breakerThreshold {
+		b.openUntil = time.Now().Add(*breakerCooldown)
+		b.setState(circuitOpen)
+	}
+}
+
+// healthCheck probes the backend every interval, so that it is known to be
+// down, or up again, without waiting on the scans of live mail.
+func (b *backend) healthCheck(interval time.Duration) {
+	for range time.Tick(interval) {
+		b.check(interval)
+	}
+}
+
+// check pings the backend once, and marks it as unhealthy or healthy
+// again if the answer changed.
+func (b *backend) check(timeout time.Duration) {
+	err := b.ping(timeout)
+
+	b.Lock()
+	defer b.Unlock()
+
+	switch {
+	case err != nil && b.healthy:
+		log.Printf("rspamd backend %s: unhealthy: %s", b, err)
+		metricInc("health.unhealthy")
+		b.healthy = false
+		b.setState(circuitOpen)
+	case err == nil && !b.healthy:
+		log.Printf("rspamd backend %s: healthy", b)
+		metricInc("health.healthy")
+		b.healthy = true
+		b.failures = 0
+		b.setState(circuitClosed)
+	}
+}
+
+// ping checks that the backend answers within timeout.  The timeout is
+// set on the request rather than on the client, which scans share.
+func (b *backend) ping(timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", b.url+"/ping", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Add("User-Agent", userAgent())
+
+	resp, err := b.client().Do(req)
+	if err != nil {
+		return err
+	}
+	defer closeResponse(resp)
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	return nil
+}
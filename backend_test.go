@@ -0,0 +1,384 @@
+//
+// Copyright (c) 2019 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/poolpOrg/filter-rspamd/internal/rspamdtest"
+)
+
+// setBackends starts a fake rspamd per spec, which is the options of the
+// backend such as ",weight=2", and points the filter at them for the
+// duration of the test.
+func setBackends(t *testing.T, specs ...string) ([]*backend, []*rspamdtest.Server) {
+	var bs []*backend
+	var servers []*rspamdtest.Server
+	for _, spec := range specs {
+		server := rspamdtest.NewServer()
+		t.Cleanup(server.Close)
+
+		b, err := parseBackend(server.URL + spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bs = append(bs, b)
+		servers = append(servers, server)
+	}
+
+	saved := backends
+	backends = bs
+	t.Cleanup(func() { backends = saved })
+	return bs, servers
+}
+
+// picks returns the backends picked for n requests from ip, by index.
+func picks(t *testing.T, bs []*backend, ip string, n int) []int {
+	var picked []int
+	for i := 0; i < n; i++ {
+		b := pickBackend(ip)
+		if b == nil {
+			t.Fatal("no backend picked")
+		}
+		for j := range bs {
+			if bs[j] == b {
+				picked = append(picked, j)
+			}
+		}
+	}
+	return picked
+}
+
+func TestParseBackend(t *testing.T) {
+	tests := []struct {
+		spec   string
+		url    string
+		socket string
+		weight int
+		err    string
+	}{
+		{"http://127.0.0.1:11333", "http://127.0.0.1:11333", "", 1, ""},
+		{"http://127.0.0.1:11333,weight=3", "http://127.0.0.1:11333", "", 3, ""},
+		{"/var/run/rspamd.sock,weight=2", "http://localhost", "/var/run/rspamd.sock", 2, ""},
+		{"http://127.0.0.1:11333,weight=0", "", "", 0, "invalid weight: 0"},
+		{"http://127.0.0.1:11333,timeout=1", "", "", 0, "unknown option: timeout=1"},
+	}
+
+	for _, test := range tests {
+		b, err := parseBackend(test.spec)
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("%s: got error %v, want %q", test.spec, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.spec, err)
+			continue
+		}
+		if b.url != test.url || b.socketPath != test.socket || b.weight != test.weight {
+			t.Errorf("%s: got url %q, socket %q, weight %d", test.spec, b.url, b.socketPath, b.weight)
+		}
+	}
+}
+
+func TestPickBackendWeighted(t *testing.T) {
+	bs, _ := setBackends(t, ",weight=5", "", "")
+
+	// the heaviest backend is interleaved with the others
+	got := fmt.Sprint(picks(t, bs, "198.51.100.1", 7))
+	if want := "[0 0 1 0 2 0 0]"; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+
+	counts := make([]int, len(bs))
+	for _, i := range picks(t, bs, "198.51.100.1", 700) {
+		counts[i]++
+	}
+	if fmt.Sprint(counts) != "[500 100 100]" {
+		t.Errorf("got %v picks, want [500 100 100]", counts)
+	}
+}
+
+func TestPickBackendRoundRobin(t *testing.T) {
+	setFlag(t, "lb-strategy", "round-robin")
+	bs, _ := setBackends(t, ",weight=5", "", "")
+
+	got := fmt.Sprint(picks(t, bs, "198.51.100.1", 6))
+	if want := "[0 1 2 0 1 2]"; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestPickBackendHashIP(t *testing.T) {
+	setFlag(t, "lb-strategy", "hash-ip")
+	bs, _ := setBackends(t, "", ",weight=3")
+
+	before := make(map[string]int)
+	counts := make([]int, len(bs))
+	for i := 0; i < 2000; i++ {
+		ip := fmt.Sprintf("10.0.%d.%d", i/256, i%256)
+		picked := picks(t, bs, ip, 3)
+		if picked[0] != picked[1] || picked[0] != picked[2] {
+			t.Fatalf("%s: picked %v", ip, picked)
+		}
+		before[ip] = picked[0]
+		counts[picked[0]]++
+	}
+
+	// three out of four clients go to the backend of weight 3
+	if counts[1] < 1350 || counts[1] > 1650 {
+		t.Errorf("got %v picks, want about [500 1500]", counts)
+	}
+
+	// only the clients of a backend which is down move
+	bs[1].healthy = false
+	for ip, i := range before {
+		picked := picks(t, bs, ip, 1)[0]
+		if picked != 0 {
+			t.Fatalf("%s: picked %d with backend 1 down", ip, picked)
+		}
+		if i == 0 && picked != i {
+			t.Fatalf("%s: moved from %d to %d", ip, i, picked)
+		}
+	}
+
+	bs[0].healthy = false
+	if b := pickBackend("198.51.100.1"); b != nil {
+		t.Errorf("picked %s with every backend down", b)
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	setFlag(t, "breaker-threshold", "2")
+	setFlag(t, "breaker-cooldown", "50ms")
+	bs, _ := setBackends(t, "", "")
+	b := bs[0]
+
+	expect := func(state string, allowed bool) {
+		t.Helper()
+		if b.state != state {
+			t.Fatalf("circuit %s, want %s", b.state, state)
+		}
+		if b.available() != allowed {
+			t.Fatalf("available: got %t, want %t", !allowed, allowed)
+		}
+	}
+
+	b.failure()
+	expect(circuitClosed, true)
+	b.failure()
+	expect(circuitOpen, false)
+	for _, i := range picks(t, bs, "198.51.100.1", 4) {
+		if i == 0 {
+			t.Fatal("picked a backend whose circuit is open")
+		}
+	}
+
+	// once the cooldown is over, a single probe is let through
+	time.Sleep(60 * time.Millisecond)
+	expect(circuitOpen, true)
+	if !b.allow() {
+		t.Fatal("probe not allowed after the cooldown")
+	}
+	expect(circuitHalfOpen, false)
+	if b.allow() {
+		t.Fatal("second probe allowed")
+	}
+
+	// a failed probe opens the circuit again at once
+	b.failure()
+	expect(circuitOpen, false)
+
+	time.Sleep(60 * time.Millisecond)
+	if !b.allow() {
+		t.Fatal("probe not allowed after the cooldown")
+	}
+	b.success()
+	expect(circuitClosed, true)
+	if b.failures != 0 {
+		t.Errorf("%d failures after a success", b.failures)
+	}
+	if b.recoveredAt.IsZero() {
+		t.Error("recovery time not set")
+	}
+}
+
+func TestCircuitBreakerDisabled(t *testing.T) {
+	setFlag(t, "breaker-threshold", "0")
+	bs, _ := setBackends(t, "")
+
+	for i := 0; i < 10; i++ {
+		bs[0].failure()
+	}
+	if bs[0].state != circuitClosed || !bs[0].allow() {
+		t.Errorf("circuit %s with the breaker disabled", bs[0].state)
+	}
+}
+
+func TestCircuitBreakerScan(t *testing.T) {
+	setFlag(t, "breaker-threshold", "1")
+	setFlag(t, "breaker-cooldown", "1m")
+	setFlag(t, "retries", "1")
+	setFlag(t, "retry-backoff", "1ms")
+	f := newFilterTest(t)
+	_, servers := setBackends(t, "", "")
+	servers[0].SetStatus(500)
+	f.connect("198.51.100.1:1234")
+
+	// the failed scan is retried on the other backend, and the backend
+	// which failed is left alone afterwards
+	for i := 0; i < 3; i++ {
+		result, _ := f.deliver("sender@example.org", []string{"rcpt@example.net"}, testMessage)
+		if result != "proceed" {
+			t.Fatalf("result: got %q", result)
+		}
+	}
+	if n := len(servers[0].Requests()); n != 1 {
+		t.Errorf("failed backend got %d requests, want 1", n)
+	}
+	if n := len(servers[1].Requests()); n != 3 {
+		t.Errorf("other backend got %d requests, want 3", n)
+	}
+}
+
+func TestSlowStart(t *testing.T) {
+	setFlag(t, "slow-start", "10s")
+	bs, _ := setBackends(t, "", "")
+	now := time.Now()
+
+	tests := []struct {
+		recovered time.Time
+		weight    int
+	}{
+		{time.Time{}, 2 * weightScale},
+		{now.Add(-20 * time.Second), 2 * weightScale},
+		{now.Add(-5 * time.Second), weightScale},
+		{now.Add(-2500 * time.Millisecond), weightScale / 2},
+		{now, 1},
+	}
+	for _, test := range tests {
+		bs[0].recoveredAt = test.recovered
+		if got := bs[0].rampedWeight(2, now); got != test.weight {
+			t.Errorf("%s after recovery: got weight %d, want %d",
+				now.Sub(test.recovered), got, test.weight)
+		}
+	}
+
+	// a backend a quarter of the way through slow start gets a quarter
+	// of its share of the requests
+	bs[0].recoveredAt = time.Now().Add(-2500 * time.Millisecond)
+	counts := make([]int, len(bs))
+	for _, i := range picks(t, bs, "198.51.100.1", 500) {
+		counts[i]++
+	}
+	if counts[0] < 95 || counts[0] > 105 {
+		t.Errorf("got %v picks, want about [100 400]", counts)
+	}
+}
+
+func TestHealthCheck(t *testing.T) {
+	bs, servers := setBackends(t, "", "")
+
+	// a healthy backend is only pinged
+	bs[0].check(time.Second)
+	if !bs[0].healthy || bs[0].state != circuitClosed {
+		t.Errorf("healthy backend: healthy=%t circuit=%s", bs[0].healthy, bs[0].state)
+	}
+	requests := servers[0].Requests()
+	if len(requests) != 1 || requests[0].Path != "/ping" {
+		t.Errorf("unexpected requests: %v", requests)
+	}
+
+	servers[1].Close()
+	bs[1].check(time.Second)
+	if bs[1].healthy || bs[1].state != circuitOpen || bs[1].allow() {
+		t.Errorf("backend down: healthy=%t circuit=%s", bs[1].healthy, bs[1].state)
+	}
+
+	bs[0].healthy = false
+	bs[0].failures = 3
+	bs[0].state = circuitOpen
+	bs[0].check(time.Second)
+	if !bs[0].healthy || bs[0].state != circuitClosed || bs[0].failures != 0 {
+		t.Errorf("backend up again: healthy=%t circuit=%s failures=%d",
+			bs[0].healthy, bs[0].state, bs[0].failures)
+	}
+}
+
+func TestDialUnixRetry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rspamd.sock")
+
+	// the socket shows up while rspamd restarts
+	go func() {
+		time.Sleep(unixDialDelay + unixDialDelay/2)
+		l, err := net.Listen("unix", path)
+		if err != nil {
+			return
+		}
+		t.Cleanup(func() { l.Close() })
+	}()
+
+	c, err := dialUnix(context.Background(), path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	start := time.Now()
+	_, err = dialUnix(context.Background(), filepath.Join(t.TempDir(), "missing.sock"))
+	if err == nil || !strings.Contains(err.Error(), "no such file") {
+		t.Errorf("got error %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 7*unixDialDelay {
+		t.Errorf("gave up after %s", elapsed)
+	}
+}
+
+func TestRecipientCheckBreaker(t *testing.T) {
+	setFlag(t, "breaker-threshold", "1")
+	bs, servers := setBackends(t, "")
+	b := bs[0]
+
+	// the probe of a half-open circuit closes it again unless rspamd fails
+	for _, test := range []struct {
+		status int
+		state  string
+	}{
+		{400, circuitClosed},
+		{200, circuitClosed},
+		{500, circuitOpen},
+	} {
+		b.state = circuitHalfOpen
+		servers[0].SetStatus(test.status)
+		req, err := http.NewRequest("POST", servers[0].URL+"/checkv2", strings.NewReader(""))
+		if err != nil {
+			t.Fatal(err)
+		}
+		recipientCheck(b, req)
+		if b.state != test.state {
+			t.Errorf("status %d: circuit %s, want %s", test.status, b.state, test.state)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+//
+// Copyright (c) 2019 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"time"
+)
+
+// checkConfig checks what the flags refer to, without starting the
+// filter.  The flags themselves, and the lists they name, have already
+// been parsed and loaded by then.
+func checkConfig() error {
+	checked := backends
+	if shadow != nil {
+		checked = append(checked, shadow)
+	}
+	for _, b := range checked {
+		if err := checkBackend(b); err != nil {
+			return fmt.Errorf("rspamd backend %s: %s", b, err)
+		}
+		fmt.Printf("rspamd backend %s: ok\n", b)
+	}
+
+	if *learnHam || len(spamtraps) > 0 {
+		controller := &backend{url: *controllerURL, socketPath: controllerSocketPath}
+		if err := checkBackend(controller); err != nil {
+			return fmt.Errorf("rspamd controller %s: %s", controller, err)
+		}
+		fmt.Printf("rspamd controller %s: ok\n", controller)
+	}
+
+	if _, err := openStorage(*storageSpec, *readOnly); err != nil {
+		return fmt.Errorf("storage '%s': %s", *storageSpec, err)
+	}
+
+	if *stateDir != "" {
+		if fi, err := os.Stat(*stateDir); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("state dir '%s': %s", *stateDir, err)
+		} else if err == nil && !fi.IsDir() {
+			return fmt.Errorf("state dir '%s': not a directory", *stateDir)
+		}
+	}
+
+	if *quarantineDir != "" {
+		if fi, err := os.Stat(*quarantineDir); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("quarantine '%s': %s", *quarantineDir, err)
+		} else if err == nil && !fi.IsDir() {
+			return fmt.Errorf("quarantine '%s': not a directory", *quarantineDir)
+		}
+	}
+	return nil
+}
+
+// checkBackend resolves the host of a backend and pings it.
+func checkBackend(b *backend) error {
+	if b.socketPath != "" {
+		if _, err := os.Stat(b.socketPath); err != nil {
+			return err
+		}
+	} else {
+		u, err := url.Parse(b.url)
+		if err != nil {
+			return err
+		}
+		if _, err := net.LookupHost(u.Hostname()); err != nil {
+			return err
+		}
+	}
+
+	return b.ping(10 * time.Second)
+}
@@ -0,0 +1,126 @@
+//
+// Copyright (c) 2019 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// loadConfig applies the options found in the configuration file at path
+// to the flags of fs: those listed before any [profile] section, then
+// those of the section named profile, if any. Each line holds the name of
+// an option followed by its value, which may be omitted for booleans, and
+// double-quoted to hold anything, with blank lines and comments ignored.
+// Options given on the command line take precedence.
+func loadConfig(fs *flag.FlagSet, path string, profile string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	explicit := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+
+	// the section in which each list option was last set, so that a
+	// profile replaces the values given outside of it
+	setIn := make(map[string]string)
+
+	section, found := "", profile == ""
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(stripComment(scanner.Text()))
+		if line == "" {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			if section == "" {
+				return fmt.Errorf("line %d: empty profile name", n)
+			}
+			if section == profile {
+				found = true
+			}
+			continue
+		}
+
+		name, value := line, ""
+		if i := strings.IndexAny(line, " \t"); i >= 0 {
+			name, value = line[:i], strings.TrimSpace(line[i:])
+		}
+		option := fs.Lookup(name)
+		if option == nil || name == "config" || name == "profile" {
+			return fmt.Errorf("line %d: unknown option: %s", n, name)
+		}
+		if strings.HasPrefix(value, "\"") {
+			unquoted, err := strconv.Unquote(value)
+			if err != nil {
+				return fmt.Errorf("line %d: %s: invalid quoted value", n, name)
+			}
+			value = unquoted
+		}
+		if section != "" && section != profile || explicit[name] {
+			continue
+		}
+		if value == "" {
+			if b, ok := option.Value.(interface{ IsBoolFlag() bool }); ok && b.IsBoolFlag() {
+				value = "true"
+			}
+		}
+		if r, ok := option.Value.(interface{ Reset() }); ok {
+			if last, ok := setIn[name]; ok && last != section {
+				r.Reset()
+			}
+			setIn[name] = section
+		}
+		if err := fs.Set(name, value); err != nil {
+			return fmt.Errorf("line %d: %s: %s", n, name, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("unknown profile: %s", profile)
+	}
+	return nil
+}
+
+// stripComment returns line without its comment, if any: from a # which
+// starts the line or follows whitespace, outside of a double-quoted value.
+func stripComment(line string) string {
+	quoted := false
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case quoted && c == '\\':
+			i++
+		case c == '"' && (quoted || i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			quoted = !quoted
+		case !quoted && c == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return line[:i]
+		}
+	}
+	return line
+}
@@ -0,0 +1,165 @@
+//
+// Copyright (c) 2019 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type testConfig struct {
+	fs      *flag.FlagSet
+	message *string
+	tag     *string
+	dry     *bool
+	urls    listFlag
+	actions mapFlag
+}
+
+// loadTestConfig loads a configuration file holding data into flags of
+// their own, after the command line args.
+func loadTestConfig(t *testing.T, data string, profile string, args ...string) (*testConfig, error) {
+	c := &testConfig{fs: flag.NewFlagSet("test", flag.ContinueOnError), actions: mapFlag{}}
+	c.message = c.fs.String("reject-message", "", "")
+	c.tag = c.fs.String("subject-tag", "", "")
+	c.dry = c.fs.Bool("dry-run", false, "")
+	c.fs.Var(&c.urls, "url", "")
+	c.fs.Var(c.actions, "map-action", "")
+	c.fs.String("config", "", "")
+	if err := c.fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "filter-rspamd.conf")
+	if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return c, loadConfig(c.fs, path, profile)
+}
+
+func TestLoadConfigValues(t *testing.T) {
+	tests := []struct {
+		line string
+		want string
+	}{
+		{`reject-message rejected`, "rejected"},
+		{`reject-message   rejected, see https://example.org/#spam  `, "rejected, see https://example.org/#spam"},
+		{`reject-message issue #42`, "issue"},
+		{`reject-message issue#42 # comment`, "issue#42"},
+		{`reject-message "  padded  "`, "  padded  "},
+		{`reject-message "# not a comment" # comment`, "# not a comment"},
+		{`reject-message "say \"no\" \\ #1"`, `say "no" \ #1`},
+		{`reject-message it"s # comment`, `it"s`},
+		{`# reject-message commented`, ""},
+		{`	# reject-message commented`, ""},
+	}
+
+	for _, test := range tests {
+		c, err := loadTestConfig(t, test.line+"\n", "")
+		if err != nil {
+			t.Errorf("%s: %s", test.line, err)
+			continue
+		}
+		if *c.message != test.want {
+			t.Errorf("%s: got %q, want %q", test.line, *c.message, test.want)
+		}
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	tests := []struct {
+		data    string
+		profile string
+		err     string
+	}{
+		{"reject-message \"unterminated\n", "", "line 1: reject-message: invalid quoted value"},
+		{"reject-message \"a\" b\n", "", "line 1: reject-message: invalid quoted value"},
+		{"\nunknown-option 1\n", "", "line 2: unknown option: unknown-option"},
+		{"config other.conf\n", "", "line 1: unknown option: config"},
+		{"[ ]\n", "", "line 1: empty profile name"},
+		{"[mx]\ndry-run\n", "submission", "unknown profile: submission"},
+		{"map-action junk\n", "", "line 1: map-action: expected <key>=<value>"},
+	}
+
+	for _, test := range tests {
+		_, err := loadTestConfig(t, test.data, test.profile)
+		if err == nil || err.Error() != test.err {
+			t.Errorf("%q: got error %v, want %q", test.data, err, test.err)
+		}
+	}
+}
+
+func TestLoadConfigProfiles(t *testing.T) {
+	data := `
+url http://a:11333
+url http://b:11333
+map-action reject=soft reject
+subject-tag [SPAM] # global
+
+[mx] # incoming mail
+map-action add header=rewrite subject
+map-action greylist=no action
+dry-run
+
+[submission]
+url http://c:11333
+subject-tag
+`
+
+	c, err := loadTestConfig(t, data, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.urls.String() != "http://a:11333 http://b:11333" || c.actions.String() != "reject=soft reject" ||
+		*c.tag != "[SPAM]" || *c.dry {
+		t.Errorf("no profile: got urls %q, actions %q, tag %q, dry run %t", c.urls.String(), c.actions.String(), *c.tag, *c.dry)
+	}
+
+	// lists set by a profile replace the global ones, those it leaves
+	// alone are kept
+	c, err = loadTestConfig(t, data, "mx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.actions.String() != "add header=rewrite subject,greylist=no action" ||
+		c.urls.String() != "http://a:11333 http://b:11333" || !*c.dry {
+		t.Errorf("mx: got urls %q, actions %q, dry run %t", c.urls.String(), c.actions.String(), *c.dry)
+	}
+
+	c, err = loadTestConfig(t, data, "submission")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.urls.String() != "http://c:11333" || c.actions.String() != "reject=soft reject" || *c.tag != "" {
+		t.Errorf("submission: got urls %q, actions %q, tag %q", c.urls.String(), c.actions.String(), *c.tag)
+	}
+
+	// the command line takes precedence
+	c, err = loadTestConfig(t, data, "submission", "-url", "http://d:11333", "-subject-tag", "[JUNK]")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.urls.String() != "http://d:11333" || *c.tag != "[JUNK]" {
+		t.Errorf("command line: got urls %q, tag %q", c.urls.String(), *c.tag)
+	}
+	if !strings.Contains(c.actions.String(), "reject=soft reject") {
+		t.Errorf("command line: got actions %q", c.actions.String())
+	}
+}
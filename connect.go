@@ -0,0 +1,158 @@
+//
+// Copyright (c) 2019 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// connectFilter checks the reputation of the client as soon as it
+// connects, scanning an empty message with only the session details, so
+// that known bad clients are turned away before a transaction is even
+// started.  The rspamd settings selected by -connect-settings-id should
+// restrict the scan to IP-based rules.
+func connectFilter(s *session, params []string) {
+	if len(params) < 2 {
+		log.Fatal("invalid input, shouldn't happen")
+	}
+
+	token := params[0]
+	if s.rdns == "" {
+		s.rdns = params[1]
+	}
+
+	go connectQuery(s, token, params[len(params)-1])
+}
+
+func connectQuery(s *session, token string, src string) {
+	if s.src != "" {
+		src = s.src
+	}
+
+	// there is no reputation to check without an address
+	ip := requestIP(src)
+	if ip == "" {
+		produceOutput("filter-result", s.id, token, "proceed")
+		return
+	}
+
+	rr, err := connectReputation(s.hostname(), ip)
+	if err != nil {
+		// The check is only an early shortcut: the message is still
+		// scanned, so there is no reason to turn the client away.
+		metricInc("connect.errors")
+		log.Printf("%s: connect check failed: %s", s.id, err)
+		produceOutput("filter-result", s.id, token, "proceed")
+		return
+	}
+
+	text := rr.Messages.SMTP
+	if *hideSMTPMessage && text != "" {
+		log.Printf("%s: client %s %s at connect: %s", s.id, src, rr.Action, text)
+		text = ""
+	}
+	if text == "" {
+		text = "connection refused"
+	}
+	text = strings.NewReplacer("\r", " ", "\n", " ").Replace(text)
+
+	switch rr.Action {
+	case "reject", "soft reject", "add header", "rewrite subject":
+		if !enforce(s.id, "applied action %s to client %s at connect", rr.Action, src) {
+			rr.Action = "no action"
+		}
+	}
+
+	switch rr.Action {
+	case "reject":
+		metricInc("connect.rejected")
+		log.Printf("%s: client %s rejected at connect, score %.2f", s.id, src, rr.Score)
+		rejected(s.id, clientIP(src), "connect")
+		produceOutput("filter-result", s.id, token, "disconnect|554 5.7.1 %s", text)
+
+	case "soft reject":
+		metricInc("connect.rejected")
+		log.Printf("%s: client %s soft rejected at connect, score %.2f", s.id, src, rr.Score)
+		rejected(s.id, clientIP(src), "connect")
+		produceOutput("filter-result", s.id, token, "disconnect|421 4.7.1 %s", text)
+
+	case "add header", "rewrite subject":
+		metricInc("connect.junked")
+		produceOutput("filter-result", s.id, token, "junk")
+
+	default:
+		produceOutput("filter-result", s.id, token, "proceed")
+	}
+}
+
+func connectReputation(rdns string, ip string) (*rspamd, error) {
+	b := pickBackend(ip)
+	if b == nil {
+		return nil, fmt.Errorf("no rspamd backend available")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *connectTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", fmt.Sprintf("%s/checkv2", b.url), strings.NewReader(""))
+	if err != nil {
+		b.failure()
+		return nil, err
+	}
+
+	req.Header.Add("User-Agent", userAgent())
+	req.Header.Add("Accept-Encoding", acceptEncoding)
+	req.Header.Add("Ip", ip)
+	req.Header.Add("Hostname", requestHeaderValue(rdns))
+	req.Header.Add("Time-Budget", fmt.Sprintf("%.3f", connectTimeout.Seconds()))
+	if *connectSettingsId != "" {
+		req.Header.Add("Settings-ID", *connectSettingsId)
+	}
+
+	resp, err := b.client().Do(req)
+	if err != nil {
+		b.failure()
+		return nil, err
+	}
+	defer closeResponse(resp)
+
+	if resp.StatusCode >= 500 {
+		b.failure()
+	} else {
+		b.success()
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+
+	body, err := responseBody(resp)
+	if err != nil {
+		return nil, err
+	}
+
+	rr := &rspamd{}
+	if err := json.NewDecoder(body).Decode(rr); err != nil {
+		return nil, err
+	}
+	return rr, nil
+}
@@ -0,0 +1,171 @@
+//
+// Copyright (c) 2019 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The control socket accepts a single command per connection, answers it
+// and closes the connection.
+
+func listenControl(path string) (net.Listener, error) {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+func serveControl(l net.Listener) {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			log.Printf("control socket accept err: %s", err)
+			return
+		}
+		go handleControl(c)
+	}
+}
+
+func handleControl(c net.Conn) {
+	defer c.Close()
+
+	c.SetDeadline(time.Now().Add(10 * time.Second))
+
+	line, err := bufio.NewReader(c).ReadString('\n')
+	if err != nil && line == "" {
+		return
+	}
+
+	if err := controlCommand(c, strings.Fields(line)); err != nil {
+		fmt.Fprintf(c, "error: %s\n", err)
+	}
+}
+
+// ctlCommand sends a command to the control socket of a running filter
+// and prints its answer.
+func ctlCommand(args []string) error {
+	if *controlSocket == "" {
+		return fmt.Errorf("no control socket configured")
+	}
+	if len(args) == 0 {
+		return fmt.Errorf("usage: ctl command [argument ...]")
+	}
+
+	c, err := net.DialTimeout("unix", *controlSocket, 10*time.Second)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	c.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err := fmt.Fprintln(c, strings.Join(args, " ")); err != nil {
+		return err
+	}
+
+	answer, err := ioutil.ReadAll(c)
+	if err != nil {
+		return err
+	}
+	if msg := string(answer); strings.HasPrefix(msg, "error: ") {
+		return fmt.Errorf("%s", strings.TrimSpace(strings.TrimPrefix(msg, "error: ")))
+	}
+	_, err = os.Stdout.Write(answer)
+	return err
+}
+
+func controlCommand(w io.Writer, args []string) error {
+	switch {
+	case len(args) == 3 && args[0] == "show" && args[1] == "verdict":
+		if verdicts == nil {
+			return fmt.Errorf("verdict cache disabled")
+		}
+		v, ok := verdicts.get(args[2])
+		if !ok {
+			return fmt.Errorf("no verdict for %s", args[2])
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+
+	case len(args) == 2 && args[0] == "show" && args[1] == "stats":
+		sessionsMutex.Lock()
+		active := len(sessions)
+		sessionsMutex.Unlock()
+
+		fmt.Fprintf(w, "dry-run: %s\n", onOff(isDryRun()))
+		fmt.Fprintf(w, "sessions.active: %d\n", active)
+		if verdicts != nil {
+			fmt.Fprintf(w, "verdicts.cached: %d/%d\n", verdicts.len(), verdicts.size)
+		}
+
+		snapshot := metricsSnapshot()
+		names := make([]string, 0, len(snapshot))
+		for k := range snapshot {
+			names = append(names, k)
+		}
+		sort.Strings(names)
+		for _, k := range names {
+			fmt.Fprintf(w, "%s: %d\n", k, snapshot[k])
+		}
+		return nil
+
+	case len(args) == 2 && args[0] == "show" && args[1] == "backends":
+		for _, b := range backends {
+			fmt.Fprintln(w, b.status())
+		}
+		if shadow != nil {
+			fmt.Fprintf(w, "%s (shadow)\n", shadow.status())
+		}
+		return nil
+
+	case len(args) == 2 && args[0] == "dry-run" && (args[1] == "on" || args[1] == "off"):
+		setDryRun(args[1] == "on")
+		fmt.Fprintln(w, "ok")
+		return nil
+
+	case len(args) == 2 && args[0] == "flush" && args[1] == "verdicts":
+		if verdicts == nil {
+			return fmt.Errorf("verdict cache disabled")
+		}
+		verdicts.flush()
+		fmt.Fprintln(w, "ok")
+		return nil
+
+	default:
+		return fmt.Errorf("unknown command: %s", strings.Join(args, " "))
+	}
+}
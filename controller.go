@@ -0,0 +1,89 @@
+//
+// Copyright (c) 2019 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The rspamd controller receives the messages rspamd should learn from.
+// Learning happens in the background: it has no effect on the session.
+
+var controllerSocketPath string
+
+var controllerOnce sync.Once
+var controllerHTTPClient *http.Client
+
+func controllerClient() *http.Client {
+	controllerOnce.Do(func() {
+		controllerHTTPClient = &http.Client{Timeout: time.Minute}
+		if controllerSocketPath != "" {
+			controllerHTTPClient.Transport = unixTransport(controllerSocketPath)
+		}
+	})
+	return controllerHTTPClient
+}
+
+func controllerPost(endpoint string, header http.Header, body string) error {
+	req, err := http.NewRequest("POST", *controllerURL+endpoint, strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", userAgent())
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if *controllerPassword != "" {
+		req.Header.Add("Password", *controllerPassword)
+	}
+
+	resp, err := controllerClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer closeResponse(resp)
+
+	// rspamd answers 208 for messages it has already learned.
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// learnMessage submits a message to a controller endpoint in the
+// background.
+func learnMessage(s *session, endpoint string, header http.Header) {
+	body := messageBody(s.tx.msg.Lines())
+	id, msgid := s.logID(), s.tx.msgid
+
+	go func() {
+		if err := controllerPost(endpoint, header, body); err != nil {
+			metricInc("controller.errors")
+			log.Printf("%s: message %s could not be submitted to %s: %s",
+				id, msgid, endpoint, err)
+			return
+		}
+		metricInc("controller" + strings.Replace(endpoint, "/", ".", -1))
+	}()
+}
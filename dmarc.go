@@ -0,0 +1,67 @@
+//
+// Copyright (c) 2019 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package main
+
+import "log"
+
+// dmarcExceptions lists the envelope senders, such as the addresses of
+// mailing lists known to break DMARC, whose messages are exempted from
+// -dmarc-enforce.
+var dmarcExceptions map[string]bool
+
+// dmarcPolicy returns the DMARC policy of the domain of a message which
+// failed DMARC, as reported by rspamd, and an empty string if it passed or
+// if its policy is none.
+func dmarcPolicy(rr *rspamd) string {
+	if _, ok := rr.Symbols["DMARC_POLICY_REJECT"]; ok {
+		return "reject"
+	}
+	if _, ok := rr.Symbols["DMARC_POLICY_QUARANTINE"]; ok {
+		return "quarantine"
+	}
+	return ""
+}
+
+// enforceDMARC rejects the messages failing DMARC for a domain with a
+// reject policy, and marks for quarantine those for a domain with a
+// quarantine policy, unless their sender is exempted.
+func enforceDMARC(s *session, rr *rspamd) {
+	policy := dmarcPolicy(rr)
+	if policy == "" {
+		return
+	}
+	if matchAddress(dmarcExceptions, s.tx.mailFrom) {
+		metricInc("dmarc.exempted")
+		return
+	}
+
+	switch policy {
+	case "reject":
+		if severity(rr.Action) < severity("reject") {
+			metricInc("dmarc.rejected")
+			log.Printf("%s: message %s action %s overridden by DMARC policy: reject", s.logID(), s.tx.msgid, rr.Action)
+			rr.Action = "reject"
+			if rr.Messages.SMTP == "" {
+				rr.Messages.SMTP = "rejected per DMARC policy"
+			}
+		}
+	case "quarantine":
+		metricInc("dmarc.quarantined")
+		log.Printf("%s: message %s marked for quarantine per DMARC policy", s.logID(), s.tx.msgid)
+		s.tx.dmarcQuarantine = true
+	}
+}
@@ -0,0 +1,60 @@
+//
+// Copyright (c) 2019 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync/atomic"
+)
+
+// dryRun is set while the filter scans messages and reports the actions
+// it would take, but lets every message through with headers added.  It
+// may be toggled on the control socket.
+var dryRun int32
+
+func isDryRun() bool {
+	return atomic.LoadInt32(&dryRun) != 0
+}
+
+func setDryRun(on bool) {
+	var v int32
+	if on {
+		v = 1
+	}
+	if atomic.SwapInt32(&dryRun, v) != v {
+		log.Printf("dry run %s", onOff(on))
+	}
+}
+
+func onOff(on bool) string {
+	if on {
+		return "on"
+	}
+	return "off"
+}
+
+// enforce returns whether an action is to be taken, logging what would
+// have been done instead while in dry run.
+func enforce(id string, format string, a ...interface{}) bool {
+	if !isDryRun() {
+		return true
+	}
+	metricInc("dryrun.skipped")
+	log.Printf("%s: dry run, would have %s", id, fmt.Sprintf(format, a...))
+	return false
+}
@@ -0,0 +1,74 @@
+//
+// Copyright (c) 2019 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package main
+
+import (
+	"log"
+	"runtime"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// dumpState logs the state of the filter, so that a stuck filter may be
+// examined without being restarted.
+func dumpState() {
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+
+	ids := make([]string, 0, len(sessions))
+	for id := range sessions {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	buffered := 0
+	for _, id := range ids {
+		s := sessions[id]
+
+		size := 0
+		for _, line := range s.tx.msg.Raw() {
+			size += len(line) + 1
+		}
+		buffered += size
+
+		if s.tx.msgid == "" {
+			log.Printf("state: session %s: src %s, helo %s, user %s, no transaction",
+				s.id, s.src, s.heloName, s.userName)
+			continue
+		}
+		since := "not in data"
+		if !s.tx.dataStart.IsZero() {
+			since = "in data for " + time.Since(s.tx.dataStart).Round(time.Millisecond).String()
+		}
+		log.Printf("state: session %s: src %s, helo %s, user %s, message %s, %d lines, %d bytes, %s",
+			s.logID(), s.src, s.heloName, s.userName, s.tx.msgid, len(s.tx.msg.Raw()), size, since)
+	}
+
+	for _, b := range backends {
+		log.Printf("state: backend %s", b.status())
+	}
+	if shadow != nil {
+		log.Printf("state: shadow backend %s", shadow.status())
+	}
+
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	log.Printf("state: %d sessions, %d scans in flight, %d of %d slots used, %d bytes of messages buffered, %d bytes of heap, %d goroutines",
+		len(ids), atomic.LoadInt64(&scansInFlight), len(scanSlots), cap(scanSlots),
+		buffered, mem.HeapAlloc, runtime.NumGoroutine())
+}
@@ -18,45 +18,218 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"context"
+	crand "crypto/rand"
 	"flag"
 	"fmt"
+	"io/ioutil"
+	"math"
+	"math/rand"
 	"os"
+	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
 
+	"encoding/hex"
 	"encoding/json"
 	"log"
 	"net"
 	"net/http"
+	"net/mail"
+	"net/url"
+
+	"github.com/poolpOrg/filter-rspamd/mailrewrite"
 )
 
-var rspamdURL *string
-var unixSocketPath string
+var rspamdURLs listFlag
 var rspamdSettingsId *string
+var rejectMessage *string
+var softRejectMessage *string
+var tempfailMessage *string
+var rejectCode *string
+var softRejectCode *string
+var tempfailCode *string
+var storageSpec *string
+var stateDir *string
+var readOnly *bool
+var spamdResult *bool
+var dataTimeout *time.Duration
+var spamLevel *bool
+var experimentSettingsId *string
+var experimentRate *float64
+var headerProfile *string
+var hamHeaders *bool
+var spamFlag *bool
+var hideSMTPMessage *bool
+var retryAfter *time.Duration
+var rewriteBody *bool
+var scanFlagList *string
+var scanFlags []string
+var recipientScanCount *int
+var canonicalRcpt *bool
+var signOnly *bool
+var smtpOut *bool
+var stripForged *bool
+var resolverSpec *string
+var localIP *string
+var localUser *string
+var authservIDFlag *string
+var trustedNetworkList *string
+var correspondentTTL *time.Duration
+var noHeaders *bool
+var emptyMessage *string
+var statusMaxSymbols *int
+var statusMinScore *float64
+var statusSort *string
+var statusOptions *bool
+var originalSubject *bool
+var subjectTag *string
+var subjectTagPosition *string
+var header8bit *string
+var eol *string
+var normalizeCR *bool
+var verdictCacheSize *int
+var controlSocket *string
+var quarantineDir *string
+var quarantineMaxSize *int64
+var quarantineMaxAge *time.Duration
+var sendmail *string
+var controllerURL *string
+var controllerPassword *string
+var learnHam *bool
+var spamtrapsFile *string
+var spamtrapFuzzy *int
+var spamtraps map[string]bool
+var connectCheck *bool
+var maxScans *int
+var retries *int
+var breakerThreshold *int
+var breakerCooldown *time.Duration
+var slowStart *time.Duration
+var healthInterval *time.Duration
+var lbStrategy *string
+var shadowURL *string
+var showVersion *bool
+var checkConf *bool
+var shadowScoreDelta *float64
+var shadowReportInterval *time.Duration
+var retryBackoff *time.Duration
+var scanQueueTimeout *time.Duration
+var rcptRejectFile *string
+var rcptBypassFile *string
+var rcptRejects map[string]bool
+var rcptBypass map[string]bool
+var connectSettingsId *string
+var connectTimeout *time.Duration
+var configFile *string
+var passwordFile *string
+var debugHeader *bool
+var journalFile *string
+var journalMaxSize *int64
+var journalMaxAge *time.Duration
+var historyRetention *time.Duration
+var publishURL *string
+var publishChannel *string
+var webhookURL *string
+var webhookSecretFile *string
+var policyHook *string
+var policyHookTimeout *time.Duration
+var rulesFile *string
+var weightsFile *string
+var rejectScore *float64
+var disconnectScore *float64
+var rateLimit *int
+var dryRunFlag *bool
+var rateLimitWindow *time.Duration
+var virusSymbolList *string
+var virusAction *string
+var dmarcEnforce *bool
+var rejectLog *string
+var pprofSocket *string
+var sessionMaxIdle *time.Duration
+var maxLines *int
+var maxBytes *int64
+var oversizeMessage *string
+var maxHeaderLines *int
+var maxHeaderLength *int
+var maxMilterHeaders *int
+var tarpitScore *float64
+var tarpitRejects *int
+var tarpitWindow *time.Duration
+var tarpitDelay *time.Duration
+var tarpitMaxDelay *time.Duration
+var dmarcExceptionsFile *string
+var settingsFile *string
+
+// rspamdSettings are the settings sent with every scan, if any.
+var rspamdSettings string
+var profile *string
+
+// headerNames maps the lowercased name of the headers generated by the
+// filter to the name they are written under, empty to suppress them.
+var headerNames = mapFlag{}
+var actionMap = mapFlag{}
+var symbolActions = mapFlag{}
+
+// dkimSelectors maps hosted domains to the selector their outgoing mail
+// is expected to be signed with.
+var dkimSelectors = mapFlag{}
 var version string
 
 var outputChannel chan string
 
 type tx struct {
 	msgid    string
+	scanID   string
 	mailFrom string
 	rcptTo   []string
-	message  []string
 	action   string
+	verdict  string
 	response string
+	virus    string
+
+	dmarcQuarantine bool
+	greylisted      bool
+	retryAfter      time.Duration
+
+	lines       int
+	bytes       int64
+	oversize    bool
+	passthrough bool
+
+	score         float32
+	requiredScore float32
+	symbols       []string
+
+	dataStart time.Time
+	msg       mailrewrite.Message
+	edit      mailrewrite.Edit
 }
 
 type session struct {
 	id string
 
 	rdns     string
+	fcrdns   string
 	src      string
 	heloName string
 	userName string
 	mtaName  string
 
+	tlsVersion string
+	tlsCipher  string
+
+	// tx is owned by rspamdQuery while the message is scanned
 	tx tx
+
+	lastSeen time.Time
+	strikes  int32 // atomic
 }
 
 type rspamd struct {
@@ -69,15 +242,74 @@ type rspamd struct {
 	} `json:"messages"`
 	DKIMSig interface{} `json:"dkim-signature"`
 	Headers struct {
-		Remove map[string]int8        `json:"remove_headers"`
-		Add    map[string]interface{} `json:"add_headers"`
+		Remove     map[string]int         `json:"remove_headers"`
+		Add        map[string]interface{} `json:"add_headers"`
+		ChangeFrom string                 `json:"change_from"`
 	} `json:"milter"`
 	Symbols map[string]struct {
-		Score float32
+		Score       float32
+		Description string
+		Options     []string
 	} `json:"symbols"`
 }
 
+// mapFlag is a flag which may be repeated to build a map out of
+// <key>=<value> pairs. Keys are lowercased.
+type mapFlag map[string]string
+
+func (m mapFlag) String() string {
+	pairs := make([]string, 0, len(m))
+	for k, v := range m {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// Reset drops the pairs set so far.
+func (m mapFlag) Reset() {
+	for k := range m {
+		delete(m, k)
+	}
+}
+
+func (m mapFlag) Set(value string) error {
+	kv := strings.SplitN(value, "=", 2)
+	if len(kv) != 2 || kv[0] == "" {
+		return fmt.Errorf("expected <key>=<value>")
+	}
+	m[strings.ToLower(kv[0])] = kv[1]
+	return nil
+}
+
+// listFlag is a flag which may be repeated to build a list.
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, " ")
+}
+
+// Reset drops the values set so far.
+func (l *listFlag) Reset() {
+	*l = nil
+}
+
+func (l *listFlag) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// sessions, and the fields of sessions set by the event handlers, are only
+// modified by the main goroutine while it holds sessionsMutex, so that they
+// may be read from other goroutines, with two exceptions.  Once the
+// data-line "." of a message is received, its tx belongs to the goroutine
+// running rspamdQuery, which sets the verdict, response and edits of the
+// message without the lock, until it writes the "." of the message back:
+// smtpd sends no event for the transaction meanwhile, and the commit which
+// follows reads what was set.  strikes is only updated atomically, by that
+// same goroutine.  connectQuery only reads the session.
 var sessions = make(map[string]*session)
+var sessionsMutex sync.Mutex
 
 var reporters = map[string]func(*session, []string){
 	"link-connect":    linkConnect,
@@ -85,6 +317,7 @@ var reporters = map[string]func(*session, []string){
 	"link-greeting":   linkGreeting,
 	"link-identify":   linkIdentify,
 	"link-auth":       linkAuth,
+	"link-tls":        linkTLS,
 	"tx-reset":        txReset,
 	"tx-begin":        txBegin,
 	"tx-mail":         txMail,
@@ -102,9 +335,43 @@ func linkConnect(s *session, params []string) {
 	}
 
 	s.rdns = params[0]
+	s.fcrdns = params[1]
 	s.src = params[2]
 }
 
+// hostname returns the host name of the client as sent to rspamd: its
+// reverse DNS name if it is forward-confirmed, or unknown, which rspamd
+// treats as missing, if it is not.  The name is trusted as is when the
+// result of the check is not known.
+func (s *session) hostname() string {
+	if s.fcrdns != "" && s.fcrdns != "pass" {
+		return "unknown"
+	}
+	return s.rdns
+}
+
+// expireSessions drops the sessions which had no event for longer than
+// maxIdle, as they would otherwise leak if their link-disconnect was
+// missed.
+func expireSessions(maxIdle time.Duration) {
+	interval := time.Minute
+	if maxIdle < interval {
+		interval = maxIdle
+	}
+
+	for range time.Tick(interval) {
+		sessionsMutex.Lock()
+		for id, s := range sessions {
+			if idle := time.Since(s.lastSeen); idle > maxIdle {
+				metricInc("sessions.expired")
+				log.Printf("%s: session idle for %s, dropped", id, idle.Round(time.Second))
+				delete(sessions, id)
+			}
+		}
+		sessionsMutex.Unlock()
+	}
+}
+
 func linkDisconnect(s *session, params []string) {
 	if len(params) != 0 {
 		log.Fatal("invalid input, shouldn't happen")
@@ -128,6 +395,20 @@ func linkIdentify(s *session, params []string) {
 	s.heloName = params[1]
 }
 
+// linkTLS keeps the protocol version and cipher of a session once TLS is
+// established, as reported in the form version:cipher:bits.
+func linkTLS(s *session, params []string) {
+	if len(params) != 1 {
+		log.Fatal("invalid input, shouldn't happen")
+	}
+
+	fields := strings.Split(params[0], ":")
+	s.tlsVersion = fields[0]
+	if len(fields) > 1 {
+		s.tlsCipher = fields[1]
+	}
+}
+
 func linkAuth(s *session, params []string) {
 	if len(params) < 2 {
 		log.Fatal("invalid input, shouldn't happen")
@@ -163,6 +444,27 @@ func txBegin(s *session, params []string) {
 	}
 
 	s.tx.msgid = params[0]
+	s.tx.scanID = newScanID()
+}
+
+// newScanID returns a random identifier for a message, which is logged
+// along with the session and sent to rspamd so that a message can be
+// followed from smtpd to rspamd.
+func newScanID() string {
+	id := make([]byte, 8)
+	if _, err := crand.Read(id); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(id)
+}
+
+// logID returns the identifier of the session in log lines, followed by
+// the scan ID of its current message, if any.
+func (s *session) logID() string {
+	if s.tx.scanID == "" {
+		return s.id
+	}
+	return s.id + "/" + s.tx.scanID
 }
 
 func txMail(s *session, params []string) {
@@ -223,15 +525,129 @@ func dataLine(s *session, params []string) {
 	token := params[0]
 	line := strings.Join(params[1:], "|")
 
+	if s.tx.dataStart.IsZero() {
+		s.tx.dataStart = time.Now()
+		s.tx.msg.Limit(*maxHeaderLines, *maxHeaderLength)
+	}
+
+	if s.tx.passthrough {
+		writeRawLine(s, token, line)
+		return
+	}
+
 	if line == "." {
+		if s.tx.oversize {
+			s.tx.action = "tempfail"
+			s.tx.response = "message too large"
+			flushMessage(s, token)
+			return
+		}
+		if s.tx.msg.Truncated() {
+			metricInc("headers.truncated")
+			log.Printf("%s: message %s has too many or too long header lines, only %d processed",
+				s.logID(), s.tx.msgid, s.tx.msg.HeaderEnd())
+		}
+		if isEmptyMessage(s.tx.msg.Lines()) {
+			metricInc("messages.empty")
+
+			switch *emptyMessage {
+			case "skip":
+				if *readOnly {
+					refuseUnscanned(s, token, "empty message")
+					return
+				}
+				flushMessage(s, token)
+				return
+			case "reject":
+				s.tx.action = "reject"
+				s.tx.response = "empty message"
+				flushMessage(s, token)
+				return
+			}
+		}
+		if isBypassed(s) {
+			metricInc("messages.bypassed")
+			if *readOnly {
+				refuseUnscanned(s, token, "recipients bypass the scan")
+				return
+			}
+			flushMessage(s, token)
+			return
+		}
+		if isSpamtrapped(s) {
+			metricInc("messages.spamtrapped")
+			log.Printf("%s: message %s sent to a spamtrap", s.logID(), s.tx.msgid)
+			recordVerdict(s, "discard")
+			learnMessage(s, "/learnspam", nil)
+			if *spamtrapFuzzy > 0 {
+				learnMessage(s, "/fuzzyadd", http.Header{
+					"Flag": {strconv.Itoa(*spamtrapFuzzy)},
+				})
+			}
+			discardMessage(s, token)
+			return
+		}
 		go rspamdQuery(s, token)
 		return
 	}
 
-	// Input is raw SMTP data - unescape leading dots.
-	line = strings.TrimPrefix(line, ".")
+	s.tx.lines++
+	s.tx.bytes += int64(len(line)) + 1
+	if !s.tx.oversize && ((*maxLines > 0 && s.tx.lines > *maxLines) || (*maxBytes > 0 && s.tx.bytes > *maxBytes)) {
+		metricInc("messages.oversize")
+		log.Printf("%s: message %s too large at %d lines and %d bytes, policy %s",
+			s.logID(), s.tx.msgid, s.tx.lines, s.tx.bytes, *oversizeMessage)
+
+		// The message is not buffered any further, and what was is
+		// either passed as is or dropped.
+		if *oversizeMessage == "pass" && !*readOnly {
+			for _, raw := range s.tx.msg.Raw() {
+				writeRawLine(s, token, raw)
+			}
+			writeRawLine(s, token, line)
+			s.tx.passthrough = true
+		}
+		s.tx.oversize = true
+		s.tx.msg = mailrewrite.Message{}
+	}
+	if s.tx.oversize {
+		return
+	}
+
+	// Lines are split on LF, so any CR left is a stray one that
+	// smtpd would transmit as is.
+	if *normalizeCR {
+		line = strings.Replace(line, "\r", "", -1)
+	}
+
+	if *header8bit == "sanitize" && s.tx.msg.InHeaders() {
+		line = strings.ToValidUTF8(line, "?")
+	}
+
+	s.tx.msg.Append(line)
+}
+
+// refuseUnscanned temporarily rejects a message which would otherwise be
+// accepted without being scanned, which a -read-only secondary MX never
+// does: the client is left to retry with the primary one.
+func refuseUnscanned(s *session, token string, reason string) {
+	metricInc("messages.unscanned")
+	log.Printf("%s: message %s not scanned (%s), refused in read-only mode", s.logID(), s.tx.msgid, reason)
+	s.tx.action = "tempfail"
+	s.tx.response = "message could not be scanned"
+	flushMessage(s, token)
+}
 
-	s.tx.message = append(s.tx.message, line)
+// isEmptyMessage returns true for messages which are made of headers only,
+// or of nothing at all, as sent by probes and broken clients.
+func isEmptyMessage(message []string) bool {
+	_, end := mailrewrite.Parse(message)
+	for _, line := range message[end:] {
+		if strings.TrimSpace(line) != "" {
+			return false
+		}
+	}
+	return true
 }
 
 func produceOutput(msgType string, sessionId string, token string, format string, a ...interface{}) {
@@ -247,6 +663,79 @@ func produceOutput(msgType string, sessionId string, token string, format string
 	outputChannel <- out
 }
 
+// mailFrom enforces the -rate-limit, and delays tarpitted sessions.
+func mailFrom(s *session, params []string) {
+	if len(params) < 2 {
+		log.Fatal("invalid input, shouldn't happen")
+	}
+
+	token := params[0]
+
+	if limiter != nil && s.userName == "" && clientIP(s.src) != "" && !limiter.allow(clientIP(s.src)) &&
+		enforce(s.logID(), "rate limited client %s", clientIP(s.src)) {
+		metricInc("messages.ratelimited")
+		log.Printf("%s: client %s over the rate limit", s.logID(), clientIP(s.src))
+		rejected(s.id, clientIP(s.src), "rate-limit")
+		filterResult(s, token, "reject|450 4.7.1 rate limit exceeded, try again later")
+		return
+	}
+	filterResult(s, token, "proceed")
+}
+
+// rcptTo rejects recipients from the reject list as soon as they are
+// given, rather than after DATA.
+func rcptTo(s *session, params []string) {
+	if len(params) < 2 {
+		log.Fatal("invalid input, shouldn't happen")
+	}
+
+	token := params[0]
+	address := strings.Join(params[1:], "|")
+
+	if matchAddress(rcptRejects, address) &&
+		enforce(s.logID(), "rejected recipient %s", address) {
+		metricInc("rcpt.rejected")
+		log.Printf("%s: recipient %s rejected", s.logID(), address)
+		rejected(s.id, clientIP(s.src), "recipient")
+		filterResult(s, token, "reject|550 5.1.1 recipient rejected")
+		return
+	}
+	filterResult(s, token, "proceed")
+}
+
+// isBypassed returns whether every recipient of the message bypasses the
+// scan.  A single recipient which does not is enough for it to be scanned.
+func isBypassed(s *session) bool {
+	if len(rcptBypass) == 0 || len(s.tx.rcptTo) == 0 {
+		return false
+	}
+	for _, rcptTo := range s.tx.rcptTo {
+		if !matchAddress(rcptBypass, rcptTo) {
+			return false
+		}
+	}
+	return true
+}
+
+func isSpamtrapped(s *session) bool {
+	for _, rcptTo := range s.tx.rcptTo {
+		if matchAddress(spamtraps, rcptTo) {
+			return true
+		}
+	}
+	return false
+}
+
+// discardMessage marks the message to be dropped once accepted, keeping it
+// in the quarantine if one is configured.
+func discardMessage(s *session, token string) {
+	quarantineMessage(s, "discard")
+	metricInc("messages.discarded")
+	log.Printf("%s: message %s discarded", s.logID(), s.tx.msgid)
+	s.tx.action = "discard"
+	flushMessage(s, token)
+}
+
 func dataCommit(s *session, params []string) {
 	if len(params) != 2 {
 		log.Fatal("invalid input, shouldn't happen")
@@ -254,213 +743,249 @@ func dataCommit(s *session, params []string) {
 
 	token := params[0]
 
+	if s.tx.action != "" && !enforce(s.logID(), "answered %s to message %s", s.tx.action, s.tx.msgid) {
+		filterResult(s, token, "proceed")
+		return
+	}
+
 	switch s.tx.action {
 	case "tempfail":
-		if s.tx.response == "" {
-			s.tx.response = "server internal error"
-		}
-		produceOutput("filter-result", s.id, token, "reject|421 %s", s.tx.response)
+		filterResult(s, token, "reject|%s %s",
+			*tempfailCode, replyText(s, *tempfailMessage, "server internal error"))
 
 	case "reject":
-		if s.tx.response == "" {
-			s.tx.response = "message rejected"
+		// hard spam gets the session dropped, so that the client may not
+		// go on with further transactions
+		decision := "reject"
+		if *disconnectScore > 0 && float64(s.tx.score) >= *disconnectScore {
+			metricInc("sessions.disconnected")
+			log.Printf("%s: message %s score %.2f, disconnecting", s.logID(), s.tx.msgid, s.tx.score)
+			decision = "disconnect"
+		}
+
+		if s.tx.virus != "" {
+			rejected(s.id, clientIP(s.src), "virus")
+			filterResult(s, token, "%s|554 5.7.1 virus detected: %s", decision,
+				strings.NewReplacer("\r", " ", "\n", " ").Replace(s.tx.virus))
+			break
 		}
-		produceOutput("filter-result", s.id, token, "reject|550 %s", s.tx.response)
+		rejected(s.id, clientIP(s.src), "spam")
+		filterResult(s, token, "%s|%s %s", decision,
+			*rejectCode, replyText(s, *rejectMessage, "message rejected"))
 
 	case "soft reject":
-		if s.tx.response == "" {
-			s.tx.response = "try again later"
+		rejected(s.id, clientIP(s.src), "soft-reject")
+		code, text := *softRejectCode, replyText(s, *softRejectMessage, "try again later")
+		if s.tx.retryAfter > 0 {
+			text += ", " + retryHint(s.tx.retryAfter)
 		}
-		produceOutput("filter-result", s.id, token, "reject|451 %s", s.tx.response)
+		if s.tx.greylisted {
+			code = "451 4.7.1"
+		}
+		filterResult(s, token, "reject|%s %s", code, text)
+
+	case "discard":
+		// smtpd rolls back a transaction rejected at commit, whatever
+		// the reply: the client is told the message was accepted, and
+		// it is dropped.
+		filterResult(s, token, "reject|250 2.0.0 %s Message accepted for delivery", s.tx.msgid)
 
 	default:
-		produceOutput("filter-result", s.id, token, "proceed")
+		filterResult(s, token, "proceed")
 	}
 }
 
-func filterInit() {
-	for k := range reporters {
-		fmt.Printf("register|report|smtp-in|%s\n", k)
-	}
-	for k := range filters {
-		fmt.Printf("register|filter|smtp-in|%s\n", k)
+// replyText returns the text of the SMTP reply for the current transaction:
+// the operator-provided template if any, then the message provided by
+// rspamd, then the built-in fallback.
+func replyText(s *session, template string, fallback string) string {
+	text := fallback
+	if template != "" {
+		text = expandTemplate(s, template)
+	} else if s.tx.response != "" {
+		text = s.tx.response
 	}
-	fmt.Println("register|ready")
+
+	// a reply must fit on a single line of the filter protocol
+	return strings.NewReplacer("\r", " ", "\n", " ").Replace(text)
 }
 
-func flushMessage(s *session, token string) {
-	for _, line := range s.tx.message {
-		writeLine(s, token, line)
-	}
-	produceOutput("filter-dataline", s.id, token, ".")
+func expandTemplate(s *session, template string) string {
+	r := strings.NewReplacer(
+		"{score}", fmt.Sprintf("%.2f", s.tx.score),
+		"{required}", fmt.Sprintf("%.2f", s.tx.requiredScore),
+		"{action}", s.tx.action,
+		"{queueid}", s.tx.msgid,
+		"{symbols}", strings.Join(s.tx.symbols, ","),
+	)
+	return r.Replace(template)
 }
 
-func writeLine(s *session, token string, line string) {
-	prefix := ""
-	// Output raw SMTP data - escape leading dots.
-	if strings.HasPrefix(line, ".") {
-		prefix = "."
+// validAction returns whether action is one of the actions rspamd may
+// return.
+func validAction(action string) bool {
+	switch action {
+	case "no action", "greylist", "add header", "rewrite subject",
+		"soft reject", "reject", "discard":
+		return true
 	}
-	produceOutput("filter-dataline", s.id, token,
-		"%s%s", prefix, line)
+	return false
 }
 
-func writeHeader(s *session, token string, h string, t string) {
-	for i, line := range strings.Split(t, "\n") {
-		if i == 0 {
-			produceOutput("filter-dataline", s.id, token,
-				"%s: %s", h, line)
-		} else {
-			produceOutput("filter-dataline", s.id, token,
-				"%s", line)
+// actionSeverity lists the actions rspamd may return, from the least to the
+// most severe.
+var actionSeverity = []string{"no action", "greylist", "add header",
+	"rewrite subject", "soft reject", "reject", "discard"}
+
+func severity(action string) int {
+	for i, a := range actionSeverity {
+		if a == action {
+			return i
 		}
 	}
+	return -1
 }
 
-func rspamdTempFail(s *session, token string, log string) {
-	s.tx.action = "tempfail"
-	s.tx.response = "server internal error"
-	flushMessage(s, token)
-	fmt.Fprintln(os.Stderr, log)
-}
-
-func rspamdQuery(s *session, token string) {
-	var client *http.Client
-	var req *http.Request
-
-	r := strings.NewReader(strings.Join(s.tx.message, "\n"))
-
-	if len(unixSocketPath) > 0 {
-		tr := new(http.Transport)
-		tr.DisableCompression = true
-		tr.Dial = nil
-		tr.DialContext = func(_ context.Context, _, _ string) (net.Conn, error) {
-			var u_addr *net.UnixAddr
-			var err error
-			network := "unix"
-			u_addr, err = net.ResolveUnixAddr(network, unixSocketPath)
-			if err != nil {
-				rspamdTempFail(s, token, fmt.Sprintf("failed to resolve unix path '%s': %v\n", unixSocketPath, err))
-				return nil, err
-			} else {
-				return net.DialUnix(network, nil, u_addr)
-			}
+// symbolAction returns the most severe of the actions forced by the
+// symbols of a message with -symbol-action, if any.
+func symbolAction(symbols []string) (string, bool) {
+	action, found := "", false
+	for _, symbol := range symbols {
+		a, ok := symbolActions[strings.ToLower(symbol)]
+		if ok && (!found || severity(a) > severity(action)) {
+			action, found = a, true
 		}
-		client = &http.Client{Transport: tr}
-	} else {
-		client = &http.Client{}
-	}
-	var err error
-	req, err = http.NewRequest("POST", fmt.Sprintf("%s/checkv2", *rspamdURL), r)
-	if err != nil {
-		rspamdTempFail(s, token, fmt.Sprintf("failed to initialize HTTP request. err: '%s'", err))
-		return
 	}
+	return action, found
+}
 
-	req.Header.Add("Pass", "All")
-	if !strings.HasPrefix(s.src, "unix:") {
-		if s.src[0] == '[' {
-			ip := strings.Split(strings.Split(s.src, "]")[0], "[")[1]
-			req.Header.Add("Ip", ip)
-		} else {
-			ip := strings.Split(s.src, ":")[0]
-			req.Header.Add("Ip", ip)
+// validHeaderName returns whether name is a valid RFC 5322 field name.
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		if name[i] < 33 || name[i] > 126 || name[i] == ':' {
+			return false
 		}
-	} else {
-		req.Header.Add("Ip", "127.0.0.1")
 	}
+	return true
+}
 
-	req.Header.Add("Hostname", s.rdns)
-	req.Header.Add("Helo", s.heloName)
-	req.Header.Add("MTA-Name", s.mtaName)
-	req.Header.Add("Queue-Id", s.tx.msgid)
-	req.Header.Add("From", s.tx.mailFrom)
+// validReplyCode checks that code is an SMTP reply code of the given class,
+// optionally followed by an RFC 3463 enhanced status code of the same class.
+func validReplyCode(code string, class byte) bool {
+	fields := strings.Fields(code)
+	if len(fields) == 0 || len(fields) > 2 {
+		return false
+	}
 
-	if *rspamdSettingsId != "" {
-		req.Header.Add("Settings-ID", *rspamdSettingsId)
+	basic := fields[0]
+	if len(basic) != 3 || basic[0] != class ||
+		basic[1] < '0' || basic[1] > '5' || basic[2] < '0' || basic[2] > '9' {
+		return false
+	}
+	if len(fields) == 1 {
+		return true
 	}
 
-	if s.userName != "" {
-		req.Header.Add("User", s.userName)
+	parts := strings.Split(fields[1], ".")
+	if len(parts) != 3 || parts[0] != string(class) {
+		return false
+	}
+	for _, part := range parts[1:] {
+		if len(part) == 0 || len(part) > 3 {
+			return false
+		}
+		for _, c := range part {
+			if c < '0' || c > '9' {
+				return false
+			}
+		}
 	}
+	return true
+}
 
-	for _, rcptTo := range s.tx.rcptTo {
-		req.Header.Add("Rcpt", rcptTo)
+func filterInit() {
+	for k := range reporters {
+		fmt.Printf("register|report|smtp-in|%s\n", k)
 	}
+	for k := range filters {
+		fmt.Printf("register|filter|smtp-in|%s\n", k)
+	}
+	if *smtpOut {
+		for k := range outReporters {
+			fmt.Printf("register|report|smtp-out|%s\n", k)
+		}
+		fmt.Println("register|report|smtp-out|link-disconnect")
+	}
+	fmt.Println("register|ready")
+}
 
-	resp, err := client.Do(req)
-	if err != nil {
-		rspamdTempFail(s, token, fmt.Sprintf("failed to receive a response from daemon. err: '%s'", err))
-		return
+func flushMessage(s *session, token string) {
+	for _, line := range s.tx.msg.Raw() {
+		writeRawLine(s, token, line)
 	}
+	produceOutput("filter-dataline", s.id, token, ".")
+}
 
-	defer resp.Body.Close()
+// writeRawLine writes a line of raw SMTP data, as received.
+func writeRawLine(s *session, token string, line string) {
+	produceOutput("filter-dataline", s.id, token, "%s", line)
+}
 
-	rr := &rspamd{}
-	if err := json.NewDecoder(resp.Body).Decode(rr); err != nil {
-		rspamdTempFail(s, token, fmt.Sprintf("failed to decode JSON response, err: '%s'", err))
-		return
-	}
+// writeHeader adds a header to those prepended to the message once it
+// is written back.
+func writeHeader(s *session, h string, t string) {
+	s.tx.edit.Add = append(s.tx.edit.Add, mailrewrite.Field{Name: h, Value: t})
+}
 
-	switch rr.Action {
-	case "reject":
-		fallthrough
-	case "soft reject":
-		s.tx.action = rr.Action
-		s.tx.response = rr.Messages.SMTP
-		flushMessage(s, token)
-		return
+// isSpam returns whether action is taken on spam.
+func isSpam(action string) bool {
+	return action != "no action" && action != "greylist"
+}
+
+// yesNo returns the way SpamAssassin reports whether a message is spam.
+func yesNo(spam bool) string {
+	if spam {
+		return "Yes"
 	}
+	return "No"
+}
 
-	switch v := rr.DKIMSig.(type) {
-	case []interface{}:
-		if len(v) > 0 {
-			for _, h := range v {
-				h, ok := h.(string)
-				if ok && h != "" {
-					writeHeader(s, token, "DKIM-Signature", h)
-				}
-			}
+// writeSpamHeaders writes the X-Spam headers of the default profile, only
+// the informational ones if the message is not spam.
+func writeSpamHeaders(s *session, rr *rspamd, spam bool) {
+	if spam {
+		writeFilterHeader(s, "X-Spam", "yes")
+		if *spamFlag {
+			writeFilterHeader(s, "X-Spam-Flag", "YES")
 		}
-	case string:
-		if v != "" {
-			writeHeader(s, token, "DKIM-Signature", v)
-		}
-	default:
 	}
+	writeFilterHeader(s, "X-Spam-Score",
+		fmt.Sprintf("%v / %v", rr.Score, rr.RequiredScore))
 
-	if rr.Action == "add header" {
-		produceOutput("filter-dataline", s.id, token,
-			"%s: %s", "X-Spam", "yes")
-		produceOutput("filter-dataline", s.id, token,
-			"%s: %v / %v", "X-Spam-Score",
-			rr.Score, rr.RequiredScore)
-
-		if len(rr.Symbols) != 0 {
-			symbols := make([]string, len(rr.Symbols))
-			buf := &strings.Builder{}
-			i := 0
-
-			produceOutput("filter-dataline", s.id, token,
-				"%s: %s, score=%.3f required=%.3f",
-				"X-Spam-Status", "Yes", rr.Score,
-				rr.RequiredScore)
+	if *spamLevel {
+		writeFilterHeader(s, "X-Spam-Level", spamLevelStars(rr.Score))
+	}
 
-			for k := range rr.Symbols {
-				symbols[i] = k
-				i++
-			}
+	if len(rr.Symbols) != 0 {
+		lines := []string{fmt.Sprintf("%s, score=%.3f required=%.3f",
+			yesNo(spam), rr.Score, rr.RequiredScore)}
 
-			sort.Strings(symbols)
+		if *statusMaxSymbols >= 0 {
+			buf := &strings.Builder{}
 
 			buf.WriteString("tests=[")
 
-			for i, k := range symbols {
+			for i, k := range statusSymbols(rr) {
 				sym := fmt.Sprintf("%s=%.3f", k, rr.Symbols[k].Score)
+				if options := rr.Symbols[k].Options; *statusOptions && len(options) > 0 {
+					sym += "[" + strings.NewReplacer("\r", "", "\n", " ").Replace(strings.Join(options, ",")) + "]"
+				}
 
 				if buf.Len() > 0 && len(sym)+buf.Len() > 68 {
-					produceOutput("filter-dataline", s.id, token, "\t%s",
-						buf.String())
+					lines = append(lines, buf.String())
 					buf.Reset()
 				}
 
@@ -471,114 +996,995 @@ func rspamdQuery(s *session, token string) {
 				buf.WriteString(sym)
 			}
 
-			produceOutput("filter-dataline", s.id, token, "\t%s]",
-				buf.String())
-
-			buf.Reset()
+			lines = append(lines, buf.String()+"]")
 		}
+
+		writeFilterHeader(s, "X-Spam-Status", strings.Join(lines, "\n\t"))
 	}
+}
 
-	if len(rr.Headers.Add) > 0 {
-		authHeaders := map[string]string{}
-
-		for h, t := range rr.Headers.Add {
-			switch v := t.(type) {
-			/**
-			 * Authentication headers from Rspamd are in the form of:
-			 * ARC-Seal : { order : 1, value : text }
-			 * ARC-Message-Signature : { order : 1, value : text }
-			 * Unfortunately they all have an order of 1, so we
-			 * make a map of them and print them in proper order.
-			 */
-			case map[string]interface{}:
-				if h != "" {
-					v, ok := v["value"].(string)
-					if ok {
-						authHeaders[h] = v
-					}
-				}
-			/**
-			 * Regular X-Spam headers from Rspamd are plain strings.
-			 * Insert these at the top.
-			 */
-			case string:
-				writeHeader(s, token, h, v)
-			default:
-			}
+// statusSymbols returns the symbols listed in the X-Spam-Status header,
+// sorted as -status-sort says: those weighing at least -status-min-score,
+// and only the -status-max-symbols heaviest of them if there are more.
+func statusSymbols(rr *rspamd) []string {
+	symbols := make([]string, 0, len(rr.Symbols))
+	for k, v := range rr.Symbols {
+		if math.Abs(float64(v.Score)) >= *statusMinScore {
+			symbols = append(symbols, k)
 		}
+	}
 
-		/**
-		 * Prefix auth headers to incoming mail in proper order.
-		 */
-		if len(authHeaders) > 0 {
-			hdrs := []string{
-				"ARC-Seal",
-				"ARC-Message-Signature",
-				"ARC-Authentication-Results",
-				"Authentication-Results"}
-
-			for _, h := range hdrs {
-				if authHeaders[h] != "" {
-					writeHeader(s, token, h, authHeaders[h])
-				}
-			}
+	sort.Slice(symbols, func(i, j int) bool {
+		a := math.Abs(float64(rr.Symbols[symbols[i]].Score))
+		b := math.Abs(float64(rr.Symbols[symbols[j]].Score))
+		if a != b {
+			return a > b
 		}
+		return symbols[i] < symbols[j]
+	})
+	if *statusMaxSymbols > 0 && len(symbols) > *statusMaxSymbols {
+		symbols = symbols[:*statusMaxSymbols]
 	}
 
-	inhdr := true
-	rmhdr := false
+	if *statusSort == "name" {
+		sort.Strings(symbols)
+	}
+	return symbols
+}
 
-LOOP:
+// writeSpamAssassinHeaders writes the headers SpamAssassin would add,
+// for the benefit of clients and scripts which only know about these.
+func writeSpamAssassinHeaders(s *session, rr *rspamd, spam bool) {
+	symbols := []string{}
+	if *statusMaxSymbols >= 0 {
+		symbols = statusSymbols(rr)
+	}
 
-	for _, line := range s.tx.message {
-		if line == "" {
-			inhdr = false
-			rmhdr = false
+	status := fmt.Sprintf("%s, score=%.1f required=%.1f tests=",
+		yesNo(spam), rr.Score, rr.RequiredScore)
+	width := len("X-Spam-Status: ") + len(status)
+	for i, k := range symbols {
+		if i > 0 {
+			status += ","
+			width++
 		}
-
-		if inhdr && rmhdr && (strings.HasPrefix(line, "\t") ||
-			strings.HasPrefix(line, " ")) {
-			continue
-		} else {
-			rmhdr = false
+		if width+len(k) > 78 {
+			status += "\n\t"
+			width = 8
 		}
+		status += k
+		width += len(k)
+	}
 
-		if inhdr && len(rr.Headers.Remove) > 0 {
-			for h := range rr.Headers.Remove {
-				if strings.HasPrefix(line, fmt.Sprintf("%s:", h)) {
-					rmhdr = true
-					continue LOOP
-				}
-			}
-		}
-		if rr.Action == "rewrite subject" && inhdr && strings.HasPrefix(line, "Subject: ") {
-			produceOutput("filter-dataline", s.id, token, "Subject: %s", rr.Subject)
-		} else {
-			writeLine(s, token, line)
+	if spam {
+		writeFilterHeader(s, "X-Spam-Flag", "YES")
+	}
+	writeFilterHeader(s, "X-Spam-Status", status)
+
+	checker := "rspamd (filter-rspamd)"
+	if s.mtaName != "" {
+		checker += " on " + s.mtaName
+	}
+	writeFilterHeader(s, "X-Spam-Checker-Version", checker)
+
+	sort.SliceStable(symbols, func(i, j int) bool {
+		return rr.Symbols[symbols[i]].Score > rr.Symbols[symbols[j]].Score
+	})
+	report := ""
+	for _, k := range symbols {
+		description := rr.Symbols[k].Description
+		if description == "" {
+			description = strings.Join(rr.Symbols[k].Options, ", ")
 		}
+		description = strings.NewReplacer("\r", "", "\n", " ").Replace(description)
+		report += strings.TrimRight(fmt.Sprintf("\n\t* %4.1f %s %s",
+			rr.Symbols[k].Score, k, description), " ")
 	}
-	produceOutput("filter-dataline", s.id, token, ".")
+	writeFilterHeader(s, "X-Spam-Report", report)
 }
 
-func trigger(actions map[string]func(*session, []string), atoms []string) {
-	if atoms[4] == "link-connect" {
-		// special case to simplify subsequent code
-		s := session{}
-		s.id = atoms[5]
-		sessions[s.id] = &s
+type milterHeader struct {
+	name    string
+	value   string
+	order   int
+	ordered bool
+}
+
+/**
+ * The authentication headers from Rspamd all have an order of 1,
+ * ties between them are broken by the order they must appear in.
+ */
+var authHeaderRanks = map[string]int{
+	"ARC-Seal":                   0,
+	"ARC-Message-Signature":      1,
+	"ARC-Authentication-Results": 2,
+	"Authentication-Results":     3,
+}
+
+func authHeaderRank(name string) int {
+	if rank, ok := authHeaderRanks[name]; ok {
+		return rank
 	}
+	return len(authHeaderRanks)
+}
 
-	s, ok := sessions[atoms[5]]
-	if !ok {
-		log.Fatalf("invalid session ID: %s", atoms[5])
+// milterHeaders returns the headers of the milter add_headers block in
+// the order they must be prefixed to the message.  Those whose name is
+// invalid are left out.
+func milterHeaders(add map[string]interface{}) []milterHeader {
+	names := make([]string, 0, len(add))
+	for h := range add {
+		if validHeaderName(h) {
+			names = append(names, h)
+		}
 	}
+	sort.Strings(names)
 
-	if v, ok := actions[atoms[4]]; ok {
-		v(s, atoms[6:])
-	} else {
-		log.Fatalf("invalid phase: %s", atoms[4])
+	headers := []milterHeader{}
+	for _, h := range names {
+		headers = append(headers, parseMilterHeader(h, add[h])...)
 	}
-}
+
+	sort.SliceStable(headers, func(i, j int) bool {
+		a, b := headers[i], headers[j]
+		if a.ordered != b.ordered {
+			return !a.ordered
+		}
+		if a.order != b.order {
+			return a.order < b.order
+		}
+		return authHeaderRank(a.name) < authHeaderRank(b.name)
+	})
+	return headers
+}
+
+/**
+ * Headers from Rspamd come in one of these forms:
+ * X-Spam : text
+ * ARC-Seal : { order : 1, value : text }
+ * X-Foo : [ { order : 0, value : text }, ... ]
+ * Plain strings have no order and are inserted at the top.
+ */
+func parseMilterHeader(name string, t interface{}) []milterHeader {
+	switch v := t.(type) {
+	case string:
+		return []milterHeader{{name: name, value: v}}
+	case map[string]interface{}:
+		value, ok := v["value"].(string)
+		if !ok {
+			return nil
+		}
+		h := milterHeader{name: name, value: value}
+		if order, ok := v["order"].(float64); ok {
+			h.order = int(order)
+			h.ordered = true
+		}
+		return []milterHeader{h}
+	case []interface{}:
+		headers := []milterHeader{}
+		for _, e := range v {
+			headers = append(headers, parseMilterHeader(name, e)...)
+		}
+		return headers
+	default:
+		return nil
+	}
+}
+
+// spamLevelStars returns one asterisk per point of score, the way
+// SpamAssassin does in its X-Spam-Level header.
+func spamLevelStars(score float32) string {
+	n := int(math.Round(float64(score)))
+	if n < 0 {
+		n = 0
+	} else if n > 50 {
+		n = 50
+	}
+	return strings.Repeat("*", n)
+}
+
+// writeSpamdResult writes the X-Spamd-Result header the same way the
+// rspamd proxy milter does, so that tooling written for it keeps working.
+func writeSpamdResult(s *session, rr *rspamd) {
+	spam := "False"
+	if isSpam(rr.Action) {
+		spam = "True"
+	}
+
+	symbols := make([]string, 0, len(rr.Symbols))
+	for k := range rr.Symbols {
+		symbols = append(symbols, k)
+	}
+	sort.Strings(symbols)
+
+	lines := []string{fmt.Sprintf("default: %s [%.2f / %.2f]",
+		spam, rr.Score, rr.RequiredScore)}
+	for _, k := range symbols {
+		options := strings.Join(rr.Symbols[k].Options, ",")
+		options = strings.NewReplacer("\r", "", "\n", " ").Replace(options)
+		lines = append(lines, fmt.Sprintf("%s(%.2f)[%s]",
+			k, rr.Symbols[k].Score, options))
+	}
+
+	writeFilterHeader(s, "X-Spamd-Result", strings.Join(lines, ";\n\t"))
+}
+
+// dkimSignatures returns the DKIM-Signature headers obtained from rspamd.
+func dkimSignatures(rr *rspamd) []string {
+	signatures := []string{}
+
+	switch v := rr.DKIMSig.(type) {
+	case []interface{}:
+		for _, h := range v {
+			h, ok := h.(string)
+			if ok && h != "" {
+				signatures = append(signatures, h)
+			}
+		}
+	case string:
+		if v != "" {
+			signatures = append(signatures, v)
+		}
+	default:
+	}
+
+	return signatures
+}
+
+// signOnlySettings restrict rspamd to DKIM signing.
+const signOnlySettings = `{"symbols_enabled":["DKIM_SIGNED"]}`
+
+// isSignOnly returns whether the messages of a session are only to be
+// signed, not scanned for spam.
+func isSignOnly(s *session) bool {
+	return *signOnly && s.userName != ""
+}
+
+// signMessage writes back a message with the signatures rspamd made, and
+// nothing else.
+func signMessage(s *session, token string, rr *rspamd) {
+	metricInc("messages.signed")
+
+	signatures := dkimSignatures(rr)
+	if !*noHeaders {
+		for _, h := range signatures {
+			writeHeader(s, "DKIM-Signature", h)
+		}
+	}
+	if len(dkimSelectors) > 0 {
+		checkDKIMCoverage(s, signatures)
+	}
+
+	s.tx.msg.Write(func(line string) {
+		writeRawLine(s, token, line)
+	}, s.tx.edit)
+	produceOutput("filter-dataline", s.id, token, ".")
+}
+
+// checkDKIMCoverage verifies that outgoing mail from a hosted domain got a
+// signature for the selector of the domain, and keeps count of the signed
+// and unsigned messages of each domain.
+func checkDKIMCoverage(s *session, signatures []string) {
+	domain := senderDomain(s)
+	selector, ok := dkimSelectors[domain]
+	if !ok {
+		return
+	}
+
+	for _, signature := range signatures {
+		tags := make(map[string]string)
+		for _, tag := range strings.Split(signature, ";") {
+			kv := strings.SplitN(strings.Join(strings.Fields(tag), ""), "=", 2)
+			if len(kv) == 2 {
+				tags[kv[0]] = kv[1]
+			}
+		}
+		if strings.EqualFold(tags["d"], domain) && tags["s"] == selector {
+			metricInc("dkim.signed." + domain)
+			return
+		}
+	}
+
+	metricInc("dkim.unsigned." + domain)
+	log.Printf("%s: message %s from %s not signed with selector %s",
+		s.logID(), s.tx.msgid, domain, selector)
+}
+
+// senderDomain returns the lowercased domain of the From header of the
+// message, falling back to the one of the envelope sender.
+func senderDomain(s *session) string {
+	address := s.tx.mailFrom
+	headers := s.tx.msg.Headers()
+	if i := mailrewrite.Find(headers, "From"); i >= 0 {
+		from, err := mail.ParseAddress(headers[i].Value())
+		if err == nil {
+			address = from.Address
+		}
+	}
+
+	if at := strings.LastIndexByte(address, '@'); at >= 0 {
+		return strings.ToLower(address[at+1:])
+	}
+	return ""
+}
+
+// debugHeaderMaxSize caps the size of the X-Rspamd-Debug header.
+const debugHeaderMaxSize = 16 * 1024
+
+// debugHeaderValue returns the raw JSON verdict of rspamd indented, so
+// that every line but the first is a continuation line and unfolding the
+// header yields the verdict, truncated to debugHeaderMaxSize.
+func debugHeaderValue(raw []byte) string {
+	var buf bytes.Buffer
+	if err := json.Indent(&buf, bytes.TrimSpace(raw), " ", " "); err != nil {
+		return "invalid verdict"
+	}
+
+	value := buf.String()
+	if len(value) > debugHeaderMaxSize {
+		end := strings.LastIndexByte(value[:debugHeaderMaxSize], '\n')
+		if end < 0 {
+			end = debugHeaderMaxSize
+		}
+		value = value[:end] + "\n ..."
+	}
+	return value
+}
+
+// writeFilterHeader writes one of the headers generated by the filter
+// itself, under the name chosen by the operator, if any.
+func writeFilterHeader(s *session, h string, t string) {
+	if name, ok := filterHeaderName(h); ok {
+		writeHeader(s, name, t)
+	}
+}
+
+// filterHeaderName returns the name under which the filter header h is
+// written, and false if it is suppressed.
+func filterHeaderName(h string) (string, bool) {
+	if name, ok := headerNames[strings.ToLower(h)]; ok {
+		return name, name != ""
+	}
+	return h, true
+}
+
+// requestHeaderValue returns value as is, unless raw 8-bit data is to be
+// sanitized, in which case invalid UTF-8 and control characters, which
+// cannot be sent in HTTP headers, are replaced.
+func requestHeaderValue(value string) string {
+	if *header8bit != "sanitize" {
+		return value
+	}
+
+	return strings.Map(func(r rune) rune {
+		if r == utf8.RuneError || (r < ' ' && r != '\t') || r == 0x7f {
+			return '?'
+		}
+		return r
+	}, strings.ToValidUTF8(value, "?"))
+}
+
+func rspamdTempFail(s *session, token string, log string) {
+	s.tx.action = "tempfail"
+	s.tx.response = "server internal error"
+	flushMessage(s, token)
+	fmt.Fprintln(os.Stderr, log)
+}
+
+// messageBody returns the message sent to rspamd.  With CRLF line
+// endings, rspamd sees the message exactly as smtpd transmits it, which
+// matters when it signs the message.
+func messageBody(message []string) string {
+	if *eol == "crlf" {
+		if len(message) == 0 {
+			return ""
+		}
+		return strings.Join(message, "\r\n") + "\r\n"
+	}
+	return strings.Join(message, "\n")
+}
+
+// clientIP returns the IP address of a session source, as reported by
+// smtpd, or nothing if the source is unknown or local: the local enqueuer
+// is not a network client to be rate limited, tarpitted or logged.
+func clientIP(src string) string {
+	// the source of a session recreated after expiring is unknown
+	if src == "" || isLocal(src) {
+		return ""
+	}
+	if src[0] == '[' {
+		return strings.Split(strings.Split(src, "]")[0], "[")[1]
+	}
+	return strings.Split(src, ":")[0]
+}
+
+// isLocal returns whether src is the local enqueuer rather than a network
+// client.
+func isLocal(src string) bool {
+	return strings.HasPrefix(src, "unix:")
+}
+
+// requestIP returns the address of the client sent to rspamd, the
+// -local-ip for local sources, or nothing if it is "none".
+func requestIP(src string) string {
+	if !isLocal(src) {
+		return clientIP(src)
+	}
+	if *localIP == "none" {
+		return ""
+	}
+	return *localIP
+}
+
+// scansInFlight counts the scans waiting for a slot or in progress.
+var scansInFlight int64
+
+// scanSlots bounds the number of scans in flight, so that a burst of
+// messages does not exhaust the workers of rspamd.
+var scanSlots chan struct{}
+
+// acquireScanSlot waits for a scan slot until the queue timeout or the
+// deadline of the message, whichever comes first.
+func acquireScanSlot(deadline time.Time) bool {
+	if scanSlots == nil {
+		return true
+	}
+
+	select {
+	case scanSlots <- struct{}{}:
+		return true
+	default:
+	}
+
+	wait := time.Until(deadline)
+	if *scanQueueTimeout < wait {
+		wait = *scanQueueTimeout
+	}
+	if wait <= 0 {
+		return false
+	}
+
+	metricInc("scans.queued")
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case scanSlots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+func releaseScanSlot() {
+	if scanSlots != nil {
+		<-scanSlots
+	}
+}
+
+// checkRequest returns the request scanning the message of a session.
+func checkRequest(ctx context.Context, b *backend, s *session, body string, settingsId string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", fmt.Sprintf("%s/checkv2", b.url), strings.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Add("User-Agent", userAgent())
+	req.Header.Add("Accept-Encoding", acceptEncoding)
+	req.Header.Add("Pass", "All")
+	if len(scanFlags) > 0 {
+		req.Header.Add("Flags", strings.Join(scanFlags, ","))
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		req.Header.Add("Time-Budget", fmt.Sprintf("%.3f", time.Until(deadline).Seconds()))
+	}
+	if ip := requestIP(s.src); ip != "" {
+		req.Header.Add("Ip", ip)
+	}
+
+	req.Header.Add("Hostname", requestHeaderValue(s.hostname()))
+	req.Header.Add("Helo", requestHeaderValue(s.heloName))
+	// rspamd names the MTA as the authserv-id of its results
+	req.Header.Add("MTA-Name", requestHeaderValue(authservID(s)))
+	req.Header.Add("Queue-Id", requestHeaderValue(s.tx.msgid))
+	req.Header.Add("From", requestHeaderValue(s.tx.mailFrom))
+
+	if isSignOnly(s) {
+		req.Header.Add("Settings", signOnlySettings)
+	} else {
+		if settingsId != "" {
+			req.Header.Add("Settings-ID", settingsId)
+		}
+		if rspamdSettings != "" {
+			req.Header.Add("Settings", rspamdSettings)
+		}
+	}
+	if s.tx.scanID != "" {
+		req.Header.Add("Scan-Id", s.tx.scanID)
+	}
+
+	if s.tlsVersion != "" {
+		req.Header.Add("TLS-Version", requestHeaderValue(s.tlsVersion))
+	}
+	if s.tlsCipher != "" {
+		req.Header.Add("TLS-Cipher", requestHeaderValue(s.tlsCipher))
+	}
+
+	if s.userName != "" {
+		req.Header.Add("User", requestHeaderValue(s.userName))
+	} else if isLocal(s.src) && *localUser != "" {
+		req.Header.Add("User", requestHeaderValue(*localUser))
+	}
+
+	for _, rcptTo := range scannedRcpts(s) {
+		req.Header.Add("Rcpt", requestHeaderValue(rcptTo))
+	}
+	return req, nil
+}
+
+// scannedRcpts returns the recipients of the current transaction as sent
+// to rspamd.
+func scannedRcpts(s *session) []string {
+	if *canonicalRcpt {
+		return canonicalAddresses(s.tx.rcptTo)
+	}
+	return s.tx.rcptTo
+}
+
+// retryDelay waits before another attempt at a scan, backing off
+// exponentially with jitter so that retries from many sessions do not
+// hit a recovering rspamd at once.  It returns false if the scan would
+// run out of time in the meantime.
+func retryDelay(ctx context.Context, attempt int) bool {
+	delay := *retryBackoff << uint(attempt)
+	delay = delay/2 + time.Duration(rand.Int63n(int64(delay)+1))
+
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+		return false
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func rspamdQuery(s *session, token string) {
+	body := messageBody(s.tx.msg.Lines())
+	// smtpd gives up on the client, and on us, after its data timeout:
+	// whatever rspamd has not answered by then is wasted work.
+	deadline := s.tx.dataStart.Add(*dataTimeout)
+	budget := time.Until(deadline)
+	if budget <= 0 {
+		rspamdTempFail(s, token, "time budget exhausted before the scan started")
+		return
+	}
+
+	atomic.AddInt64(&scansInFlight, 1)
+	defer atomic.AddInt64(&scansInFlight, -1)
+
+	if !acquireScanSlot(deadline) {
+		metricInc("scans.overflow")
+		rspamdTempFail(s, token, "too many scans in progress")
+		return
+	}
+	defer releaseScanSlot()
+
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+
+	settingsId := *rspamdSettingsId
+	if *experimentSettingsId != "" && !isSignOnly(s) && rand.Float64()*100 < *experimentRate {
+		settingsId = *experimentSettingsId
+		log.Printf("%s: message %s scanned with experiment settings-id %s",
+			s.logID(), s.tx.msgid, settingsId)
+	}
+
+	var shadowResult <-chan *rspamd
+	if shadow != nil && !isSignOnly(s) {
+		shadowResult = shadowScan(s, body, settingsId, deadline)
+	}
+
+	var recipientResults <-chan []recipientVerdict
+	if *recipientScanCount > 0 && len(scannedRcpts(s)) > 1 && !*noHeaders && !isSignOnly(s) {
+		recipientResults = recipientScans(ctx, s, body, settingsId)
+	}
+
+	var resp *http.Response
+	for attempt := 0; ; attempt++ {
+		// every attempt may go to another backend
+		b := pickBackend(clientIP(s.src))
+		if b == nil {
+			metricInc("breaker.rejected")
+			rspamdTempFail(s, token, "no rspamd backend available")
+			return
+		}
+
+		req, err := checkRequest(ctx, b, s, body, settingsId)
+		if err != nil {
+			b.failure()
+			rspamdTempFail(s, token, fmt.Sprintf("failed to initialize HTTP request. err: '%s'", err))
+			return
+		}
+
+		resp, err = b.client().Do(req)
+		if err == nil && resp.StatusCode < 500 {
+			b.success()
+			break
+		}
+		if err == nil {
+			closeResponse(resp)
+			err = fmt.Errorf("unexpected status: %s", resp.Status)
+		}
+		b.failure()
+		err = fmt.Errorf("rspamd backend %s: %s", b, err)
+
+		if attempt >= *retries || ctx.Err() != nil || !retryDelay(ctx, attempt) {
+			rspamdTempFail(s, token, fmt.Sprintf("failed to receive a response from daemon. err: '%s'", err))
+			return
+		}
+		metricInc("scans.retried")
+		log.Printf("%s: message %s scan failed, retrying: %s", s.logID(), s.tx.msgid, err)
+	}
+
+	defer closeResponse(resp)
+
+	var raw []byte
+	verdict, err := responseBody(resp)
+	if err == nil {
+		raw, err = ioutil.ReadAll(verdict)
+	}
+	if err != nil {
+		rspamdTempFail(s, token, fmt.Sprintf("failed to read response, err: '%s'", err))
+		return
+	}
+
+	// a message rewritten by rspamd follows the verdict
+	var rewritten []byte
+	if offset := resp.Header.Get("Message-Offset"); offset != "" {
+		n, err := strconv.Atoi(offset)
+		if err != nil || n < 0 || n > len(raw) {
+			rspamdTempFail(s, token, fmt.Sprintf("invalid Message-Offset: %s", offset))
+			return
+		}
+		raw, rewritten = raw[:n], raw[n:]
+	}
+
+	rr := &rspamd{}
+	if err := json.Unmarshal(raw, rr); err != nil {
+		rspamdTempFail(s, token, fmt.Sprintf("failed to decode JSON response, err: '%s'", err))
+		return
+	}
+
+	if isSignOnly(s) {
+		signMessage(s, token, rr)
+		return
+	}
+
+	// Filters may only rewrite the sender at MAIL FROM, long before the
+	// message is scanned.
+	if rr.Headers.ChangeFrom != "" {
+		metricInc("milter.change_from")
+		log.Printf("%s: message %s sender change to %s not supported, ignored",
+			s.logID(), s.tx.msgid, rr.Headers.ChangeFrom)
+	}
+
+	if *maxMilterHeaders > 0 && len(milterHeaders(rr.Headers.Add))+len(rr.Headers.Remove) > *maxMilterHeaders {
+		metricInc("milter.ignored")
+		log.Printf("%s: message %s: rspamd changes more than %d headers, changes ignored",
+			s.logID(), s.tx.msgid, *maxMilterHeaders)
+		rr.Headers.Add, rr.Headers.Remove = nil, nil
+	}
+
+	if shadowResult != nil {
+		shadowCompare(s, rr, shadowResult)
+	}
+
+	if len(symbolWeights) > 0 && applyWeights(rr) {
+		metricInc("weights.adjusted")
+		log.Printf("%s: message %s score adjusted to %.2f, action %s", s.logID(), s.tx.msgid, rr.Score, rr.Action)
+	}
+
+	s.tx.score = rr.Score
+	s.tx.requiredScore = rr.RequiredScore
+	s.tx.symbols = make([]string, 0, len(rr.Symbols))
+	for k := range rr.Symbols {
+		s.tx.symbols = append(s.tx.symbols, k)
+	}
+	sort.Strings(s.tx.symbols)
+
+	if *tarpitScore > 0 && float64(rr.Score) >= *tarpitScore {
+		atomic.AddInt32(&s.strikes, 1)
+		log.Printf("%s: message %s score %.2f, session tarpitted", s.logID(), s.tx.msgid, rr.Score)
+	}
+
+	if action, ok := actionMap[rr.Action]; ok {
+		rr.Action = action
+	}
+
+	if len(virusSymbols) > 0 {
+		if s.tx.virus = virusName(rr); s.tx.virus != "" {
+			metricInc("messages.virus")
+			log.Printf("%s: message %s virus detected: %s", s.logID(), s.tx.msgid, s.tx.virus)
+			rr.Action = *virusAction
+		}
+	}
+
+	if *dmarcEnforce {
+		enforceDMARC(s, rr)
+	}
+
+	if *rejectScore > 0 && float64(rr.Score) >= *rejectScore && severity(rr.Action) < severity("reject") {
+		metricInc("messages.escalated")
+		log.Printf("%s: message %s action %s escalated to reject, score %.2f", s.logID(), s.tx.msgid, rr.Action, rr.Score)
+		rr.Action = "reject"
+	}
+
+	if action, ok := symbolAction(s.tx.symbols); ok && action != rr.Action {
+		metricInc("symbols.overrides")
+		log.Printf("%s: message %s action %s overridden by symbol: %s", s.logID(), s.tx.msgid, rr.Action, action)
+		rr.Action = action
+	}
+
+	var ruleHeaders [][2]string
+	if len(rules) > 0 {
+		var action string
+		action, ruleHeaders = evalRules(newRuleEnv(s, rr))
+		if action != "" && action != rr.Action {
+			metricInc("rules.overrides")
+			log.Printf("%s: message %s action %s overridden by rules: %s", s.logID(), s.tx.msgid, rr.Action, action)
+			rr.Action = action
+		}
+	}
+
+	if *policyHook != "" {
+		action, err := runPolicyHook(newVerdict(s, rr.Action))
+		if err != nil {
+			metricInc("policy.errors")
+			log.Printf("%s: message %s policy hook failed: %s", s.logID(), s.tx.msgid, err)
+			if *readOnly {
+				rspamdTempFail(s, token, fmt.Sprintf("policy hook failed in read-only mode, err: '%s'", err))
+				return
+			}
+		} else if action != rr.Action {
+			metricInc("policy.overrides")
+			log.Printf("%s: message %s action %s overridden by policy hook: %s", s.logID(), s.tx.msgid, rr.Action, action)
+			rr.Action = action
+		}
+	}
+
+	recordVerdict(s, rr.Action)
+
+	if *learnHam && s.userName != "" && rr.Action == "no action" {
+		learnMessage(s, "/learnham", nil)
+	}
+
+	switch rr.Action {
+	case "discard", "reject", "soft reject", "rewrite subject":
+		if !enforce(s.logID(), "applied action %s to message %s", rr.Action, s.tx.msgid) {
+			rr.Action = "add header"
+		}
+	}
+
+	switch rr.Action {
+	case "discard":
+		discardMessage(s, token)
+		return
+	case "reject":
+		quarantineMessage(s, rr.Action)
+		fallthrough
+	case "soft reject":
+		s.tx.action = rr.Action
+		if rr.Action == "soft reject" && *retryAfter > 0 {
+			s.tx.retryAfter, s.tx.greylisted = greylistDelay(rr)
+		}
+		if *hideSMTPMessage && rr.Messages.SMTP != "" {
+			log.Printf("%s: message %s %s: %s", s.logID(), s.tx.msgid, rr.Action, rr.Messages.SMTP)
+		} else {
+			s.tx.response = rr.Messages.SMTP
+		}
+		flushMessage(s, token)
+		return
+	}
+
+	if *noHeaders {
+		flushMessage(s, token)
+		return
+	}
+
+	signatures := dkimSignatures(rr)
+	for _, h := range signatures {
+		writeHeader(s, "DKIM-Signature", h)
+	}
+
+	if s.userName != "" && len(dkimSelectors) > 0 {
+		checkDKIMCoverage(s, signatures)
+	}
+
+	if len(virusSymbols) > 0 {
+		writeVirusHeaders(s)
+	}
+
+	if s.tx.dmarcQuarantine {
+		writeFilterHeader(s, "X-DMARC-Quarantine", "yes")
+	}
+
+	if *spamdResult {
+		writeSpamdResult(s, rr)
+	}
+
+	if rr.Action == "add header" || *hamHeaders {
+		switch *headerProfile {
+		case "spamassassin":
+			writeSpamAssassinHeaders(s, rr, isSpam(rr.Action))
+		default:
+			writeSpamHeaders(s, rr, isSpam(rr.Action))
+		}
+	}
+
+	if recipientResults != nil {
+		writeRecipientHeaders(ctx, s, recipientResults)
+	}
+
+	if len(rr.Headers.Add) > 0 {
+		for _, h := range milterHeaders(rr.Headers.Add) {
+			writeHeader(s, h.name, h.value)
+		}
+	}
+
+	for _, h := range ruleHeaders {
+		writeHeader(s, h[0], h[1])
+	}
+
+	if *debugHeader {
+		writeFilterHeader(s, "X-Rspamd-Debug", debugHeaderValue(raw))
+	}
+
+	// a dry run only adds headers
+	if !isDryRun() {
+		if *rewriteBody && rewritten != nil {
+			if s.tx.msg.Truncated() {
+				log.Printf("%s: message %s body rewritten by rspamd ignored, headers truncated", s.logID(), s.tx.msgid)
+			} else {
+				metricInc("messages.body_rewritten")
+				s.tx.edit.Body = rewrittenBody(rewritten)
+			}
+		}
+		s.tx.edit.Remove = rr.Headers.Remove
+		if *stripForged && !isTrusted(s) {
+			s.tx.edit.Drop = forgedHeader(s)
+		}
+		if rr.Action == "rewrite subject" || (rr.Action == "add header" && *subjectTag != "") {
+			s.tx.edit.Subject = func(h *mailrewrite.Header) []mailrewrite.Field {
+				return subjectFields(rr, h)
+			}
+		}
+	}
+
+	s.tx.msg.Write(func(line string) {
+		writeRawLine(s, token, line)
+	}, s.tx.edit)
+	produceOutput("filter-dataline", s.id, token, ".")
+}
+
+// rewrittenBody returns the lines of the body of a message rewritten by
+// rspamd, whose headers are ignored as changes to them are described in
+// the milter block.
+func rewrittenBody(message []byte) []string {
+	lines := strings.Split(string(message), "\n")
+	for i := range lines {
+		lines[i] = strings.TrimSuffix(lines[i], "\r")
+	}
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+
+	for i, line := range lines {
+		if line == "" {
+			return lines[i+1:]
+		}
+	}
+	return []string{}
+}
+
+// subjectFields returns the headers written in place of the Subject header
+// h, or nil if the message has none, when the subject is rewritten.
+func subjectFields(rr *rspamd, h *mailrewrite.Header) []mailrewrite.Field {
+	if h == nil {
+		if rr.Action != "add header" {
+			return nil
+		}
+		return []mailrewrite.Field{{Name: "Subject", Value: newSubject(rr, "")}}
+	}
+
+	fields := []mailrewrite.Field{}
+	if *originalSubject {
+		if name, ok := filterHeaderName("X-Original-Subject"); ok {
+			fields = append(fields, mailrewrite.Field{Name: name, Value: h.RawValue()})
+		}
+	}
+	return append(fields, mailrewrite.Field{Name: "Subject", Value: newSubject(rr, h.Value())})
+}
+
+// newSubject returns the subject of a message once rewritten, either by
+// rspamd or by tagging the original one.
+func newSubject(rr *rspamd, original string) string {
+	if rr.Action == "rewrite subject" {
+		return mailrewrite.EncodeValue(rr.Subject)
+	}
+	if original == "" {
+		return mailrewrite.EncodeValue(*subjectTag)
+	}
+
+	/**
+	 * Whitespace between two encoded-words is not displayed: if both
+	 * the tag and the original subject are encoded, the space which
+	 * separates them must be encoded with the tag.
+	 */
+	if *subjectTagPosition == "suffix" {
+		tag := mailrewrite.EncodeValue(*subjectTag)
+		if tag != *subjectTag && strings.HasSuffix(original, "?=") {
+			tag = mailrewrite.EncodeValue(" " + *subjectTag)
+		}
+		return original + " " + tag
+	}
+
+	tag := mailrewrite.EncodeValue(*subjectTag)
+	if tag != *subjectTag && strings.HasPrefix(original, "=?") {
+		tag = mailrewrite.EncodeValue(*subjectTag + " ")
+	}
+	return tag + " " + original
+}
+
+func trigger(actions map[string]func(*session, []string), atoms []string) {
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+
+	if atoms[4] == "link-connect" {
+		// special case to simplify subsequent code
+		s := session{}
+		s.id = atoms[5]
+		sessions[s.id] = &s
+	}
+
+	s, ok := sessions[atoms[5]]
+	if !ok {
+		if *sessionMaxIdle == 0 {
+			log.Fatalf("invalid session ID: %s", atoms[5])
+		}
+		// the session may have been dropped for being idle
+		log.Printf("%s: event for an unknown session, session state lost", atoms[5])
+		s = &session{id: atoms[5]}
+		sessions[s.id] = s
+	}
+	s.lastSeen = time.Now()
+
+	if v, ok := actions[atoms[4]]; ok {
+		v(s, atoms[6:])
+	} else {
+		log.Fatalf("invalid phase: %s", atoms[4])
+	}
+}
+
+// scanProtocolLines splits the input on newlines only: unlike
+// bufio.ScanLines, carriage returns are part of the data and preserved.
+func scanProtocolLines(data []byte, atEOF bool) (int, []byte, error) {
+	if atEOF && len(data) == 0 {
+		return 0, nil, nil
+	}
+	if i := bytes.IndexByte(data, '\n'); i >= 0 {
+		return i + 1, data[:i], nil
+	}
+	if atEOF {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
 
 func skipConfig(scanner *bufio.Scanner) {
 	for {
@@ -586,93 +1992,879 @@ func skipConfig(scanner *bufio.Scanner) {
 			log.Print("no more lines to scan for skipping. exiting...")
 			os.Exit(0)
 		}
-		line := scanner.Text()
-		if line == "config|ready" {
-			return
+		line := scanner.Text()
+		if line == "config|ready" {
+			return
+		}
+	}
+}
+
+// caBundle is the file of the certificate authorities TLS connections
+// are verified against.
+const caBundle = "/etc/ssl/cert.pem"
+
+// remotes returns the services the filter connects to.
+func remotes() []*backend {
+	services := append([]*backend{}, backends...)
+	if shadow != nil {
+		services = append(services, shadow)
+	}
+	if *learnHam || len(spamtraps) > 0 {
+		services = append(services, &backend{url: *controllerURL, socketPath: controllerSocketPath})
+	}
+
+	if strings.HasPrefix(*storageSpec, "redis://") {
+		services = append(services, &backend{url: *storageSpec})
+	}
+	if *publishURL != "" {
+		services = append(services, &backend{url: *publishURL})
+	}
+	if webhook != nil {
+		services = append(services, &backend{url: webhook.url})
+	}
+	return services
+}
+
+// usesTLS returns whether the filter connects to any service over TLS,
+// which needs the caBundle.
+func usesTLS() bool {
+	for _, b := range remotes() {
+		if b.socketPath == "" && strings.HasPrefix(b.url, "https:") {
+			return true
+		}
+	}
+	return false
+}
+
+// steadyPromises returns the promises needed once the filter is set up:
+// unix sockets and the network only if rspamd is reached through them, name
+// resolution only if it is not reached by address, and files only for
+// storage, quarantine, the resolv.conf of -resolver, read at every lookup,
+// and the certificates of TLS connections.
+func steadyPromises() string {
+	inet, dns, unix := false, false, *controlSocket != "" || *pprofSocket != ""
+	for _, b := range remotes() {
+		if b.socketPath != "" {
+			unix = true
+			continue
+		}
+		inet = true
+		if u, err := url.Parse(b.url); err != nil || net.ParseIP(u.Hostname()) == nil {
+			dns = true
+		}
+	}
+
+	promises := "stdio"
+	if storagePath(*storageSpec) != "" || *stateDir != "" || *quarantineDir != "" || resolverConf() != "" || usesTLS() {
+		promises += " rpath"
+	}
+	if (storagePath(*storageSpec) != "" && !*readOnly) || (*stateDir != "" && !*readOnly) || *quarantineDir != "" || *journalFile != "" || *rejectLog != "" {
+		promises += " wpath cpath"
+	}
+	if strings.HasPrefix(*storageSpec, "sqlite:") {
+		promises += " flock"
+	}
+	if inet {
+		promises += " inet"
+	}
+	if dns {
+		promises += " dns"
+	}
+	if unix {
+		promises += " unix"
+	}
+	if *policyHook != "" {
+		promises += " proc exec"
+	}
+	return promises
+}
+
+// init defines the flags, so that they hold their defaults before they
+// are parsed, in tests too.
+func init() {
+	flag.Var(&rspamdURLs, "url", "rspamd base url (or path to unix socket), optionally followed by ,weight=<n>, may be repeated")
+	rspamdSettingsId = flag.String("settings-id", "", "rspamd Settings-ID")
+	rejectMessage = flag.String("reject-message", "", "reply template for rejected messages")
+	softRejectMessage = flag.String("soft-reject-message", "", "reply template for soft-rejected messages")
+	tempfailMessage = flag.String("tempfail-message", "", "reply template for messages that could not be scanned")
+	rejectCode = flag.String("reject-code", "550 5.7.1", "SMTP reply code for rejected messages")
+	softRejectCode = flag.String("soft-reject-code", "451 4.7.1", "SMTP reply code for soft-rejected messages")
+	tempfailCode = flag.String("tempfail-code", "421 4.3.0", "SMTP reply code for messages that could not be scanned")
+	stateDir = flag.String("state-dir", "", "directory keeping the state of the filter across restarts")
+	storageSpec = flag.String("storage", "memory", "storage for persistent state (memory, file:<path>, sqlite:<path> or redis://host:port/db)")
+	readOnly = flag.Bool("read-only", false, "never write to the storage nor the state directory, and temporarily reject the messages which would not be scanned")
+	spamdResult = flag.Bool("spamd-result", false, "add the X-Spamd-Result header of the rspamd milter")
+	dataTimeout = flag.Duration("data-timeout", 5*time.Minute, "time budget for a message, from the start of DATA")
+	authservIDFlag = flag.String("authserv-id", "", "authserv-id of the Authentication-Results of the MTA (defaults to its host name)")
+	localIP = flag.String("local-ip", "127.0.0.1", "address sent for the mail enqueued locally, or none")
+	localUser = flag.String("local-user", "", "user sent for the mail enqueued locally, as if authenticated")
+	resolverSpec = flag.String("resolver", "", "address of the name server to use, or path to a resolv.conf naming it")
+	stripForged = flag.Bool("strip-forged", false, "remove the headers of the filter and our Authentication-Results from the messages of untrusted clients")
+	trustedNetworkList = flag.String("trusted-networks", "127.0.0.0/8,::1", "comma-separated networks whose clients are trusted with the headers of the filter")
+	smtpOut = flag.Bool("smtp-out", false, "follow outgoing deliveries and record their recipients as correspondents")
+	correspondentTTL = flag.Duration("correspondent-ttl", 30*24*time.Hour, "time during which the recipients of outgoing mail are known as correspondents")
+	signOnly = flag.Bool("sign-only", false, "only have the messages of authenticated sessions DKIM-signed, without scanning them for spam")
+	canonicalRcpt = flag.Bool("canonical-rcpt", false, "send recipients to rspamd with their domain lowercased, without +extension and duplicates")
+	recipientScanCount = flag.Int("recipient-scans", 0, "number of recipients of a message scanned for them alone, reported in X-Spam-Recipient headers (0 to disable)")
+	scanFlagList = flag.String("flags", "", "comma-separated flags of the scans, as understood by rspamd")
+	rewriteBody = flag.Bool("rewrite-body", false, "replace the body of the messages rspamd rewrites")
+	retryAfter = flag.Duration("retry-after", 0, "delay after which clients are told to retry soft-rejected messages, unless rspamd greylisting tells (0 for no hint)")
+	hideSMTPMessage = flag.Bool("hide-smtp-message", false, "log the SMTP message of rspamd rather than send it to the client")
+	spamFlag = flag.Bool("spam-flag", false, "add an X-Spam-Flag header to spam along with X-Spam")
+	spamLevel = flag.Bool("spam-level", false, "add an X-Spam-Level header to spam")
+	experimentSettingsId = flag.String("experiment-settings-id", "", "rspamd Settings-ID used for a sample of the messages")
+	experimentRate = flag.Float64("experiment-rate", 0, "percentage of the messages scanned with the experiment Settings-ID")
+	hamHeaders = flag.Bool("ham-headers", false, "add the informational headers of the -header-profile to every scanned message, not only to spam")
+	headerProfile = flag.String("header-profile", "default", "headers added to spam (default or spamassassin)")
+	noHeaders = flag.Bool("no-headers", false, "enforce actions but never modify messages")
+	emptyMessage = flag.String("empty-message", "scan", "policy for messages without a body (scan, skip or reject)")
+	maxLines = flag.Int("max-lines", 0, "maximum number of lines of a message (0 for unlimited)")
+	maxBytes = flag.Int64("max-bytes", 0, "maximum size of a message in bytes (0 for unlimited)")
+	tarpitScore = flag.Float64("tarpit-score", 0, "score from which the messages of a session get it tarpitted (0 to disable)")
+	tarpitRejects = flag.Int("tarpit-rejects", 0, "number of rejects from which the sessions of an address are tarpitted (0 to disable)")
+	tarpitWindow = flag.Duration("tarpit-window", 24*time.Hour, "time during which the rejects of an address are counted")
+	tarpitDelay = flag.Duration("tarpit-delay", 10*time.Second, "delay of the responses to tarpitted sessions, per strike")
+	tarpitMaxDelay = flag.Duration("tarpit-max-delay", 0, "maximum delay of the responses to tarpitted sessions (defaults to -tarpit-delay)")
+	maxHeaderLines = flag.Int("max-header-lines", 1000, "maximum number of header lines processed (0 for unlimited)")
+	maxHeaderLength = flag.Int("max-header-length", 65536, "maximum length of the header lines processed (0 for unlimited)")
+	maxMilterHeaders = flag.Int("max-milter-headers", 100, "maximum number of headers rspamd may add or remove (0 for unlimited)")
+	oversizeMessage = flag.String("oversize-message", "tempfail", "policy for messages over -max-lines or -max-bytes (tempfail or pass)")
+	statusMaxSymbols = flag.Int("status-max-symbols", 0, "maximum number of symbols listed in X-Spam-Status (0 for all, -1 for none)")
+	statusSort = flag.String("status-sort", "name", "order of the symbols listed in X-Spam-Status (name or score)")
+	statusOptions = flag.Bool("status-options", false, "list the options of the symbols in X-Spam-Status")
+	statusMinScore = flag.Float64("status-min-score", 0, "minimum absolute score of the symbols listed in X-Spam-Status")
+	originalSubject = flag.Bool("original-subject", false, "keep rewritten subjects in an X-Original-Subject header")
+	subjectTag = flag.String("subject-tag", "", "tag added to the subject of spam")
+	subjectTagPosition = flag.String("subject-tag-position", "prefix", "position of the subject tag (prefix or suffix)")
+	eol = flag.String("eol", "lf", "line endings of the message sent to rspamd (lf or crlf)")
+	normalizeCR = flag.Bool("normalize-cr", false, "remove stray CRs from messages")
+	header8bit = flag.String("header-8bit", "pass", "handling of raw 8-bit data in headers (pass or sanitize)")
+	verdictCacheSize = flag.Int("verdict-cache", 0, "number of recent verdicts kept for the control socket")
+	controlSocket = flag.String("control-socket", "", "path of the control socket")
+	sessionMaxIdle = flag.Duration("session-max-idle", time.Hour, "time after which sessions without events are dropped (0 to never drop them)")
+	pprofSocket = flag.String("pprof-socket", "", "path of a unix socket serving runtime profiles")
+	quarantineDir = flag.String("quarantine-dir", "", "directory where rejected messages are kept")
+	quarantineMaxSize = flag.Int64("quarantine-max-size", 0, "maximum size of the quarantine in bytes (0 for unlimited)")
+	quarantineMaxAge = flag.Duration("quarantine-max-age", 0, "maximum age of quarantined messages (0 for unlimited)")
+	sendmail = flag.String("sendmail", "/usr/sbin/sendmail", "path of the sendmail program used to release quarantined messages")
+	controllerURL = flag.String("controller-url", "http://localhost:11334", "rspamd controller base url (or path to unix socket)")
+	controllerPassword = flag.String("controller-password", "", "password of the rspamd controller")
+	learnHam = flag.Bool("learn-ham", false, "submit messages from authenticated users which pass as ham")
+	spamtrapsFile = flag.String("spamtraps", "", "file listing spamtrap addresses and @domains")
+	spamtrapFuzzy = flag.Int("spamtrap-fuzzy", 0, "fuzzy flag under which messages sent to spamtraps are added to the fuzzy storage (0 to disable)")
+	connectCheck = flag.Bool("connect-check", false, "check the reputation of clients when they connect")
+	connectSettingsId = flag.String("connect-settings-id", "", "rspamd Settings-ID used for the connect check")
+	connectTimeout = flag.Duration("connect-timeout", 10*time.Second, "time allowed for the connect check")
+	rcptRejectFile = flag.String("rcpt-reject", "", "file listing recipient addresses and @domains rejected at RCPT time")
+	rcptBypassFile = flag.String("rcpt-bypass", "", "file listing recipient addresses and @domains whose messages are not scanned")
+	maxScans = flag.Int("max-scans", 0, "maximum number of scans in flight (0 for unlimited)")
+	scanQueueTimeout = flag.Duration("scan-queue-timeout", 0, "time a message may wait for a scan slot before it is temporarily rejected")
+	retries = flag.Int("retries", 2, "number of times a failed scan is retried")
+	retryBackoff = flag.Duration("retry-backoff", 200*time.Millisecond, "delay before the first retry of a failed scan, doubled on every retry")
+	breakerThreshold = flag.Int("breaker-threshold", 5, "consecutive failed scans after which rspamd is left alone (0 to disable)")
+	slowStart = flag.Duration("slow-start", 0, "time over which the traffic of a recovered rspamd is ramped up (0 to disable)")
+	breakerCooldown = flag.Duration("breaker-cooldown", 30*time.Second, "time rspamd is left alone after too many failed scans")
+	checkConf = flag.Bool("n", false, "check the configuration and exit")
+	flag.BoolVar(checkConf, "checkconf", false, "check the configuration and exit")
+	showVersion = flag.Bool("version", false, "print the version and exit")
+	shadowURL = flag.String("shadow-url", "", "rspamd base url (or path to unix socket) which receives a copy of every scan")
+	shadowScoreDelta = flag.Float64("shadow-score-delta", 0, "score difference from the shadow instance logged as a disagreement (0 to only compare actions)")
+	shadowReportInterval = flag.Duration("shadow-report-interval", time.Hour, "interval between summaries of the disagreements with the shadow instance (0 to disable)")
+	lbStrategy = flag.String("lb-strategy", "weighted", "how scans are spread over rspamd instances (weighted, round-robin or hash-ip)")
+	healthInterval = flag.Duration("health-interval", 0, "interval between health checks of rspamd (0 to disable)")
+	flag.Var(actionMap, "map-action", "handle an rspamd action as another one (<action>=<action>), may be repeated")
+	flag.Var(symbolActions, "symbol-action", "force an action when a symbol is found (<symbol>=<action>, accept for no action), may be repeated")
+	flag.Var(dkimSelectors, "dkim-selector", "check that outgoing mail from a domain is signed with a selector (<domain>=<selector>), may be repeated")
+	flag.Var(headerNames, "rename-header", "write a header generated by the filter under another name (<header>=<name>, empty to suppress), may be repeated")
+	configFile = flag.String("config", "", "file of options, optionally grouped in [profile] sections")
+	profile = flag.String("profile", "", "profile of the configuration file to apply")
+	passwordFile = flag.String("password-file", "", "file holding the password of the rspamd controller")
+	settingsFile = flag.String("settings-file", "", "file holding rspamd settings sent with every scan")
+	debugHeader = flag.Bool("debug-header", false, "add the raw rspamd verdict to messages in an X-Rspamd-Debug header")
+	journalFile = flag.String("journal", "", "file the verdicts are appended to, one JSON object per line")
+	journalMaxSize = flag.Int64("journal-max-size", 0, "size in bytes past which the journal is rotated (0 for unlimited)")
+	journalMaxAge = flag.Duration("journal-max-age", 0, "time after which the journal is rotated (0 for unlimited)")
+	historyRetention = flag.Duration("history-retention", 0, "time the verdicts are kept in the storage for the history command (0 to keep none)")
+	publishURL = flag.String("publish-url", "", "redis://[:password@]host[:port][/db] URL of the redis server verdicts are published to")
+	publishChannel = flag.String("publish-channel", "filter-rspamd", "redis channel verdicts are published to")
+	webhookURL = flag.String("webhook-url", "", "URL notified of rejected messages")
+	webhookSecretFile = flag.String("webhook-secret-file", "", "file holding the key used to sign webhook notifications")
+	virusSymbolList = flag.String("virus-symbols", "", "comma-separated prefixes of the symbols reporting viruses")
+	virusAction = flag.String("virus-action", "reject", "action applied to messages with a virus")
+	dmarcEnforce = flag.Bool("dmarc-enforce", false, "reject or mark for quarantine the messages failing DMARC according to the policy of their domain")
+	dmarcExceptionsFile = flag.String("dmarc-exceptions", "", "file listing sender addresses and @domains exempted from -dmarc-enforce")
+	rejectLog = flag.String("reject-log", "", "file a line is appended to for every rejection, for fail2ban or blocklistd")
+	rejectScore = flag.Float64("reject-score", 0, "reject messages whose score reaches this threshold whatever the action of rspamd (0 to disable)")
+	dryRunFlag = flag.Bool("dry-run", false, "scan messages and log the actions which would be taken, but only add headers")
+	rateLimit = flag.Int("rate-limit", 0, "number of transactions allowed to a client address during the -rate-limit-window (0 to disable)")
+	rateLimitWindow = flag.Duration("rate-limit-window", time.Hour, "sliding window over which the transactions of a client address are counted")
+	disconnectScore = flag.Float64("disconnect-score", 0, "drop the session instead of rejecting messages whose score reaches this threshold (0 to disable)")
+	weightsFile = flag.String("weights", "", "file of local adjustments to the scores of symbols")
+	rulesFile = flag.String("rules", "", "file of local policy rules evaluated after the rspamd verdict")
+	policyHook = flag.String("policy-hook", "", "program run with the verdict of every message, which may override its action")
+	policyHookTimeout = flag.Duration("policy-hook-timeout", 5*time.Second, "time allowed to the policy hook")
+}
+
+func main() {
+	flag.Parse()
+
+	if *showVersion {
+		fmt.Println(versionString())
+		os.Exit(0)
+	}
+
+	if *profile != "" && *configFile == "" {
+		log.Fatalf("a profile requires a configuration file")
+	}
+	if *configFile != "" {
+		if err := loadConfig(flag.CommandLine, *configFile, *profile); err != nil {
+			log.Fatalf("config '%s' err: %s", *configFile, err)
+		}
+	}
+
+	if *passwordFile != "" {
+		if *controllerPassword != "" {
+			log.Fatalf("-controller-password and -password-file are mutually exclusive")
 		}
+		password, err := readSecret(*passwordFile)
+		if err != nil {
+			log.Fatalf("password file '%s' err: %s", *passwordFile, err)
+		}
+		*controllerPassword = password
 	}
-}
 
-func main() {
-	rspamdURL = flag.String("url", "http://localhost:11333", "rspamd base url (or path to unix socket)")
-	rspamdSettingsId = flag.String("settings-id", "", "rspamd Settings-ID")
+	if *webhookURL != "" {
+		if *webhookSecretFile == "" {
+			log.Fatalf("-webhook-url requires -webhook-secret-file")
+		}
+		u, err := url.Parse(*webhookURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			log.Fatalf("invalid webhook URL: %s", *webhookURL)
+		}
+		secret, err := readSecret(*webhookSecretFile)
+		if err != nil {
+			log.Fatalf("webhook secret file '%s' err: %s", *webhookSecretFile, err)
+		}
+		webhook = newWebhookNotifier(*webhookURL, secret)
+	}
 
-	flag.Parse()
+	if *settingsFile != "" {
+		var err error
+		if rspamdSettings, err = readSettings(*settingsFile); err != nil {
+			log.Fatalf("settings file '%s' err: %s", *settingsFile, err)
+		}
+	}
+
+	if *experimentRate < 0 || *experimentRate > 100 {
+		log.Fatalf("invalid experiment rate: %v", *experimentRate)
+	}
+	rand.Seed(time.Now().UnixNano())
+
+	switch *emptyMessage {
+	case "scan", "skip", "reject":
+	default:
+		log.Fatalf("invalid empty message policy: %s", *emptyMessage)
+	}
+
+	if *maxLines < 0 {
+		log.Fatalf("invalid maximum number of lines: %d", *maxLines)
+	}
+	if *maxBytes < 0 {
+		log.Fatalf("invalid maximum size: %d", *maxBytes)
+	}
+	if *tarpitScore < 0 || *tarpitRejects < 0 || *tarpitWindow < 0 || *tarpitDelay < 0 || *tarpitMaxDelay < 0 {
+		log.Fatalf("invalid tarpit settings")
+	}
+	if *tarpitMaxDelay < *tarpitDelay {
+		*tarpitMaxDelay = *tarpitDelay
+	}
+
+	if *maxHeaderLines < 0 {
+		log.Fatalf("invalid maximum number of header lines: %d", *maxHeaderLines)
+	}
+	if *maxHeaderLength < 0 {
+		log.Fatalf("invalid maximum header length: %d", *maxHeaderLength)
+	}
+	if *maxMilterHeaders < 0 {
+		log.Fatalf("invalid maximum number of milter headers: %d", *maxMilterHeaders)
+	}
+	switch *oversizeMessage {
+	case "tempfail", "pass":
+	default:
+		log.Fatalf("invalid oversize message policy: %s", *oversizeMessage)
+	}
+
+	if *stateDir != "" {
+		storageSet := false
+		flag.Visit(func(f *flag.Flag) {
+			storageSet = storageSet || f.Name == "storage"
+		})
+		if !storageSet {
+			*storageSpec = "file:" + stateStoragePath(*stateDir)
+		}
+	}
+
+	if *verdictCacheSize < 0 {
+		log.Fatalf("invalid verdict cache size: %d", *verdictCacheSize)
+	}
+	if *verdictCacheSize > 0 {
+		verdicts = newVerdictCache(*verdictCacheSize)
+	}
+
+	if *spamtrapsFile != "" {
+		var err error
+		if spamtraps, err = loadList(*spamtrapsFile); err != nil {
+			log.Fatalf("spamtraps '%s' err: %s", *spamtrapsFile, err)
+		}
+	}
+
+	if *rcptRejectFile != "" {
+		var err error
+		if rcptRejects, err = loadList(*rcptRejectFile); err != nil {
+			log.Fatalf("rcpt reject '%s' err: %s", *rcptRejectFile, err)
+		}
+	}
+
+	if *rcptBypassFile != "" {
+		var err error
+		if rcptBypass, err = loadList(*rcptBypassFile); err != nil {
+			log.Fatalf("rcpt bypass '%s' err: %s", *rcptBypassFile, err)
+		}
+	}
+
+	if *dmarcExceptionsFile != "" {
+		var err error
+		if dmarcExceptions, err = loadList(*dmarcExceptionsFile); err != nil {
+			log.Fatalf("dmarc exceptions '%s' err: %s", *dmarcExceptionsFile, err)
+		}
+	}
+
+	for from, to := range actionMap {
+		if !validAction(from) || !validAction(to) {
+			log.Fatalf("invalid action mapping: %s=%s", from, to)
+		}
+	}
+
+	for symbol, action := range symbolActions {
+		if action == "accept" {
+			symbolActions[symbol] = "no action"
+		} else if !validAction(action) {
+			log.Fatalf("invalid symbol action: %s=%s", symbol, action)
+		}
+	}
+
+	for _, prefix := range strings.Split(*virusSymbolList, ",") {
+		if prefix = strings.TrimSpace(prefix); prefix != "" {
+			virusSymbols = append(virusSymbols, strings.ToUpper(prefix))
+		}
+	}
+	for _, f := range strings.Split(*scanFlagList, ",") {
+		if f = strings.TrimSpace(f); f == "" {
+			continue
+		}
+		if strings.ContainsAny(f, " \t\r\n") {
+			log.Fatalf("invalid flag: %s", f)
+		}
+		scanFlags = append(scanFlags, f)
+	}
+	if *rewriteBody {
+		// the rewritten body only comes back with the body block
+		blocks := false
+		for _, f := range scanFlags {
+			blocks = blocks || strings.EqualFold(f, "body_block")
+		}
+		if !blocks {
+			scanFlags = append(scanFlags, "body_block")
+		}
+	}
+
+	if !validAction(*virusAction) {
+		log.Fatalf("invalid virus action: %s", *virusAction)
+	}
+
+	if *rejectScore < 0 {
+		log.Fatalf("invalid reject score: %v", *rejectScore)
+	}
+	if *disconnectScore < 0 {
+		log.Fatalf("invalid disconnect score: %v", *disconnectScore)
+	}
+	if *rateLimit < 0 || *rateLimitWindow <= 0 {
+		log.Fatalf("invalid rate limit: %d/%s", *rateLimit, *rateLimitWindow)
+	}
+	if *rateLimit > 0 {
+		limiter = newRateLimiter(*rateLimit, *rateLimitWindow)
+	}
+	if *dryRunFlag {
+		dryRun = 1
+	}
+
+	if *retries < 0 {
+		log.Fatalf("invalid number of retries: %d", *retries)
+	}
+	if *retryBackoff <= 0 {
+		log.Fatalf("invalid retry backoff: %s", *retryBackoff)
+	}
+
+	if *weightsFile != "" {
+		var err error
+		if symbolWeights, actionThresholds, err = loadWeights(*weightsFile); err != nil {
+			log.Fatalf("weights '%s' err: %s", *weightsFile, err)
+		}
+	}
+
+	if *rulesFile != "" {
+		var err error
+		if rules, err = loadRules(*rulesFile); err != nil {
+			log.Fatalf("rules '%s' err: %s", *rulesFile, err)
+		}
+	}
+
+	if *policyHook != "" && !filepath.IsAbs(*policyHook) {
+		log.Fatalf("invalid policy hook, path must be absolute: %s", *policyHook)
+	}
+	if *sessionMaxIdle < 0 {
+		log.Fatalf("invalid session max idle time: %s", *sessionMaxIdle)
+	}
+	if *policyHookTimeout <= 0 {
+		log.Fatalf("invalid policy hook timeout: %s", *policyHookTimeout)
+	}
+
+	switch *lbStrategy {
+	case "weighted", "round-robin", "hash-ip":
+	default:
+		log.Fatalf("invalid load balancing strategy: %s", *lbStrategy)
+	}
+
+	if *healthInterval < 0 {
+		log.Fatalf("invalid health check interval: %s", *healthInterval)
+	}
+
+	if *breakerThreshold < 0 {
+		log.Fatalf("invalid breaker threshold: %d", *breakerThreshold)
+	}
+	if *slowStart < 0 {
+		log.Fatalf("invalid slow start: %s", *slowStart)
+	}
+
+	if *maxScans < 0 {
+		log.Fatalf("invalid maximum number of scans: %d", *maxScans)
+	}
+	if *maxScans > 0 {
+		scanSlots = make(chan struct{}, *maxScans)
+	}
+
+	if *quarantineMaxSize < 0 {
+		log.Fatalf("invalid quarantine size: %d", *quarantineMaxSize)
+	}
+	if *quarantineMaxAge < 0 {
+		log.Fatalf("invalid quarantine age: %s", *quarantineMaxAge)
+	}
+	if *journalMaxSize < 0 {
+		log.Fatalf("invalid journal size: %d", *journalMaxSize)
+	}
+	if *journalMaxAge < 0 {
+		log.Fatalf("invalid journal age: %s", *journalMaxAge)
+	}
+	if *historyRetention < 0 {
+		log.Fatalf("invalid history retention: %s", *historyRetention)
+	}
+
+	if *eol != "lf" && *eol != "crlf" {
+		log.Fatalf("invalid line endings: %s", *eol)
+	}
+
+	if *header8bit != "pass" && *header8bit != "sanitize" {
+		log.Fatalf("invalid 8-bit header handling: %s", *header8bit)
+	}
+
+	if *subjectTagPosition != "prefix" && *subjectTagPosition != "suffix" {
+		log.Fatalf("invalid subject tag position: %s", *subjectTagPosition)
+	}
+
+	if *localIP != "none" && net.ParseIP(*localIP) == nil {
+		log.Fatalf("invalid local ip: %s", *localIP)
+	}
+
+	if err := setupResolver(); err != nil {
+		log.Fatalf("resolver '%s' err: %s", *resolverSpec, err)
+	}
+
+	if networks, err := parseNetworks(*trustedNetworkList); err != nil {
+		log.Fatalf("invalid trusted networks: %s", err)
+	} else {
+		trustedNetworks = networks
+	}
+
+	if *correspondentTTL <= 0 {
+		log.Fatalf("invalid correspondent ttl: %s", *correspondentTTL)
+	}
+
+	if *recipientScanCount < 0 {
+		log.Fatalf("invalid recipient scans: %d", *recipientScanCount)
+	}
+
+	if *retryAfter < 0 {
+		log.Fatalf("invalid retry after: %s", *retryAfter)
+	}
 
-	if err := PledgePromises("stdio rpath inet dns unix unveil"); err != nil {
+	if *statusSort != "name" && *statusSort != "score" {
+		log.Fatalf("invalid status sort: %s", *statusSort)
+	}
+
+	if *headerProfile != "default" && *headerProfile != "spamassassin" {
+		log.Fatalf("invalid header profile: %s", *headerProfile)
+	}
+
+	if !validReplyCode(*rejectCode, '5') {
+		log.Fatalf("invalid reject code: %s", *rejectCode)
+	}
+	if !validReplyCode(*softRejectCode, '4') {
+		log.Fatalf("invalid soft reject code: %s", *softRejectCode)
+	}
+	if !validReplyCode(*tempfailCode, '4') {
+		log.Fatalf("invalid tempfail code: %s", *tempfailCode)
+	}
+
+	if len(rspamdURLs) == 0 {
+		rspamdURLs = listFlag{"http://localhost:11333"}
+	}
+	for _, spec := range rspamdURLs {
+		b, err := parseBackend(spec)
+		if err != nil {
+			log.Fatalf("invalid rspamd url '%s': %s", spec, err)
+		}
+		backends = append(backends, b)
+	}
+
+	if *shadowURL != "" {
+		var err error
+		if shadow, err = parseBackend(*shadowURL); err != nil {
+			log.Fatalf("invalid shadow url '%s': %s", *shadowURL, err)
+		}
+	}
+
+	if !strings.HasPrefix(*controllerURL, "http") {
+		controllerSocketPath = *controllerURL
+		*controllerURL = "http://localhost"
+	}
+
+	if *checkConf {
+		if err := checkConfig(); err != nil {
+			log.Fatalf("configuration check failed: %s", err)
+		}
+		fmt.Println("configuration OK")
+		os.Exit(0)
+	}
+
+	if flag.NArg() > 0 {
+		if err := PledgePromises("stdio rpath wpath cpath flock inet dns unix proc exec"); err != nil {
+			log.Fatalf("pledge promise err: %s", err)
+		}
+		if err := command(flag.Args()); err != nil {
+			log.Fatalf("%s: %s", flag.Arg(0), err)
+		}
+		os.Exit(0)
+	}
+
+	handleDumpSignal()
+	if *sessionMaxIdle > 0 {
+		go expireSessions(*sessionMaxIdle)
+	}
+	if limiter != nil {
+		go limiter.expire()
+	}
+
+	if *stateDir != "" {
+		// a secondary MX reads the state of the primary, but never
+		// creates nor saves any
+		if !*readOnly {
+			if err := openStateDir(*stateDir); err != nil {
+				log.Fatalf("state dir '%s' err: %s", *stateDir, err)
+			}
+		}
+		if verdicts != nil {
+			if err := verdicts.load(stateVerdictsPath(*stateDir)); err != nil {
+				log.Fatalf("state dir '%s' err: %s", *stateDir, err)
+			}
+			if !*readOnly {
+				go persistVerdicts(*stateDir)
+			}
+		}
+	}
+
+	promises := "stdio rpath inet dns unix unveil"
+	if *policyHook != "" {
+		promises += " proc exec"
+	}
+	if (storagePath(*storageSpec) != "" && !*readOnly) || (*stateDir != "" && !*readOnly) || *quarantineDir != "" || *journalFile != "" || *rejectLog != "" {
+		promises += " wpath cpath"
+	} else if *controlSocket != "" || *pprofSocket != "" {
+		promises += " cpath"
+	}
+	if strings.HasPrefix(*storageSpec, "sqlite:") {
+		promises += " flock"
+	}
+	if *controlSocket != "" || *pprofSocket != "" {
+		promises += " fattr"
+	}
+	if err := PledgePromises(promises); err != nil {
 		log.Fatalf("pledge promise err: %s", err)
 	}
 
-	if err := Unveil("/etc/resolv.conf", "r"); err != nil {
-		log.Fatalf("unveil resolv err: %s", err)
+	resolvConf := "/etc/resolv.conf"
+	if *resolverSpec != "" {
+		resolvConf = resolverConf()
+	}
+	if resolvConf != "" {
+		if err := Unveil(resolvConf, "r"); err != nil {
+			log.Fatalf("unveil resolv err: %s", err)
+		}
 	}
 
 	if err := Unveil("/etc/hosts", "r"); err != nil {
 		log.Fatalf("unveil hosts err: %s", err)
 	}
 
-	if !strings.HasPrefix(*rspamdURL, "http") {
-		unixSocketPath = *rspamdURL
-		*rspamdURL = "http://localhost"
+	// certificates are loaded on the first TLS connection, once the
+	// filter is set up
+	if usesTLS() {
+		if err := Unveil(caBundle, "r"); err != nil {
+			log.Fatalf("unveil '%s' err: %s", caBundle, err)
+		}
+	}
+
+	for _, b := range backends {
+		if b.socketPath == "" {
+			continue
+		}
+		unixSocketPath := b.socketPath
 
 		if err := Unveil(unixSocketPath, "rw"); err != nil {
 			log.Fatalf("unveil '%s' err: %s", unixSocketPath, err)
 		}
 
-		if _, err := os.Stat(unixSocketPath); err != nil {
-			log.Fatalf("unix socket stat '%s' err: '%s'", unixSocketPath, err)
+		// rspamd may not be up yet, scans are retried and tempfailed
+		// until it is.
+		c, err := dialUnix(context.Background(), unixSocketPath)
+		if err != nil {
+			log.Printf("warning: unix socket connect '%s' err: '%s'", unixSocketPath, err)
+			continue
+		}
+		c.Close()
+	}
+	if shadow != nil {
+		if shadow.socketPath != "" {
+			if err := Unveil(shadow.socketPath, "rw"); err != nil {
+				log.Fatalf("unveil '%s' err: %s", shadow.socketPath, err)
+			}
+		}
+		if *shadowReportInterval > 0 {
+			go shadowReport(*shadowReportInterval)
+		}
+	}
+
+	if *healthInterval > 0 {
+		for _, b := range backends {
+			go b.healthCheck(*healthInterval)
+		}
+	}
+
+	if controllerSocketPath != "" {
+		if err := Unveil(controllerSocketPath, "rw"); err != nil {
+			log.Fatalf("unveil '%s' err: %s", controllerSocketPath, err)
+		}
+	}
+
+	if path := storagePath(*storageSpec); path != "" {
+		// sqlite looks for its journal next to the database, and file
+		// storages are replaced by another file when compacted
+		if *readOnly {
+			if err := Unveil(filepath.Dir(path), "r"); err != nil {
+				log.Fatalf("unveil '%s' err: %s", filepath.Dir(path), err)
+			}
+		} else if err := Unveil(filepath.Dir(path), "rwc"); err != nil {
+			log.Fatalf("unveil '%s' err: %s", filepath.Dir(path), err)
+		}
+	}
+
+	if *stateDir != "" && *readOnly {
+		if err := Unveil(*stateDir, "r"); err != nil {
+			log.Fatalf("unveil '%s' err: %s", *stateDir, err)
+		}
+	} else if *stateDir != "" {
+		if err := Unveil(*stateDir, "rwc"); err != nil {
+			log.Fatalf("unveil '%s' err: %s", *stateDir, err)
+		}
+	}
+
+	if *quarantineDir != "" {
+		if err := Unveil(*quarantineDir, "rwc"); err != nil {
+			log.Fatalf("unveil '%s' err: %s", *quarantineDir, err)
 		}
 
-		c, err := net.Dial("unix", unixSocketPath)
+		q, err := openQuarantine(*quarantineDir, *quarantineMaxSize, *quarantineMaxAge)
 		if err != nil {
-			log.Fatalf("unix socket connect '%s' err: '%s'", unixSocketPath, err)
+			log.Fatalf("quarantine '%s' err: %s", *quarantineDir, err)
 		}
-		c.Close()
+		quarantined = q
+		go q.maintain(quarantineSyncInterval)
+	}
+
+	if *policyHook != "" {
+		if err := Unveil(*policyHook, "x"); err != nil {
+			log.Fatalf("unveil '%s' err: %s", *policyHook, err)
+		}
+	}
+
+	if *rejectLog != "" {
+		if err := Unveil(filepath.Dir(*rejectLog), "wc"); err != nil {
+			log.Fatalf("unveil '%s' err: %s", filepath.Dir(*rejectLog), err)
+		}
+	}
+
+	if *journalFile != "" {
+		if err := Unveil(filepath.Dir(*journalFile), "wc"); err != nil {
+			log.Fatalf("unveil '%s' err: %s", filepath.Dir(*journalFile), err)
+		}
+
+		j, err := openJournal(*journalFile, *journalMaxSize, *journalMaxAge)
+		if err != nil {
+			log.Fatalf("journal '%s' err: %s", *journalFile, err)
+		}
+		journal = j
+	}
+
+	if *controlSocket != "" {
+		if err := Unveil(*controlSocket, "rwc"); err != nil {
+			log.Fatalf("unveil '%s' err: %s", *controlSocket, err)
+		}
+
+		l, err := listenControl(*controlSocket)
+		if err != nil {
+			log.Fatalf("control socket '%s' err: %s", *controlSocket, err)
+		}
+		go serveControl(l)
+	}
+
+	if *pprofSocket != "" {
+		if err := Unveil(*pprofSocket, "rwc"); err != nil {
+			log.Fatalf("unveil '%s' err: %s", *pprofSocket, err)
+		}
+
+		if err := servePprof(*pprofSocket); err != nil {
+			log.Fatalf("pprof socket '%s' err: %s", *pprofSocket, err)
+		}
+	}
+
+	if *publishURL != "" {
+		p, err := newVerdictPublisher(*publishURL, *publishChannel)
+		if err != nil {
+			log.Fatalf("publish '%s' err: %s", *publishURL, err)
+		}
+		publisher = p
+		go publisher.run()
+	}
+
+	if webhook != nil {
+		go webhook.run()
+	}
+
+	var err error
+	if store, err = openStorage(*storageSpec, *readOnly); err != nil {
+		log.Fatalf("storage '%s' err: %s", *storageSpec, err)
+	}
+	if *readOnly {
+		if f, ok := store.(*fileStorage); ok {
+			go f.follow(storageReloadInterval)
+		}
+		store = readOnlyStorage{store}
 	}
 
 	if err := UnveilBlock(); err != nil {
 		log.Fatalf("unveil block err: %s", err)
 	}
 
+	if err := PledgePromises(steadyPromises()); err != nil {
+		log.Fatalf("pledge promise err: %s", err)
+	}
+
+	log.Println(versionString())
 	log.Println("reading line scanner")
 	scanner := bufio.NewScanner(os.Stdin)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	scanner.Split(scanProtocolLines)
 
 	log.Println("reading lines until ready")
 	skipConfig(scanner)
 
+	if *connectCheck {
+		filters["connect"] = connectFilter
+	}
+	if *rcptRejectFile != "" || tarpitEnabled() {
+		filters["rcpt-to"] = rcptTo
+	}
+	if limiter != nil || tarpitEnabled() {
+		filters["mail-from"] = mailFrom
+	}
+
 	log.Println("responding desired filters")
 	filterInit()
 
-	outputChannel = make(chan string)
+	// Scans run concurrently and flush whole messages at once: output is
+	// queued and written in batches so that the dispatch loop, and the
+	// other sessions, never wait on a single line being written.
+	outputChannel = make(chan string, 4096)
 	go func() {
+		w := bufio.NewWriterSize(os.Stdout, 64*1024)
 		for line := range outputChannel {
-			fmt.Println(line)
+			w.WriteString(line)
+			w.WriteByte('\n')
+			if len(outputChannel) == 0 {
+				if err := w.Flush(); err != nil {
+					log.Fatalf("output err: %s", err)
+				}
+			}
 		}
 	}()
 
-	atom_len := 6
-
 	for {
 		if !scanner.Scan() {
+			if err := scanner.Err(); err != nil {
+				log.Fatalf("input err: %s", err)
+			}
 			log.Print("no more lines to scan. exiting...")
+			if *stateDir != "" && !*readOnly {
+				saveState(*stateDir)
+			}
+			logMetrics()
 			os.Exit(0)
 		}
 
-		line := scanner.Text()
-		atoms := strings.Split(line, "|")
-		if len(atoms) < atom_len {
-			log.Fatalf("missing atoms. expected %d. got %d: %s", atom_len, len(atoms), line)
-		}
+		dispatch(scanner.Text())
+	}
+}
 
-		version = atoms[1]
+// dispatch passes a line of the filter protocol to its handler.
+func dispatch(line string) {
+	atom_len := 6
 
-		switch atoms[0] {
-		case "report":
-			trigger(reporters, atoms)
-		case "filter":
-			trigger(filters, atoms)
-		default:
-			log.Fatalf("invalid stream: %s", atoms[0])
+	atoms := strings.Split(line, "|")
+	if len(atoms) < atom_len {
+		log.Fatalf("missing atoms. expected %d. got %d: %s", atom_len, len(atoms), line)
+	}
+
+	version = atoms[1]
+
+	switch atoms[0] {
+	case "report":
+		if atoms[3] == "smtp-out" {
+			reportOut(atoms)
+			break
 		}
+		trigger(reporters, atoms)
+	case "filter":
+		trigger(filters, atoms)
+	default:
+		log.Fatalf("invalid stream: %s", atoms[0])
 	}
 }
@@ -0,0 +1,827 @@
+//
+// Copyright (c) 2019 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/poolpOrg/filter-rspamd/internal/rspamdtest"
+	"github.com/poolpOrg/filter-rspamd/mailrewrite"
+)
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	if !testing.Verbose() {
+		log.SetOutput(ioutil.Discard)
+	}
+	os.Exit(m.Run())
+}
+
+// filterTest drives the filter through the protocol of smtpd, scanning
+// messages with a fake rspamd.
+type filterTest struct {
+	t       *testing.T
+	rspamd  *rspamdtest.Server
+	session string
+	n       int
+}
+
+// newFilterTest starts a fake rspamd and points the filter at it.  Flags
+// changed by the test with setFlag are restored once it is over.
+func newFilterTest(t *testing.T) *filterTest {
+	f := &filterTest{t: t, rspamd: rspamdtest.NewServer(), session: "0000000000000001"}
+	t.Cleanup(f.rspamd.Close)
+
+	b, err := parseBackend(f.rspamd.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := backends
+	backends = []*backend{b}
+	t.Cleanup(func() { backends = saved })
+
+	outputChannel = make(chan string, 4096)
+	return f
+}
+
+// setFlag sets a flag for the duration of the test.
+func setFlag(t *testing.T, name string, value string) {
+	fl := flag.Lookup(name)
+	if fl == nil {
+		t.Fatalf("no flag -%s", name)
+	}
+	saved := fl.Value.String()
+	if err := fl.Value.Set(value); err != nil {
+		t.Fatalf("-%s %s: %s", name, value, err)
+	}
+	t.Cleanup(func() { fl.Value.Set(saved) })
+}
+
+// send passes a line of the filter protocol to the filter.
+func (f *filterTest) send(kind string, event string, params ...string) {
+	dispatch(strings.Join(append([]string{kind, "0.7", "1576146008.006099", "smtp-in", event, f.session}, params...), "|"))
+}
+
+// receive returns the next line the filter writes.
+func (f *filterTest) receive() string {
+	select {
+	case line := <-outputChannel:
+		return line
+	case <-time.After(10 * time.Second):
+		f.t.Fatal("no answer from the filter")
+		return ""
+	}
+}
+
+// connect opens a session from the client at src.
+func (f *filterTest) connect(src string) {
+	f.send("report", "link-connect", "mail.example.org", "pass", src, "192.0.2.25:25")
+	f.send("report", "link-greeting", "mx.example.net")
+	f.send("report", "link-identify", "EHLO", "mail.example.org")
+	f.t.Cleanup(func() { f.send("report", "link-disconnect") })
+}
+
+// deliver sends message as the data of a transaction from sender to rcpts,
+// one line per element, and returns the filter-result answered at commit
+// and the message as it is handed back to smtpd, dot-stuffing included.
+func (f *filterTest) deliver(sender string, rcpts []string, message []string) (string, []string) {
+	f.n++
+	msgid := fmt.Sprintf("%08x", f.n)
+	token := fmt.Sprintf("%016x", f.n)
+
+	f.send("report", "tx-begin", msgid)
+	f.send("report", "tx-mail", msgid, "ok", sender)
+	for _, rcpt := range rcpts {
+		f.send("report", "tx-rcpt", msgid, "ok", rcpt)
+	}
+	for _, line := range message {
+		f.send("filter", "data-line", token, line)
+	}
+	f.send("filter", "data-line", token, ".")
+
+	prefix := "filter-dataline|" + f.session + "|" + token + "|"
+	var out []string
+	for {
+		line := f.receive()
+		if !strings.HasPrefix(line, prefix) {
+			f.t.Fatalf("unexpected output: %q", line)
+		}
+		line = strings.TrimPrefix(line, prefix)
+		if line == "." {
+			break
+		}
+		out = append(out, line)
+	}
+
+	f.send("filter", "commit", token, "ok")
+	result := f.receive()
+	prefix = "filter-result|" + f.session + "|" + token + "|"
+	if !strings.HasPrefix(result, prefix) {
+		f.t.Fatalf("unexpected result: %q", result)
+	}
+	f.send("report", "tx-reset", msgid)
+	return strings.TrimPrefix(result, prefix), out
+}
+
+var testMessage = []string{
+	"From: sender@example.org",
+	"To: rcpt@example.net",
+	"Subject: hello",
+	"",
+	"body",
+}
+
+func TestFilterActions(t *testing.T) {
+	tests := []struct {
+		action  string
+		result  string
+		headers []string
+	}{
+		{"no action", "proceed", nil},
+		{"greylist", "proceed", nil},
+		{"add header", "proceed", []string{"X-Spam: yes", "X-Spam-Score: 6 / 15"}},
+		{"rewrite subject", "proceed", []string{"Subject: *** SPAM *** hello"}},
+		{"soft reject", "reject|451 4.7.1 try again later", nil},
+		{"reject", "reject|550 5.7.1 message rejected", nil},
+		{"discard", "reject|250 2.0.0 00000001 Message accepted for delivery", nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.action, func(t *testing.T) {
+			f := newFilterTest(t)
+			v := rspamdtest.Action(test.action)
+			v.Subject = "*** SPAM *** hello"
+			f.rspamd.SetVerdict(v)
+			f.connect("198.51.100.1:1234")
+
+			result, out := f.deliver("sender@example.org", []string{"rcpt@example.net"}, testMessage)
+			if result != test.result {
+				t.Errorf("result: got %q, want %q", result, test.result)
+			}
+			for _, h := range test.headers {
+				if !contains(out, h) {
+					t.Errorf("header %q missing: %q", h, out)
+				}
+			}
+			if test.headers == nil && contains(out, "X-Spam: yes") {
+				t.Errorf("unexpected spam header: %q", out)
+			}
+		})
+	}
+}
+
+func TestFilterRequest(t *testing.T) {
+	f := newFilterTest(t)
+	f.connect("198.51.100.1:1234")
+
+	f.deliver("sender@example.org", []string{"a@example.net", "b@example.net"}, testMessage)
+
+	requests := f.rspamd.Requests()
+	if len(requests) != 1 || requests[0].Path != "/checkv2" {
+		t.Fatalf("requests: %+v", requests)
+	}
+	header := requests[0].Header
+	expected := map[string][]string{
+		"Ip":       {"198.51.100.1"},
+		"Helo":     {"mail.example.org"},
+		"Hostname": {"mail.example.org"},
+		"From":     {"sender@example.org"},
+		"Rcpt":     {"a@example.net", "b@example.net"},
+		"Queue-Id": {"00000001"},
+	}
+	for name, values := range expected {
+		if !reflect.DeepEqual(header[name], values) {
+			t.Errorf("%s: got %q, want %q", name, header[name], values)
+		}
+	}
+	if body := string(requests[0].Body); body != strings.Join(testMessage, "\n") {
+		t.Errorf("body: got %q", body)
+	}
+}
+
+func TestFilterDotStuffing(t *testing.T) {
+	f := newFilterTest(t)
+	f.rspamd.SetVerdict(rspamdtest.Action("add header"))
+	f.connect("198.51.100.1:1234")
+
+	message := []string{"Subject: dots", "", "..", "..leading dot", "not.leading", "...", "body"}
+	_, out := f.deliver("sender@example.org", []string{"rcpt@example.net"}, message)
+
+	if !reflect.DeepEqual(out[len(out)-len(message):], message) {
+		t.Errorf("got %q, want %q", out, message)
+	}
+	body := string(f.rspamd.Requests()[0].Body)
+	if !strings.Contains(body, "\n.\n.leading dot\nnot.leading\n..\n") {
+		t.Errorf("rspamd got a dot-stuffed message: %q", body)
+	}
+}
+
+func TestFilterPassThrough(t *testing.T) {
+	message := []string{
+		"From: sender@example.org ",
+		"Subject: trailing   ",
+		" \tfolded\t",
+		"",
+		"trailing spaces   ",
+		"\x0cform feed",
+		"stray\rcarriage return",
+		"",
+	}
+
+	for _, action := range []string{"no action", "add header"} {
+		t.Run(action, func(t *testing.T) {
+			f := newFilterTest(t)
+			f.rspamd.SetVerdict(rspamdtest.Action(action))
+			f.connect("198.51.100.1:1234")
+
+			_, out := f.deliver("sender@example.org", []string{"rcpt@example.net"}, message)
+			if !reflect.DeepEqual(out[len(out)-len(message):], message) {
+				t.Errorf("got %q, want %q", out, message)
+			}
+		})
+	}
+}
+
+func TestFilterMilter(t *testing.T) {
+	f := newFilterTest(t)
+	v := rspamdtest.Action("no action")
+	v.Milter = &rspamdtest.Milter{
+		AddHeaders: map[string]interface{}{
+			"X-Plain":   "plain",
+			"X-Ordered": map[string]interface{}{"order": 0, "value": "ordered"},
+			"X-List": []interface{}{
+				map[string]interface{}{"order": 1, "value": "second"},
+				map[string]interface{}{"order": 0, "value": "first"},
+			},
+		},
+		RemoveHeaders: map[string]int{"x-remove": 0, "X-Once": -1},
+	}
+	f.rspamd.SetVerdict(v)
+	f.connect("198.51.100.1:1234")
+
+	message := []string{
+		"X-Remove: foo",
+		"\tbar",
+		"X-Once: 1",
+		"X-Once: 2",
+		"Subject: hello",
+		"",
+		"X-Remove: in the body",
+	}
+	_, out := f.deliver("sender@example.org", []string{"rcpt@example.net"}, message)
+
+	want := []string{
+		"X-Plain: plain",
+		"X-List: first",
+		"X-Ordered: ordered",
+		"X-List: second",
+		"X-Once: 1",
+		"Subject: hello",
+		"",
+		"X-Remove: in the body",
+	}
+	if !reflect.DeepEqual(out, want) {
+		t.Errorf("got %q, want %q", out, want)
+	}
+}
+
+func TestFilterHeaderInjection(t *testing.T) {
+	f := newFilterTest(t)
+	v := rspamdtest.Action("no action")
+	v.Milter = &rspamdtest.Milter{
+		AddHeaders: map[string]interface{}{
+			"X-Folded":           "one\n\ttwo",
+			"X-Injected":         "value\nBcc: victim@example.net",
+			"X-Blank":            "value\n\nbody",
+			"X-Name: x\nBcc":     "victim@example.net",
+			"X-Bad Name":         "value",
+			"X-Carriage-Returns": "one\r\n two",
+		},
+	}
+	f.rspamd.SetVerdict(v)
+	f.connect("198.51.100.1:1234")
+
+	_, out := f.deliver("sender@example.org", []string{"rcpt@example.net"}, testMessage)
+
+	headers, end := mailrewrite.Parse(out)
+	if end != len(out)-2 || !reflect.DeepEqual(out[end:], []string{"", "body"}) {
+		t.Fatalf("header block not ended where it should: %q", out)
+	}
+	for _, h := range headers {
+		if strings.EqualFold(h.Name, "Bcc") || h.Name == "" {
+			t.Errorf("header injected: %q", h.Lines)
+		}
+		for _, line := range h.Lines {
+			if strings.ContainsAny(line, "\r\n") {
+				t.Errorf("line break in a line: %q", line)
+			}
+		}
+	}
+	if i := mailrewrite.Find(headers, "X-Folded"); i < 0 || !reflect.DeepEqual(headers[i].Lines, []string{"X-Folded: one", "\ttwo"}) {
+		t.Errorf("folded header not kept as is: %q", out)
+	}
+}
+
+func TestFilterDKIMSignature(t *testing.T) {
+	f := newFilterTest(t)
+	v := rspamdtest.Action("no action")
+	v.DKIMSignature = []interface{}{
+		"v=1; a=rsa-sha256; c=relaxed/relaxed; d=example.org; s=sel; h=from:to:subject; bh=abc=; b=def=",
+		"v=1; a=ed25519-sha256; c=relaxed/relaxed; d=example.org; s=ed; h=from; bh=abc=; b=ghi=",
+	}
+	f.rspamd.SetVerdict(v)
+	f.connect("198.51.100.1:1234")
+
+	_, out := f.deliver("sender@example.org", []string{"rcpt@example.net"}, testMessage)
+
+	headers, _ := mailrewrite.Parse(out)
+	var signatures []string
+	for _, h := range headers {
+		if h.Name == "DKIM-Signature" {
+			signatures = append(signatures, h.Value())
+		}
+	}
+	if len(signatures) != 2 || !strings.HasSuffix(signatures[0], "b=def=") || !strings.HasSuffix(signatures[1], "b=ghi=") {
+		t.Errorf("signatures: got %q", signatures)
+	}
+	if !reflect.DeepEqual(out[len(out)-len(testMessage):], testMessage) {
+		t.Errorf("message changed: %q", out)
+	}
+}
+
+func TestFilterRewrittenBody(t *testing.T) {
+	setFlag(t, "rewrite-body", "true")
+	f := newFilterTest(t)
+	f.rspamd.SetMessage([]byte("Subject: ignored\r\n\r\nnew body\r\n.starts with a dot\r\n"))
+	f.connect("198.51.100.1:1234")
+
+	_, out := f.deliver("sender@example.org", []string{"rcpt@example.net"}, testMessage)
+
+	want := []string{
+		"From: sender@example.org",
+		"To: rcpt@example.net",
+		"Subject: hello",
+		"",
+		"new body",
+		"..starts with a dot",
+	}
+	if !reflect.DeepEqual(out, want) {
+		t.Errorf("got %q, want %q", out, want)
+	}
+}
+
+func TestFilterTempfail(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		verdict string
+	}{
+		{"server error", 500, `{"action":"no action"}`},
+		{"invalid JSON", 200, `{"action":`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setFlag(t, "retries", "0")
+			f := newFilterTest(t)
+			f.rspamd.SetStatus(test.status)
+			f.rspamd.SetRawVerdict([]byte(test.verdict))
+			f.connect("198.51.100.1:1234")
+
+			result, out := f.deliver("sender@example.org", []string{"rcpt@example.net"}, testMessage)
+			if result != "reject|421 4.3.0 server internal error" {
+				t.Errorf("result: got %q", result)
+			}
+			if !reflect.DeepEqual(out, testMessage) {
+				t.Errorf("message changed: %q", out)
+			}
+		})
+	}
+}
+
+func contains(lines []string, line string) bool {
+	for _, l := range lines {
+		if l == line {
+			return true
+		}
+	}
+	return false
+}
+
+func TestRequestHeaderValue(t *testing.T) {
+	tests := []struct {
+		value     string
+		sanitized string
+	}{
+		{"mail.example.org", "mail.example.org"},
+		{"Jérôme <jerome@example.org>", "Jérôme <jerome@example.org>"},
+		{"CafÃ© crÃ¨me", "CafÃ© crÃ¨me"},
+		{"caf\xe9 cr\xe8me", "caf? cr?me"},
+		{"\x93quoted\x94", "?quoted?"},
+		{"\x82\xb1\x82\xf1", "?"},
+		{"truncated caf\xc3", "truncated caf?"},
+		{"helo\r\nX-Injected: yes", "helo??X-Injected: yes"},
+		{"tab\tand nul\x00 and del\x7f", "tab\tand nul? and del?"},
+	}
+
+	for _, mode := range []string{"pass", "sanitize"} {
+		t.Run(mode, func(t *testing.T) {
+			setFlag(t, "header-8bit", mode)
+			for _, test := range tests {
+				want := test.value
+				if mode == "sanitize" {
+					want = test.sanitized
+				}
+				if value := requestHeaderValue(test.value); value != want {
+					t.Errorf("%q: got %q, want %q", test.value, value, want)
+				}
+			}
+		})
+	}
+}
+
+func TestFilterHeader8bit(t *testing.T) {
+	message := []string{
+		"From: =?iso-8859-1?q?J=E9r=F4me?= <jerome@example.org>",
+		"Subject: caf\xe9 cr\xe8me \x93quoted\x94",
+		"X-Mojibake: CafÃ© crÃ¨me",
+		"X-Shift-JIS: \x82\xb1\x82\xf1\x82\xc9\x82\xbf\x82\xcd",
+		"",
+		"caf\xe9 in the body is left alone",
+	}
+	// a run of invalid bytes becomes a single question mark, and some
+	// Shift_JIS pairs happen to be valid UTF-8
+	sanitized := []string{
+		"From: =?iso-8859-1?q?J=E9r=F4me?= <jerome@example.org>",
+		"Subject: caf? cr?me ?quoted?",
+		"X-Mojibake: CafÃ© crÃ¨me",
+		"X-Shift-JIS: ?\xc9\x82?",
+		"",
+		"caf\xe9 in the body is left alone",
+	}
+
+	tests := []struct {
+		mode string
+		want []string
+	}{
+		{"pass", message},
+		{"sanitize", sanitized},
+	}
+
+	for _, test := range tests {
+		t.Run(test.mode, func(t *testing.T) {
+			setFlag(t, "header-8bit", test.mode)
+			f := newFilterTest(t)
+			f.connect("198.51.100.1:1234")
+
+			result, out := f.deliver("j\xe9r\xf4me@example.org", []string{"rcpt@example.net"}, message)
+			if result != "proceed" {
+				t.Fatalf("result: got %q", result)
+			}
+			if !reflect.DeepEqual(out, test.want) {
+				t.Errorf("message: got %q, want %q", out, test.want)
+			}
+
+			request := f.rspamd.Requests()[0]
+			if body := string(request.Body); body != strings.Join(test.want, "\n") {
+				t.Errorf("scanned: got %q", body)
+			}
+			from := request.Header.Get("From")
+			if test.mode == "sanitize" && from != "j?r?me@example.org" {
+				t.Errorf("sender: got %q", from)
+			}
+			if test.mode == "pass" && from != "j\xe9r\xf4me@example.org" {
+				t.Errorf("sender: got %q", from)
+			}
+		})
+	}
+}
+
+func TestIsEmptyMessage(t *testing.T) {
+	tests := []struct {
+		name    string
+		message []string
+		empty   bool
+	}{
+		{"nothing", nil, true},
+		{"empty line", []string{""}, true},
+		{"headers only", []string{"From: a@example.org", "Subject: hi"}, true},
+		{"headers and separator", []string{"From: a@example.org", ""}, true},
+		{"blank body", []string{"From: a@example.org", "", "", " ", "\t"}, true},
+		{"body", []string{"From: a@example.org", "", "hello"}, false},
+		{"body only", []string{"", "hello"}, false},
+		{"body after blank lines", []string{"Subject: hi", "", "", "hello"}, false},
+		{"not a header", []string{"hello"}, true},
+	}
+
+	for _, test := range tests {
+		if empty := isEmptyMessage(test.message); empty != test.empty {
+			t.Errorf("%s: got %t, want %t", test.name, empty, test.empty)
+		}
+	}
+}
+
+func TestFilterEmptyMessage(t *testing.T) {
+	messages := map[string][]string{
+		"nothing":      nil,
+		"headers only": {"From: a@example.org", "Subject: probe"},
+		"blank body":   {"From: a@example.org", "", "  "},
+	}
+
+	tests := []struct {
+		policy  string
+		result  string
+		scanned bool
+	}{
+		{"scan", "proceed", true},
+		{"skip", "proceed", false},
+		{"reject", "reject|550 5.7.1 empty message", false},
+	}
+
+	for _, test := range tests {
+		for name, message := range messages {
+			t.Run(test.policy+"/"+name, func(t *testing.T) {
+				setFlag(t, "empty-message", test.policy)
+				f := newFilterTest(t)
+				f.connect("198.51.100.1:1234")
+
+				before := metricsSnapshot()["messages.empty"]
+				result, out := f.deliver("sender@example.org", []string{"rcpt@example.net"}, message)
+				if result != test.result {
+					t.Errorf("result: got %q, want %q", result, test.result)
+				}
+				if scanned := len(f.rspamd.Requests()) > 0; scanned != test.scanned {
+					t.Errorf("scanned: got %t, want %t", scanned, test.scanned)
+				}
+				if !test.scanned && !reflect.DeepEqual(out, message) {
+					t.Errorf("message: got %q, want %q", out, message)
+				}
+				if after := metricsSnapshot()["messages.empty"]; after != before+1 {
+					t.Errorf("messages.empty: got %d, want %d", after, before+1)
+				}
+			})
+		}
+	}
+
+	f := newFilterTest(t)
+	f.connect("198.51.100.1:1234")
+	before := metricsSnapshot()["messages.empty"]
+	f.deliver("sender@example.org", []string{"rcpt@example.net"}, testMessage)
+	if after := metricsSnapshot()["messages.empty"]; after != before {
+		t.Errorf("message with a body counted as empty")
+	}
+}
+
+func TestFilterReadOnly(t *testing.T) {
+	empty := []string{"From: a@example.org", "Subject: probe"}
+
+	tests := []struct {
+		name    string
+		flags   map[string]string
+		bypass  bool
+		message []string
+	}{
+		{"empty message", map[string]string{"empty-message": "skip"}, false, empty},
+		{"oversize message", map[string]string{"max-lines": "2", "oversize-message": "pass"}, false, testMessage},
+		{"bypassed recipient", nil, true, testMessage},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for name, value := range test.flags {
+				setFlag(t, name, value)
+			}
+			if test.bypass {
+				saved := rcptBypass
+				rcptBypass = map[string]bool{"rcpt@example.net": true}
+				t.Cleanup(func() { rcptBypass = saved })
+			}
+
+			for _, readOnly := range []bool{false, true} {
+				setFlag(t, "read-only", fmt.Sprint(readOnly))
+				f := newFilterTest(t)
+				f.connect("198.51.100.1:1234")
+
+				result, _ := f.deliver("sender@example.org", []string{"rcpt@example.net"}, test.message)
+				if readOnly && !strings.HasPrefix(result, "reject|421 ") {
+					t.Errorf("read-only: got %q, want a tempfail", result)
+				} else if !readOnly && result != "proceed" {
+					t.Errorf("got %q, want proceed", result)
+				}
+				if len(f.rspamd.Requests()) > 0 {
+					t.Errorf("message scanned")
+				}
+			}
+		})
+	}
+}
+
+func TestFilterDryRunVerdict(t *testing.T) {
+	savedCache, savedWebhook := verdicts, webhook
+	verdicts = newVerdictCache(10)
+	webhook = newWebhookNotifier("http://127.0.0.1:1", "secret")
+	t.Cleanup(func() {
+		verdicts, webhook = savedCache, savedWebhook
+		setDryRun(false)
+	})
+
+	for _, dry := range []bool{false, true} {
+		setDryRun(dry)
+		f := newFilterTest(t)
+		f.rspamd.SetVerdict(rspamdtest.Action("reject"))
+		f.connect("198.51.100.1:1234")
+
+		queued := len(webhook.events)
+		result, _ := f.deliver("sender@example.org", []string{"rcpt@example.net"}, testMessage)
+		v, ok := verdicts.get("00000001")
+		if !ok {
+			t.Fatalf("dry run %t: no verdict recorded", dry)
+		}
+		if v.Action != "reject" || v.DryRun != dry {
+			t.Errorf("dry run %t: got action %q, dry run %t", dry, v.Action, v.DryRun)
+		}
+
+		notified := len(webhook.events) > queued
+		if dry && (result != "proceed" || notified) {
+			t.Errorf("dry run: got %q, webhook notified %t", result, notified)
+		} else if !dry && !notified {
+			t.Errorf("webhook not notified of a reject")
+		}
+	}
+}
+
+func TestParseArgs(t *testing.T) {
+	tests := []struct {
+		args     []string
+		operands []string
+		from     string
+		rcpts    string
+	}{
+		{[]string{"message.eml"}, []string{"message.eml"}, "", ""},
+		{[]string{"-from", "a@b", "message.eml"}, []string{"message.eml"}, "a@b", ""},
+		{[]string{"message.eml", "--from", "a@b", "--rcpt", "c@d", "-rcpt", "e@f"}, []string{"message.eml"}, "a@b", "c@d e@f"},
+		{[]string{"-rcpt", "c@d", "-", "-from", "a@b"}, []string{"-"}, "a@b", "c@d"},
+		{[]string{"a.eml", "b.eml", "-from", "a@b"}, []string{"a.eml", "b.eml"}, "a@b", ""},
+		{[]string{"-from", "a@b", "--", "-rcpt"}, []string{"-rcpt"}, "a@b", ""},
+	}
+
+	for _, test := range tests {
+		var rcpts listFlag
+		fs := flag.NewFlagSet("scan", flag.ContinueOnError)
+		from := fs.String("from", "", "")
+		fs.Var(&rcpts, "rcpt", "")
+
+		operands, err := parseArgs(fs, test.args)
+		if err != nil {
+			t.Errorf("%q: %s", test.args, err)
+			continue
+		}
+		if !reflect.DeepEqual(operands, test.operands) || *from != test.from || rcpts.String() != test.rcpts {
+			t.Errorf("%q: got %q, from %q, rcpts %q", test.args, operands, *from, rcpts.String())
+		}
+	}
+}
+
+func TestLocalSource(t *testing.T) {
+	local := "unix:/var/run/smtpd.sock"
+	if ip := clientIP(local); ip != "" {
+		t.Errorf("clientIP: got %q for a local source", ip)
+	}
+	if ip := requestIP(local); ip != "127.0.0.1" {
+		t.Errorf("requestIP: got %q for a local source", ip)
+	}
+	if env := newRuleEnv(&session{src: local}, &rspamd{}); env.ip != "127.0.0.1" {
+		t.Errorf("rules: got ip %q for a local source", env.ip)
+	}
+	if !isTrusted(&session{src: local}) {
+		t.Errorf("local source not trusted")
+	}
+
+	saved := limiter
+	limiter = newRateLimiter(1, time.Hour)
+	t.Cleanup(func() { limiter = saved })
+	outputChannel = make(chan string, 16)
+
+	for _, src := range []string{local, "198.51.100.1:1234"} {
+		s := &session{id: "0000000000000001", src: src}
+		results := []string{}
+		for i := 0; i < 2; i++ {
+			mailFrom(s, []string{"0000000000000001", "sender@example.org"})
+			result := <-outputChannel
+			results = append(results, result[strings.LastIndexByte(result, '|')+1:])
+		}
+		limited := results[1] != "proceed"
+		if limited != (src != local) {
+			t.Errorf("%s: got %q", src, results)
+		}
+	}
+}
+
+func TestTarpit(t *testing.T) {
+	setFlag(t, "tarpit-delay", "300ms")
+	setFlag(t, "tarpit-max-delay", "300ms")
+	setFlag(t, "tarpit-rejects", "1")
+	setFlag(t, "tarpit-window", "1m")
+
+	saved := store
+	t.Cleanup(func() { store = saved })
+
+	// the commands which scan messages run without a storage
+	store = nil
+	f := newFilterTest(t)
+	f.rspamd.SetVerdict(rspamdtest.Action("reject"))
+	f.connect("198.51.100.1:1234")
+	for i := 0; i < 2; i++ {
+		if result, _ := f.deliver("sender@example.org", []string{"rcpt@example.net"}, testMessage); result != "reject|550 5.7.1 message rejected" {
+			t.Fatalf("result: got %q", result)
+		}
+	}
+
+	store = newMemoryStorage()
+	countReject("198.51.100.1")
+	deadline := time.Now().Add(10 * time.Second)
+	for tarpitStrikes("198.51.100.1", 0) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("reject not counted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	start := time.Now()
+	f.deliver("sender@example.org", []string{"rcpt@example.net"}, testMessage)
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond {
+		t.Errorf("result not delayed: %s", elapsed)
+	}
+}
+
+func TestSteadyPromisesResolver(t *testing.T) {
+	newFilterTest(t)
+
+	for _, test := range []struct {
+		resolver string
+		rpath    bool
+	}{
+		{"192.0.2.53", false},
+		{"/var/unbound/etc/resolv.conf", true},
+	} {
+		setFlag(t, "resolver", test.resolver)
+		promises := strings.Fields(steadyPromises())
+		if contains(promises, "rpath") != test.rpath {
+			t.Errorf("-resolver %s: got promises %q", test.resolver, promises)
+		}
+	}
+}
+
+func TestVerdictCacheSave(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "verdicts.json")
+
+	c := newVerdictCache(10)
+	c.add(verdict{QueueId: "0000000a", Action: "reject"})
+
+	// a failed save is tried again
+	if err := c.save(filepath.Join(dir, "missing", "verdicts.json")); err == nil {
+		t.Fatal("saved to a missing directory")
+	}
+	if err := c.save(path); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := newVerdictCache(10)
+	if err := loaded.load(path); err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := loaded.get("0000000a"); !ok || v.Action != "reject" {
+		t.Errorf("got %+v, %t", v, ok)
+	}
+
+	if err := ioutil.WriteFile(path, []byte(`{"version":2,"verdicts":[]}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := newVerdictCache(10).load(path); err == nil {
+		t.Error("verdicts of a later version loaded")
+	}
+}
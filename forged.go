@@ -0,0 +1,117 @@
+//
+// Copyright (c) 2019 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/poolpOrg/filter-rspamd/mailrewrite"
+)
+
+// Senders could pass their spam for ham by adding the headers of the
+// filter themselves, or Authentication-Results of our own.  With
+// -strip-forged, these are removed from the messages of clients outside
+// the -trusted-networks.
+
+var trustedNetworks []*net.IPNet
+
+// parseNetworks parses a comma-separated list of addresses and CIDR
+// networks.
+func parseNetworks(list string) ([]*net.IPNet, error) {
+	networks := []*net.IPNet{}
+	for _, network := range strings.Split(list, ",") {
+		network = strings.TrimSpace(network)
+		if network == "" {
+			continue
+		}
+		if !strings.Contains(network, "/") {
+			if ip := net.ParseIP(network); ip != nil && ip.To4() != nil {
+				network += "/32"
+			} else {
+				network += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(network)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network: %s", network)
+		}
+		networks = append(networks, n)
+	}
+	return networks, nil
+}
+
+// isTrusted returns whether the client of a session is trusted with the
+// headers of the filter: the local enqueuer always is.
+func isTrusted(s *session) bool {
+	if isLocal(s.src) {
+		return true
+	}
+	ip := net.ParseIP(clientIP(s.src))
+	for _, n := range trustedNetworks {
+		if ip != nil && n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// forgedHeader returns a function telling whether a header of the message
+// of a session is one the client may not add: those of the filter, and the
+// Authentication-Results of our own authserv-id.
+func forgedHeader(s *session) func(h mailrewrite.Header) bool {
+	authservID := authservID(s)
+	return func(h mailrewrite.Header) bool {
+		name := strings.ToLower(h.Name)
+		if strings.HasPrefix(name, "x-spam") {
+			return true
+		}
+		for _, renamed := range headerNames {
+			if renamed != "" && strings.EqualFold(h.Name, renamed) {
+				return true
+			}
+		}
+		return name == "authentication-results" && authservID != "" &&
+			strings.EqualFold(resultsAuthservID(h.Value()), authservID)
+	}
+}
+
+// authservID returns the authserv-id of the Authentication-Results of the
+// MTA: the -authserv-id if any, its host name otherwise.
+func authservID(s *session) string {
+	if *authservIDFlag != "" {
+		return *authservIDFlag
+	}
+	return s.mtaName
+}
+
+// resultsAuthservID returns the authserv-id of an Authentication-Results
+// header value, without its version or comments.
+func resultsAuthservID(value string) string {
+	if i := strings.IndexByte(value, ';'); i >= 0 {
+		value = value[:i]
+	}
+	if i := strings.IndexByte(value, '('); i >= 0 {
+		value = value[:i]
+	}
+	fields := strings.Fields(value)
+	if len(fields) == 0 {
+		return ""
+	}
+	return fields[0]
+}
@@ -0,0 +1,99 @@
+//
+// Copyright (c) 2019 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/poolpOrg/filter-rspamd/internal/rspamdtest"
+	"github.com/poolpOrg/filter-rspamd/mailrewrite"
+)
+
+// FuzzFilter runs arbitrary messages through the filter, scanned with
+// arbitrary verdicts, and checks that what is handed back to smtpd is
+// valid whatever the verdict, and the message itself when rspamd asks
+// for no change.
+func FuzzFilter(f *testing.F) {
+	message := strings.Join(testMessage, "\n")
+	for _, action := range []string{"no action", "greylist", "add header", "rewrite subject", "soft reject", "reject", "discard"} {
+		v := rspamdtest.Action(action)
+		v.Subject = "*** SPAM *** hello"
+		data, _ := json.Marshal(v)
+		f.Add(message, data)
+	}
+	f.Add("Subject: dots\n\n.\n..\n.x", []byte(`{"action":"add header","score":6,"required_score":15,"milter":{"add_headers":{"X-A":"one\ntwo","X-B":[{"value":"b","order":1}]},"remove_headers":{"subject":-1}}}`))
+	f.Add("X-Spam: forged\n\tfolded\n\nbody", []byte(`{"action":"no action","dkim-signature":["v=1; c=relaxed/relaxed; b=AAAA","v=1; c=simple/simple; b=BBBB"]}`))
+	f.Add("From: a\n\nbody", []byte(`{"action":"no action","milter":{"add_headers":{"X-Injected":"value\nBcc: victim@example.net","X-Blank":"a\n\nb"}}}`))
+	f.Add("", []byte(`{"action":"rewrite subject","subject":"café\r\nBcc: x"}`))
+
+	f.Fuzz(func(t *testing.T, message string, verdict []byte) {
+		var lines []string
+		for _, line := range strings.Split(message, "\n") {
+			lines = append(lines, mailrewrite.Stuff(line))
+		}
+
+		ft := newFilterTest(t)
+		ft.connect("198.51.100.1:1234")
+
+		ft.rspamd.SetRawVerdict(verdict)
+		result, out := ft.deliver("sender@example.org", []string{"rcpt@example.net"}, lines)
+
+		switch {
+		case result == "proceed":
+		case strings.HasPrefix(result, "reject|"), strings.HasPrefix(result, "disconnect|"):
+		default:
+			t.Fatalf("invalid result: %q", result)
+		}
+		for _, line := range append(out, result) {
+			if strings.ContainsAny(line, "\n") {
+				t.Fatalf("line break in an output line: %q", line)
+			}
+		}
+
+		// the lines of the message after its header block, and the
+		// header block itself, must end where they did
+		_, end := mailrewrite.Parse(unstuff(lines))
+		_, outEnd := mailrewrite.Parse(unstuff(out))
+		body := lines[end:]
+		if len(out) < len(body) || !reflect.DeepEqual(out[len(out)-len(body):], body) ||
+			len(out)-outEnd != len(body) {
+			t.Fatalf("body or header block end changed: got %q, want %q", out, lines)
+		}
+		for _, line := range out {
+			if strings.HasPrefix(line, ".") && !strings.HasPrefix(line, "..") {
+				t.Fatalf("line not dot-stuffed: %q", line)
+			}
+		}
+
+		// no change asked for: the message is handed back as is
+		ft.rspamd.SetVerdict(rspamdtest.Action("no action"))
+		if _, out := ft.deliver("sender@example.org", []string{"rcpt@example.net"}, lines); !reflect.DeepEqual(out, lines) {
+			t.Fatalf("pass-through: got %q, want %q", out, lines)
+		}
+	})
+}
+
+func unstuff(lines []string) []string {
+	out := make([]string, len(lines))
+	for i, line := range lines {
+		out[i] = mailrewrite.Unstuff(line)
+	}
+	return out
+}
@@ -0,0 +1,52 @@
+//
+// Copyright (c) 2019 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// greylistDelay returns the time left before a message greylisted by
+// rspamd is accepted, which the greylist module reports as an option of
+// its symbol, or -retry-after, along with whether the message was
+// greylisted at all.
+func greylistDelay(rr *rspamd) (time.Duration, bool) {
+	symbol, ok := rr.Symbols["GREYLIST"]
+	if !ok {
+		return *retryAfter, false
+	}
+	for _, option := range symbol.Options {
+		if end, err := http.ParseTime(option); err == nil {
+			if delay := time.Until(end); delay > time.Second {
+				return delay, true
+			}
+			return time.Second, true
+		}
+	}
+	return *retryAfter, true
+}
+
+// retryHint returns the hint given with soft rejects of when to retry.
+func retryHint(delay time.Duration) string {
+	seconds := int64((delay + time.Second - 1) / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	return fmt.Sprintf("retry after %d seconds", seconds)
+}
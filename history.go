@@ -0,0 +1,130 @@
+//
+// Copyright (c) 2019 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// historyPrefix is the prefix of the keys of the verdicts kept in the
+// storage, which are followed by the time of the verdict, so that they sort
+// in order, and the queue id of the message.
+const historyPrefix = "history:"
+
+func historyKey(v verdict) string {
+	return fmt.Sprintf("%s%020d:%s", historyPrefix, v.Time.UnixNano(), v.QueueId)
+}
+
+// keepHistory keeps a verdict in the storage for the -history-retention.
+func keepHistory(v verdict) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return store.Set(historyKey(v), string(data), *historyRetention)
+}
+
+// historyCommand lists the verdicts kept in the storage, oldest first, or
+// shows those of a queue id in full.
+func historyCommand(args []string) error {
+	fs := flag.NewFlagSet("history", flag.ContinueOnError)
+	since := fs.Duration("since", 0, "only list the verdicts of the last duration")
+	action := fs.String("action", "", "only list the verdicts with this action")
+	address := fs.String("address", "", "only list the verdicts with this sender or recipient")
+	operands, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(operands) > 1 {
+		return fmt.Errorf("usage: history [-since duration] [-action action] [-address address] [queue-id]")
+	}
+	if *storageSpec == "memory" {
+		return fmt.Errorf("no history in memory storage")
+	}
+
+	// the history is only read
+	st, err := openStorage(*storageSpec, true)
+	if err != nil {
+		return err
+	}
+
+	var after time.Time
+	if *since > 0 {
+		after = time.Now().Add(-*since)
+	}
+
+	// the keys sort by time, but not every storage scans them in order
+	var keys []string
+	values := make(map[string]string)
+	err = st.Scan(historyPrefix, func(key string, value string) bool {
+		keys = append(keys, key)
+		values[key] = value
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		var v verdict
+		if err := json.Unmarshal([]byte(values[key]), &v); err != nil {
+			return fmt.Errorf("%s: %s", key, err)
+		}
+
+		switch {
+		case v.Time.Before(after):
+		case *action != "" && v.Action != *action:
+		case *address != "" && !verdictAddress(v, *address):
+		case len(operands) == 1 && v.QueueId != operands[0]:
+		case len(operands) == 1:
+			out, err := json.MarshalIndent(v, "", "  ")
+			if err != nil {
+				return err
+			}
+			fmt.Printf("%s\n", out)
+		default:
+			action := v.Action
+			if v.DryRun {
+				action += " (dry run)"
+			}
+			fmt.Printf("%s\t%s\t%s\t%.2f/%.2f\t%s\t%s\n", v.QueueId,
+				v.Time.Format(time.RFC3339), action, v.Score,
+				v.Required, v.From, strings.Join(v.Rcpts, ","))
+		}
+	}
+	return nil
+}
+
+// verdictAddress returns whether address is the sender or one of the
+// recipients of a verdict.
+func verdictAddress(v verdict, address string) bool {
+	if strings.EqualFold(v.From, address) {
+		return true
+	}
+	for _, rcpt := range v.Rcpts {
+		if strings.EqualFold(rcpt, address) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,180 @@
+//
+// Copyright (c) 2019 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+// Package rspamdtest provides a fake rspamd for tests: an HTTP server
+// which answers scans with a verdict set by the test, and records the
+// requests it receives.
+package rspamdtest
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+)
+
+// Verdict is the answer of rspamd to a scan, in the format of /checkv2.
+type Verdict struct {
+	Action        string            `json:"action"`
+	Score         float64           `json:"score"`
+	RequiredScore float64           `json:"required_score"`
+	Subject       string            `json:"subject,omitempty"`
+	Messages      map[string]string `json:"messages,omitempty"`
+	DKIMSignature interface{}       `json:"dkim-signature,omitempty"`
+	Milter        *Milter           `json:"milter,omitempty"`
+	Symbols       map[string]Symbol `json:"symbols,omitempty"`
+}
+
+// Milter is the milter block of a verdict, which lists the changes rspamd
+// asks for.  The values of AddHeaders are either a string, an object with
+// a value and an order, or a list of those.
+type Milter struct {
+	AddHeaders    map[string]interface{} `json:"add_headers,omitempty"`
+	RemoveHeaders map[string]int         `json:"remove_headers,omitempty"`
+	ChangeFrom    string                 `json:"change_from,omitempty"`
+}
+
+// Symbol is a symbol matched by a scan.
+type Symbol struct {
+	Score       float64  `json:"score"`
+	Description string   `json:"description,omitempty"`
+	Options     []string `json:"options,omitempty"`
+}
+
+// RequiredScore is the score of the reject action of the verdicts made
+// by Action.
+const RequiredScore = 15
+
+// Action returns a verdict with action, and a score which matches it.
+func Action(action string) Verdict {
+	scores := map[string]float64{
+		"no action":       0.5,
+		"greylist":        4,
+		"add header":      6,
+		"rewrite subject": 8,
+		"soft reject":     10,
+		"reject":          16.5,
+		"discard":         20,
+	}
+	return Verdict{
+		Action:        action,
+		Score:         scores[action],
+		RequiredScore: RequiredScore,
+		Symbols: map[string]Symbol{
+			"TEST_SYMBOL": {Score: scores[action], Description: "test symbol"},
+		},
+	}
+}
+
+// Request is a request received by the server.
+type Request struct {
+	Path   string
+	Header http.Header
+	Body   []byte
+}
+
+// Server is a fake rspamd.  Scans are answered with the verdict set with
+// SetVerdict, followed by the message set with SetMessage if any, and
+// the controller endpoints used to learn messages always succeed.
+type Server struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	verdict  []byte
+	message  []byte
+	status   int
+	requests []Request
+}
+
+// NewServer starts a server answering no action to every scan.  It must
+// be closed once done with.
+func NewServer() *Server {
+	s := &Server{status: http.StatusOK}
+	s.SetVerdict(Action("no action"))
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// SetVerdict sets the verdict answered to the following scans.
+func (s *Server) SetVerdict(v Verdict) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	s.SetRawVerdict(data)
+}
+
+// SetRawVerdict sets the verdict answered to the following scans, as is.
+func (s *Server) SetRawVerdict(data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.verdict = data
+}
+
+// SetMessage sets the message rewritten by rspamd which follows the
+// verdict, as with the body_block flag, or none if message is nil.
+func (s *Server) SetMessage(message []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.message = message
+}
+
+// SetStatus sets the HTTP status of the answers to the following scans.
+func (s *Server) SetStatus(status int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status = status
+}
+
+// Requests returns the requests received so far.
+func (s *Server) Requests() []Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Request(nil), s.requests...)
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	s.requests = append(s.requests, Request{Path: r.URL.Path, Header: r.Header.Clone(), Body: body})
+	verdict, message, status := s.verdict, s.message, s.status
+	s.mu.Unlock()
+
+	switch r.URL.Path {
+	case "/ping":
+		w.Write([]byte("pong\r\n"))
+	case "/checkv2":
+		w.Header().Set("Content-Type", "application/json")
+		if message != nil {
+			w.Header().Set("Message-Offset", strconv.Itoa(len(verdict)))
+		}
+		w.WriteHeader(status)
+		w.Write(verdict)
+		w.Write(message)
+	case "/learnspam", "/learnham", "/fuzzyadd":
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"success":true}`))
+	default:
+		http.NotFound(w, r)
+	}
+}
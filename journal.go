@@ -0,0 +1,109 @@
+//
+// Copyright (c) 2019 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// The journal is an append-only file of verdicts, one JSON object per
+// line.  Once it grows over maxSize, or has been written to for longer
+// than maxAge, it is rotated: renamed with a .1 suffix, the previous ones
+// being shifted up to journalRotations, past which they are removed.
+type verdictJournal struct {
+	sync.Mutex
+	path    string
+	maxSize int64
+	maxAge  time.Duration
+
+	file   *os.File
+	size   int64
+	opened time.Time
+}
+
+const journalRotations = 5
+
+var journal *verdictJournal
+
+func openJournal(path string, maxSize int64, maxAge time.Duration) (*verdictJournal, error) {
+	j := &verdictJournal{path: path, maxSize: maxSize, maxAge: maxAge}
+	if err := j.open(); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+func (j *verdictJournal) open() error {
+	f, err := os.OpenFile(j.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	j.file, j.size, j.opened = f, info.Size(), time.Now()
+	return nil
+}
+
+// write appends a verdict to the journal, rotating it first if needed.
+func (j *verdictJournal) write(v verdict) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	j.Lock()
+	defer j.Unlock()
+
+	// a failed rotation leaves the journal closed
+	if j.file == nil {
+		if err := j.open(); err != nil {
+			return err
+		}
+	}
+
+	if j.size > 0 && ((j.maxSize > 0 && j.size+int64(len(data)) > j.maxSize) ||
+		(j.maxAge > 0 && time.Since(j.opened) > j.maxAge)) {
+		if err := j.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := j.file.Write(data)
+	j.size += int64(n)
+	return err
+}
+
+func (j *verdictJournal) rotate() error {
+	j.file.Close()
+	j.file = nil
+
+	for i := journalRotations - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", j.path, i), fmt.Sprintf("%s.%d", j.path, i+1))
+	}
+	if err := os.Rename(j.path, j.path+".1"); err != nil {
+		return err
+	}
+	return j.open()
+}
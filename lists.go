@@ -0,0 +1,89 @@
+//
+// Copyright (c) 2019 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package main
+
+import (
+	"bufio"
+	"os"
+	"strings"
+)
+
+// loadList reads a list file: one entry per line, with blank lines and
+// comments starting with # ignored.  Entries are lowercased.
+func loadList(path string) (map[string]bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	list := make(map[string]bool)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.ToLower(strings.TrimSpace(line))
+		if line != "" {
+			list[line] = true
+		}
+	}
+	return list, scanner.Err()
+}
+
+// matchAddress returns whether an address is in a list, either as is or
+// through an @domain entry.
+func matchAddress(list map[string]bool, address string) bool {
+	address = strings.ToLower(address)
+	if list[address] {
+		return true
+	}
+	if i := strings.LastIndexByte(address, '@'); i >= 0 {
+		return list[address[i:]]
+	}
+	return false
+}
+
+// canonicalAddress returns address with its domain lowercased and without
+// its +extension, so that the variants of an address are told apart from
+// other addresses only.
+func canonicalAddress(address string) string {
+	local, domain := address, ""
+	if i := strings.LastIndexByte(address, '@'); i >= 0 {
+		local, domain = address[:i], strings.ToLower(address[i:])
+	}
+	if i := strings.IndexByte(local, '+'); i > 0 {
+		local = local[:i]
+	}
+	return local + domain
+}
+
+// canonicalAddresses returns the canonical forms of addresses, without
+// duplicates.
+func canonicalAddresses(addresses []string) []string {
+	seen := make(map[string]bool, len(addresses))
+	canonical := make([]string, 0, len(addresses))
+	for _, address := range addresses {
+		address = canonicalAddress(address)
+		if !seen[address] {
+			seen[address] = true
+			canonical = append(canonical, address)
+		}
+	}
+	return canonical
+}
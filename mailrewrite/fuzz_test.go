@@ -0,0 +1,151 @@
+//
+// Copyright (c) 2019 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package mailrewrite
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// checkStuffing fails the test if a line is not valid dot-stuffed SMTP
+// data: a lone dot would end the message early, and line breaks would
+// split the line in two.
+func checkStuffing(t *testing.T, lines []string) {
+	for _, line := range lines {
+		if strings.ContainsAny(line, "\n") {
+			t.Fatalf("line break in a line: %q", line)
+		}
+		if strings.HasPrefix(line, ".") && !strings.HasPrefix(line, "..") {
+			t.Fatalf("line not dot-stuffed: %q", line)
+		}
+	}
+}
+
+// stuffed returns the lines of message as smtpd hands them over.
+func stuffed(message string) []string {
+	var lines []string
+	for _, line := range strings.Split(message, "\n") {
+		lines = append(lines, Stuff(line))
+	}
+	return lines
+}
+
+func FuzzWrite(f *testing.F) {
+	f.Add("From: a@example.org\nSubject: hello\n\nbody", "X-Spam", "yes", "Subject", 0, "new body")
+	f.Add("X-Spam: a\n\tfolded\nx-spam: b\n\n.\n..", "X-Test", "one\ntwo", "X-SPAM", -1, "")
+	f.Add(" stray\nFrom a\n:\n\n", "DKIM-Signature", "v=1; c=relaxed; b=AAAA", "From", 1, ".")
+	f.Add("Subject: caf\xe9\r\n\r\n\x0c", "X-Long", strings.Repeat("word ", 40), "", 2, "\n.\n")
+
+	f.Fuzz(func(t *testing.T, message string, name string, value string, remove string, index int, body string) {
+		// names are checked by the callers
+		if !validName(name) {
+			name = "X-Fuzz"
+		}
+		lines := stuffed(message)
+
+		// nothing to change: the message is written back as is
+		out := write(newMessage(lines), Edit{})
+		if !reflect.DeepEqual(out, lines) {
+			t.Fatalf("pass-through: got %q, want %q", out, lines)
+		}
+
+		m := newMessage(lines)
+		e := Edit{
+			Add:    []Field{{Name: name, Value: value}},
+			Remove: map[string]int{remove: index},
+			Subject: func(h *Header) []Field {
+				return []Field{{Name: "Subject", Value: value}}
+			},
+		}
+		if body != "" {
+			e.Body = strings.Split(body, "\n")
+		}
+		out = write(m, e)
+		checkStuffing(t, out)
+
+		// the value of a field never spans more than the field
+		added := Fold(name, value)
+		if len(out) < len(added) || !reflect.DeepEqual(out[:len(added)], stuffedLines(added)) {
+			t.Fatalf("added field not written first: %q", out)
+		}
+		headers, end := Parse(added)
+		if len(headers) != 1 || end != len(added) || headers[0].Name != name {
+			t.Fatalf("field %q: %q split into %q", name, value, added)
+		}
+
+		// the body is left alone unless replaced
+		if e.Body == nil && m.parser.Done {
+			rest := lines[m.HeaderEnd():]
+			if len(out) < len(rest) || !reflect.DeepEqual(out[len(out)-len(rest):], rest) {
+				t.Fatalf("body changed: got %q, want %q", out, rest)
+			}
+		}
+	})
+}
+
+// validName returns whether name is a valid RFC 5322 field name.
+func validName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		if name[i] < 33 || name[i] > 126 || name[i] == ':' {
+			return false
+		}
+	}
+	return true
+}
+
+func stuffedLines(lines []string) []string {
+	out := make([]string, len(lines))
+	for i, line := range lines {
+		out[i] = Stuff(line)
+	}
+	return out
+}
+
+func FuzzParser(f *testing.F) {
+	f.Add("From: a@example.org\nSubject: hello\n world\n\nbody", 0, 0)
+	f.Add(" stray\nA: 1\nB: 2\n more\n", 2, 0)
+	f.Add("A: 1\nB: 0123456789\n", 0, 10)
+
+	f.Fuzz(func(t *testing.T, message string, maxLines int, maxLength int) {
+		lines := strings.Split(message, "\n")
+		p := Parser{MaxLines: maxLines, MaxLineLength: maxLength}
+		for _, line := range lines {
+			if !p.Feed(line) {
+				break
+			}
+		}
+
+		// headers cover the lines of the header block, in order
+		next := 0
+		for _, h := range p.Headers {
+			if h.Start != next || len(h.Lines) == 0 {
+				t.Fatalf("header %q at %d, expected at %d", h.Lines, h.Start, next)
+			}
+			if !reflect.DeepEqual(h.Lines, lines[h.Start:h.End()]) {
+				t.Fatalf("header %q does not match its lines", h.Lines)
+			}
+			next = h.End()
+		}
+		if next != p.End() {
+			t.Fatalf("headers end at %d, header block at %d", next, p.End())
+		}
+	})
+}
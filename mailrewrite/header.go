@@ -0,0 +1,342 @@
+//
+// Copyright (c) 2019 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+// Package mailrewrite parses the header block of messages received over
+// SMTP and writes them back with headers added, removed or rewritten,
+// leaving every other line untouched byte for byte.
+package mailrewrite
+
+import (
+	"mime"
+	"strings"
+	"unicode/utf8"
+)
+
+// Header is a header field of a message: its first line and any
+// continuation line folded after it. Start is the index of its first
+// line in the message.
+type Header struct {
+	Name  string
+	Lines []string
+	Start int
+}
+
+// Value returns the unfolded value of the header, as found after the
+// colon, with leading whitespace removed.
+func (h Header) Value() string {
+	raw := strings.Join(h.Lines, "")
+	if colon := strings.IndexByte(raw, ':'); colon >= 0 {
+		raw = raw[colon+1:]
+	}
+	return strings.TrimLeft(raw, " \t")
+}
+
+// RawValue returns the value of the header as found after the colon,
+// with leading whitespace removed but its folding preserved.
+func (h Header) RawValue() string {
+	raw := strings.Join(h.Lines, "\n")
+	if colon := strings.IndexByte(raw, ':'); colon >= 0 {
+		raw = raw[colon+1:]
+	}
+	return strings.TrimLeft(raw, " \t")
+}
+
+// End returns the index following the last line of the header in the
+// message.
+func (h Header) End() int {
+	return h.Start + len(h.Lines)
+}
+
+// Parser parses the header block of a message as it is received,
+// one line at a time.
+//
+// Lines which are neither a field nor a continuation, including
+// continuation lines found before any field, are kept as fields with an
+// empty name so that they pass through untouched.
+//
+// Parsing stops, and Truncated is set, at the first line beyond MaxLines
+// or longer than MaxLineLength, when set: the rest of the header block is
+// then left alone like the body.
+type Parser struct {
+	Headers []Header
+	Lines   int
+	Done    bool
+
+	MaxLines      int
+	MaxLineLength int
+	Truncated     bool
+}
+
+// Feed passes the next line of the message to the parser, and returns
+// false once the header block is over.
+func (p *Parser) Feed(line string) bool {
+	if p.Done {
+		return false
+	}
+	if line == "" {
+		p.Done = true
+		return false
+	}
+	if (p.MaxLines > 0 && p.Lines >= p.MaxLines) || (p.MaxLineLength > 0 && len(line) > p.MaxLineLength) {
+		// a field cut short is left alone along with the rest
+		if (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) && len(p.Headers) > 0 {
+			p.Lines = p.Headers[len(p.Headers)-1].Start
+			p.Headers = p.Headers[:len(p.Headers)-1]
+		}
+		p.Done, p.Truncated = true, true
+		return false
+	}
+
+	index := p.Lines
+	p.Lines++
+
+	if strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t") {
+		if len(p.Headers) > 0 {
+			h := &p.Headers[len(p.Headers)-1]
+			h.Lines = append(h.Lines, line)
+			return true
+		}
+	}
+
+	name := ""
+	if colon := strings.IndexByte(line, ':'); colon > 0 {
+		name = strings.TrimRight(line[:colon], " \t")
+		if strings.ContainsAny(name, " \t") {
+			name = ""
+		}
+	}
+	p.Headers = append(p.Headers, Header{Name: name, Lines: []string{line}, Start: index})
+	return true
+}
+
+// End returns the index of the line which ends the header block: the
+// empty line separating it from the body, or the number of lines fed so
+// far if there is none.
+func (p *Parser) End() int {
+	return p.Lines
+}
+
+// Parse splits the header block of message into header fields,
+// and returns them along with the index of the line which ends it.
+func Parse(message []string) ([]Header, int) {
+	p := Parser{}
+	for _, line := range message {
+		if !p.Feed(line) {
+			break
+		}
+	}
+	return p.Headers, p.End()
+}
+
+// Find returns the index of the first header named name, compared
+// case-insensitively, or -1 if there is none.
+func Find(headers []Header, name string) int {
+	for i, h := range headers {
+		if h.Name != "" && strings.EqualFold(h.Name, name) {
+			return i
+		}
+	}
+	return -1
+}
+
+// Remove drops the headers listed in remove, which maps a header
+// name to the occurrence to remove, as in the rspamd milter block: 0 for
+// every occurrence, n for the nth one, -n for the nth one from the end.
+// Names are compared case-insensitively.
+func Remove(headers []Header, remove map[string]int) []Header {
+	if len(remove) == 0 {
+		return headers
+	}
+
+	indexes := make(map[string]int, len(remove))
+	for name, index := range remove {
+		indexes[strings.ToLower(name)] = index
+	}
+
+	counts := make(map[string]int)
+	for _, h := range headers {
+		counts[strings.ToLower(h.Name)]++
+	}
+
+	kept := make([]Header, 0, len(headers))
+	seen := make(map[string]int)
+	for _, h := range headers {
+		name := strings.ToLower(h.Name)
+		seen[name]++
+
+		index, ok := indexes[name]
+		if !ok || h.Name == "" {
+			kept = append(kept, h)
+			continue
+		}
+
+		nth := seen[name]
+		switch {
+		case index == 0:
+		case index > 0 && nth == index:
+		case index < 0 && nth == counts[name]+index+1:
+		default:
+			kept = append(kept, h)
+		}
+	}
+	return kept
+}
+
+// EncodeValue returns value as is if it is made of printable ASCII
+// only, or as RFC 2047 encoded-words otherwise: quoted-printable ones if
+// the value is mostly ASCII, base64 ones if not.
+func EncodeValue(value string) string {
+	encoded := 0
+	for i := 0; i < len(value); i++ {
+		if value[i] >= utf8.RuneSelf || (value[i] < ' ' && value[i] != '\t') {
+			encoded++
+		}
+	}
+
+	switch {
+	case encoded == 0:
+		return value
+	case encoded*3 < len(value):
+		return mime.QEncoding.Encode("utf-8", value)
+	default:
+		return mime.BEncoding.Encode("utf-8", value)
+	}
+}
+
+// signatureHeaders are the headers whose own signature does not cover the
+// value of their b= tag, which may then be folded anywhere.
+var signatureHeaders = map[string]bool{
+	"dkim-signature": true,
+	"arc-seal":       true,
+}
+
+// Fold returns the lines of the header name once folded to 78
+// characters. Folding only ever inserts line breaks before existing
+// whitespace, which relaxed canonicalization ignores, and inside the b=
+// tag of signatures, which they do not cover, so that signatures remain
+// valid.
+//
+// Lines of the value which do not start with whitespace would be taken
+// for other headers, and empty ones for the end of the header block:
+// the former are indented, the latter dropped.
+func Fold(name string, value string) []string {
+	value = strings.Replace(value, "\r", "", -1)
+	if signatureHeaders[strings.ToLower(name)] {
+		value = foldSignature(value)
+	}
+
+	lines := []string{}
+	for n, line := range strings.Split(value, "\n") {
+		switch {
+		case n == 0:
+		case strings.TrimLeft(line, " \t") == "":
+			continue
+		case line[0] != ' ' && line[0] != '\t':
+			line = "\t" + line
+		}
+		lines = append(lines, line)
+	}
+	lines[0] = name + ": " + lines[0]
+
+	if !relaxedHeader(name, value) {
+		return lines
+	}
+
+	folded := make([]string, 0, len(lines))
+	for n, line := range lines {
+		// never fold between the name of the header and its value
+		min := 1
+		if n == 0 {
+			min = len(name) + len(": ")
+		}
+		for len(line) > 78 {
+			i := foldPosition(line, min)
+			min = 1
+			if i < 0 {
+				break
+			}
+			folded = append(folded, line[:i])
+			line = line[i:]
+		}
+		folded = append(folded, line)
+	}
+	return folded
+}
+
+// foldPosition returns the index of the whitespace before which line
+// should be folded: the last one within 78 characters, or the first one
+// after that, provided the line does not end up made of whitespace only.
+// Positions before min are not considered.
+func foldPosition(line string, min int) int {
+	first := -1
+	for i := min; i < len(line); i++ {
+		if line[i] != ' ' && line[i] != '\t' {
+			continue
+		}
+		if strings.TrimSpace(line[:i]) == "" {
+			continue
+		}
+		if i > 78 {
+			if first < 0 {
+				first = i
+			}
+			break
+		}
+		first = i
+	}
+	return first
+}
+
+// foldSignature splits the b= tag of a signature over several lines if it
+// is not folded already.
+func foldSignature(value string) string {
+	tags := strings.Split(value, ";")
+	for i, tag := range tags {
+		trimmed := strings.TrimLeft(tag, " \t\n")
+		if !strings.HasPrefix(trimmed, "b=") || strings.ContainsAny(trimmed, " \t\n") {
+			continue
+		}
+
+		b := trimmed[len("b="):]
+		var buf strings.Builder
+		buf.WriteString(tag[:len(tag)-len(trimmed)] + "b=")
+		for len(b) > 64 {
+			buf.WriteString(b[:64] + "\n\t")
+			b = b[64:]
+		}
+		buf.WriteString(b)
+		tags[i] = buf.String()
+	}
+	return strings.Join(tags, ";")
+}
+
+// relaxedHeader returns false for the DKIM and ARC message signatures
+// which use the simple header canonicalization, the default of both, under
+// which folding would invalidate them.  ARC seals always use the relaxed
+// one.
+func relaxedHeader(name string, value string) bool {
+	if !strings.EqualFold(name, "DKIM-Signature") && !strings.EqualFold(name, "ARC-Message-Signature") {
+		return true
+	}
+
+	for _, tag := range strings.Split(value, ";") {
+		tag = strings.Join(strings.Fields(tag), "")
+		if strings.HasPrefix(tag, "c=") {
+			return strings.HasPrefix(tag, "c=relaxed")
+		}
+	}
+	return false
+}
@@ -0,0 +1,541 @@
+//
+// Copyright (c) 2019 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package mailrewrite
+
+import (
+	"io"
+	"mime"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParser(t *testing.T) {
+	tests := []struct {
+		name      string
+		message   []string
+		maxLines  int
+		maxLength int
+		headers   []Header
+		end       int
+		done      bool
+		truncated bool
+	}{
+		{
+			name:    "empty",
+			message: nil,
+			end:     0,
+		},
+		{
+			name:    "empty line only",
+			message: []string{""},
+			end:     0,
+			done:    true,
+		},
+		{
+			name:    "headers and body",
+			message: []string{"From: a@example.org", "To: b@example.org", "", "body"},
+			headers: []Header{
+				{Name: "From", Lines: []string{"From: a@example.org"}, Start: 0},
+				{Name: "To", Lines: []string{"To: b@example.org"}, Start: 1},
+			},
+			end:  2,
+			done: true,
+		},
+		{
+			name:    "no body",
+			message: []string{"Subject: hi"},
+			headers: []Header{
+				{Name: "Subject", Lines: []string{"Subject: hi"}, Start: 0},
+			},
+			end: 1,
+		},
+		{
+			name:    "folded",
+			message: []string{"Subject: hello", " world", "\tagain", "To: b", ""},
+			headers: []Header{
+				{Name: "Subject", Lines: []string{"Subject: hello", " world", "\tagain"}, Start: 0},
+				{Name: "To", Lines: []string{"To: b"}, Start: 3},
+			},
+			end:  4,
+			done: true,
+		},
+		{
+			name:    "space before colon",
+			message: []string{"Subject : hi", ""},
+			headers: []Header{
+				{Name: "Subject", Lines: []string{"Subject : hi"}, Start: 0},
+			},
+			end:  1,
+			done: true,
+		},
+		{
+			name:    "continuation before any field",
+			message: []string{" stray", "From: a", ""},
+			headers: []Header{
+				{Name: "", Lines: []string{" stray"}, Start: 0},
+				{Name: "From", Lines: []string{"From: a"}, Start: 1},
+			},
+			end:  2,
+			done: true,
+		},
+		{
+			name:    "not a field",
+			message: []string{"From a@example.org Mon Jan 1", ":empty", "X Y: z", ""},
+			headers: []Header{
+				{Name: "", Lines: []string{"From a@example.org Mon Jan 1"}, Start: 0},
+				{Name: "", Lines: []string{":empty"}, Start: 1},
+				{Name: "", Lines: []string{"X Y: z"}, Start: 2},
+			},
+			end:  3,
+			done: true,
+		},
+		{
+			name:     "too many lines",
+			message:  []string{"A: 1", "B: 2", "C: 3", ""},
+			maxLines: 2,
+			headers: []Header{
+				{Name: "A", Lines: []string{"A: 1"}, Start: 0},
+				{Name: "B", Lines: []string{"B: 2"}, Start: 1},
+			},
+			end:       2,
+			done:      true,
+			truncated: true,
+		},
+		{
+			name:     "field cut short",
+			message:  []string{"A: 1", "B: 2", " more", ""},
+			maxLines: 2,
+			headers: []Header{
+				{Name: "A", Lines: []string{"A: 1"}, Start: 0},
+			},
+			end:       1,
+			done:      true,
+			truncated: true,
+		},
+		{
+			name:      "line too long",
+			message:   []string{"A: 1", "B: 0123456789", ""},
+			maxLength: 10,
+			headers: []Header{
+				{Name: "A", Lines: []string{"A: 1"}, Start: 0},
+			},
+			end:       1,
+			done:      true,
+			truncated: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p := Parser{MaxLines: test.maxLines, MaxLineLength: test.maxLength}
+			for _, line := range test.message {
+				if !p.Feed(line) {
+					break
+				}
+			}
+			if !reflect.DeepEqual(p.Headers, test.headers) {
+				t.Errorf("headers: got %q, want %q", p.Headers, test.headers)
+			}
+			if p.End() != test.end {
+				t.Errorf("end: got %d, want %d", p.End(), test.end)
+			}
+			if p.Done != test.done {
+				t.Errorf("done: got %t, want %t", p.Done, test.done)
+			}
+			if p.Truncated != test.truncated {
+				t.Errorf("truncated: got %t, want %t", p.Truncated, test.truncated)
+			}
+			if p.Feed("X: after") && test.done {
+				t.Errorf("line accepted after the end of the header block")
+			}
+		})
+	}
+}
+
+func TestHeaderValue(t *testing.T) {
+	headers, _ := Parse([]string{"Subject:  hello", "\tworld", "X-Empty:", ""})
+
+	if v := headers[0].Value(); v != "hello\tworld" {
+		t.Errorf("value: got %q", v)
+	}
+	if v := headers[0].RawValue(); v != "hello\n\tworld" {
+		t.Errorf("raw value: got %q", v)
+	}
+	if v := headers[1].Value(); v != "" {
+		t.Errorf("empty value: got %q", v)
+	}
+	if end := headers[0].End(); end != 2 {
+		t.Errorf("end: got %d", end)
+	}
+}
+
+func TestFind(t *testing.T) {
+	headers, _ := Parse([]string{"not a field", "From: a", "subject: x", "Subject: y", ""})
+
+	tests := []struct {
+		name  string
+		index int
+	}{
+		{"Subject", 2},
+		{"SUBJECT", 2},
+		{"from", 1},
+		{"To", -1},
+		{"", -1},
+	}
+	for _, test := range tests {
+		if i := Find(headers, test.name); i != test.index {
+			t.Errorf("%q: got %d, want %d", test.name, i, test.index)
+		}
+	}
+}
+
+func TestRemove(t *testing.T) {
+	message := []string{
+		"Received: 1",
+		"X-Spam: a",
+		"Received: 2",
+		"x-spam: b",
+		"Received: 3",
+		"X-SPAM: c",
+		"no field",
+		"",
+	}
+
+	tests := []struct {
+		name   string
+		remove map[string]int
+		kept   []string
+	}{
+		{
+			name: "nothing",
+			kept: []string{"Received: 1", "X-Spam: a", "Received: 2", "x-spam: b", "Received: 3", "X-SPAM: c", "no field"},
+		},
+		{
+			name:   "every occurrence",
+			remove: map[string]int{"X-Spam": 0},
+			kept:   []string{"Received: 1", "Received: 2", "Received: 3", "no field"},
+		},
+		{
+			name:   "first",
+			remove: map[string]int{"x-spam": 1},
+			kept:   []string{"Received: 1", "Received: 2", "x-spam: b", "Received: 3", "X-SPAM: c", "no field"},
+		},
+		{
+			name:   "second",
+			remove: map[string]int{"X-SPAM": 2},
+			kept:   []string{"Received: 1", "X-Spam: a", "Received: 2", "Received: 3", "X-SPAM: c", "no field"},
+		},
+		{
+			name:   "last",
+			remove: map[string]int{"X-Spam": -1},
+			kept:   []string{"Received: 1", "X-Spam: a", "Received: 2", "x-spam: b", "Received: 3", "no field"},
+		},
+		{
+			name:   "second from the end",
+			remove: map[string]int{"Received": -2},
+			kept:   []string{"Received: 1", "X-Spam: a", "x-spam: b", "Received: 3", "X-SPAM: c", "no field"},
+		},
+		{
+			name:   "beyond the count",
+			remove: map[string]int{"X-Spam": 4, "Received": -4},
+			kept:   []string{"Received: 1", "X-Spam: a", "Received: 2", "x-spam: b", "Received: 3", "X-SPAM: c", "no field"},
+		},
+		{
+			name:   "several",
+			remove: map[string]int{"X-Spam": 0, "Received": 1},
+			kept:   []string{"Received: 2", "Received: 3", "no field"},
+		},
+		{
+			name:   "absent",
+			remove: map[string]int{"To": 0},
+			kept:   []string{"Received: 1", "X-Spam: a", "Received: 2", "x-spam: b", "Received: 3", "X-SPAM: c", "no field"},
+		},
+		{
+			name:   "empty name",
+			remove: map[string]int{"": 0},
+			kept:   []string{"Received: 1", "X-Spam: a", "Received: 2", "x-spam: b", "Received: 3", "X-SPAM: c", "no field"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			headers, _ := Parse(message)
+
+			var kept []string
+			for _, h := range Remove(headers, test.remove) {
+				kept = append(kept, h.Lines...)
+			}
+			if !reflect.DeepEqual(kept, test.kept) {
+				t.Errorf("got %q, want %q", kept, test.kept)
+			}
+		})
+	}
+}
+
+func TestEncodeValue(t *testing.T) {
+	tests := []struct {
+		value   string
+		encoded string
+	}{
+		{"", ""},
+		{"plain ascii", "plain ascii"},
+		{"with\ttab", "with\ttab"},
+		{"Re: café", "=?utf-8?q?Re:_caf=C3=A9?="},
+		{"日本語", "=?utf-8?b?5pel5pys6Kqe?="},
+		{"line\nbreak", "=?utf-8?q?line=0Abreak?="},
+		{"\x01\x02\x03", "=?utf-8?b?AQID?="},
+		{"a very long value with a single accent: é", "=?utf-8?q?a_very_long_value_with_a_single_accent:_=C3=A9?="},
+	}
+
+	for _, test := range tests {
+		if encoded := EncodeValue(test.value); encoded != test.encoded {
+			t.Errorf("%q: got %q, want %q", test.value, encoded, test.encoded)
+		}
+	}
+}
+
+func TestFold(t *testing.T) {
+	long := strings.Repeat("word ", 30)
+
+	tests := []struct {
+		name   string
+		header string
+		value  string
+		lines  []string
+	}{
+		{
+			name:   "short",
+			header: "X-Spam",
+			value:  "yes",
+			lines:  []string{"X-Spam: yes"},
+		},
+		{
+			name:   "already folded",
+			header: "X-Spam-Status",
+			value:  "Yes, score=10\n\tA, B",
+			lines:  []string{"X-Spam-Status: Yes, score=10", "\tA, B"},
+		},
+		{
+			name:   "carriage returns",
+			header: "X-Spam",
+			value:  "yes\r\n\tno",
+			lines:  []string{"X-Spam: yes", "\tno"},
+		},
+		{
+			name:   "long",
+			header: "X-Long",
+			value:  strings.TrimSpace(long),
+			lines: []string{
+				"X-Long:" + strings.TrimSuffix(" "+strings.Repeat("word ", 14), " "),
+				strings.TrimSuffix(" "+strings.Repeat("word ", 15), " "),
+				" word",
+			},
+		},
+		{
+			name:   "no whitespace",
+			header: "X-Long",
+			value:  strings.Repeat("x", 100),
+			lines:  []string{"X-Long: " + strings.Repeat("x", 100)},
+		},
+		{
+			name:   "never before the value",
+			header: "X-" + strings.Repeat("n", 80),
+			value:  "value",
+			lines:  []string{"X-" + strings.Repeat("n", 80) + ": value"},
+		},
+		{
+			name:   "simple signature",
+			header: "DKIM-Signature",
+			value:  "v=1; c=simple/simple; d=example.org; h=from:to; " + long,
+			lines:  []string{"DKIM-Signature: v=1; c=simple/simple; d=example.org; h=from:to; " + long},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			lines := Fold(test.header, test.value)
+			if !reflect.DeepEqual(lines, test.lines) {
+				t.Errorf("got %q, want %q", lines, test.lines)
+			}
+			if strings.Join(lines, "") != test.header+": "+strings.NewReplacer("\r", "", "\n", "").Replace(test.value) {
+				t.Errorf("folding changed the value: %q", lines)
+			}
+		})
+	}
+}
+
+func TestFoldSignature(t *testing.T) {
+	b := strings.Repeat("A", 64) + strings.Repeat("B", 64) + "CC"
+
+	tests := []struct {
+		name   string
+		value  string
+		folded string
+	}{
+		{
+			name:   "short",
+			value:  "v=1; b=abc",
+			folded: "v=1; b=abc",
+		},
+		{
+			name:   "long",
+			value:  "v=1; b=" + b + "; bh=xyz",
+			folded: "v=1; b=" + strings.Repeat("A", 64) + "\n\t" + strings.Repeat("B", 64) + "\n\tCC; bh=xyz",
+		},
+		{
+			name:   "already folded",
+			value:  "v=1; b=" + strings.Repeat("A", 64) + "\n\t" + strings.Repeat("B", 64),
+			folded: "v=1; b=" + strings.Repeat("A", 64) + "\n\t" + strings.Repeat("B", 64),
+		},
+		{
+			name:   "body hash left alone",
+			value:  "v=1; bh=" + b,
+			folded: "v=1; bh=" + b,
+		},
+		{
+			name:   "first tag",
+			value:  "b=" + b,
+			folded: "b=" + strings.Repeat("A", 64) + "\n\t" + strings.Repeat("B", 64) + "\n\tCC",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if folded := foldSignature(test.value); folded != test.folded {
+				t.Errorf("got %q, want %q", folded, test.folded)
+			}
+		})
+	}
+}
+
+func TestFoldSignatureHeader(t *testing.T) {
+	b := strings.Repeat("A", 100)
+	lines := Fold("DKIM-Signature", "v=1; a=rsa-sha256; c=relaxed/relaxed; d=example.org; b="+b)
+
+	want := []string{
+		"DKIM-Signature: v=1; a=rsa-sha256; c=relaxed/relaxed; d=example.org;",
+		" b=" + strings.Repeat("A", 64),
+		"\t" + strings.Repeat("A", 36),
+	}
+	if !reflect.DeepEqual(lines, want) {
+		t.Errorf("got %q, want %q", lines, want)
+	}
+}
+
+func TestFoldSimpleSignature(t *testing.T) {
+	h := strings.Repeat("from:to:subject:", 6)
+	for _, name := range []string{"DKIM-Signature", "ARC-Message-Signature"} {
+		value := "i=1; a=rsa-sha256; c=simple/simple; d=example.org; h=" + h + "; b=sig"
+		lines := Fold(name, value)
+		if want := []string{name + ": " + value}; !reflect.DeepEqual(lines, want) {
+			t.Errorf("%s: got %q, want %q", name, lines, want)
+		}
+
+		// the relaxed ones are folded
+		relaxed := strings.Replace(value, "c=simple/simple", "c=relaxed/simple", 1)
+		if lines := Fold(name, relaxed); len(lines) == 1 {
+			t.Errorf("%s: relaxed signature not folded: %q", name, lines)
+		}
+	}
+}
+
+func TestRelaxedHeader(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		relaxed bool
+	}{
+		{"X-Spam", "c=simple", true},
+		{"DKIM-Signature", "v=1; c=relaxed/simple; d=example.org", true},
+		{"dkim-signature", "v=1; c = relaxed/relaxed", true},
+		{"DKIM-Signature", "v=1; c=simple/relaxed", false},
+		{"DKIM-Signature", "v=1; c=simple", false},
+		{"DKIM-Signature", "v=1; d=example.org", false},
+		{"DKIM-Signature", "v=1;\n\tc=relaxed/relaxed", true},
+		{"ARC-Seal", "i=1; cv=none", true},
+		{"ARC-Message-Signature", "i=1; c=relaxed/relaxed; d=example.org", true},
+		{"arc-message-signature", "i=1; c=simple/relaxed; d=example.org", false},
+		{"ARC-Message-Signature", "i=1; d=example.org", false},
+	}
+
+	for _, test := range tests {
+		if relaxed := relaxedHeader(test.name, test.value); relaxed != test.relaxed {
+			t.Errorf("%s: %q: got %t, want %t", test.name, test.value, relaxed, test.relaxed)
+		}
+	}
+}
+
+func TestFoldContinuation(t *testing.T) {
+	tests := []struct {
+		value string
+		lines []string
+	}{
+		{"one\n\ttwo", []string{"X-Test: one", "\ttwo"}},
+		{"one\nBcc: victim@example.net", []string{"X-Test: one", "\tBcc: victim@example.net"}},
+		{"one\n\ntwo", []string{"X-Test: one", "\ttwo"}},
+		{"one\n \t\n", []string{"X-Test: one"}},
+		{"one\r\n\r\n two", []string{"X-Test: one", " two"}},
+		{"\none", []string{"X-Test: ", "\tone"}},
+	}
+
+	for _, test := range tests {
+		if lines := Fold("X-Test", test.value); !reflect.DeepEqual(lines, test.lines) {
+			t.Errorf("%q: got %q, want %q", test.value, lines, test.lines)
+		}
+	}
+}
+
+// mojibake are header values found in the wild: raw legacy charsets,
+// UTF-8 decoded as Latin-1 and encoded again, and broken UTF-8.
+var mojibake = []string{
+	"CafÃ© crÃ¨me Ã  la franÃ§aise",
+	"caf\xe9 cr\xe8me \xe0 la fran\xe7aise",
+	"\x93smart quotes\x94 \x96 and a dash",
+	"\x82\xb1\x82\xf1\x82\xc9\x82\xbf\x82\xcd",
+	"\xc4\xe3\xba\xc3",
+	"\xcf\xf0\xe8\xe2\xe5\xf2",
+	"truncated caf\xc3",
+	"overlong \xc0\xaf slash",
+	"\xef\xbb\xbfbyte order mark",
+	"ÐŸÑ€Ð¸Ð²ÐµÑ‚",
+}
+
+func TestEncodeValueMojibake(t *testing.T) {
+	decoder := &mime.WordDecoder{
+		CharsetReader: func(charset string, input io.Reader) (io.Reader, error) {
+			return input, nil
+		},
+	}
+
+	for _, value := range mojibake {
+		encoded := EncodeValue(value)
+		for i := 0; i < len(encoded); i++ {
+			if encoded[i] < ' ' || encoded[i] > '~' {
+				t.Errorf("%q: not printable ASCII: %q", value, encoded)
+				break
+			}
+		}
+
+		decoded, err := decoder.DecodeHeader(encoded)
+		if err != nil {
+			t.Errorf("%q: %s", value, err)
+		} else if decoded != value {
+			t.Errorf("%q: decoded as %q", value, decoded)
+		}
+	}
+}
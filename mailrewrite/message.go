@@ -0,0 +1,165 @@
+//
+// Copyright (c) 2019 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package mailrewrite
+
+import (
+	"strings"
+)
+
+// Field is a header field to be written: its value may span several
+// lines, separated by LF, and is folded as it is written.
+type Field struct {
+	Name  string
+	Value string
+}
+
+// Edit describes the changes to apply to a message as it is written.
+type Edit struct {
+	// Add lists the headers prepended to the message, in order.
+	Add []Field
+
+	// Remove maps a header name to the occurrence to remove, as
+	// understood by Remove.
+	Remove map[string]int
+
+	// Drop, if set, is called with every header of the message and
+	// returns whether it is removed.
+	Drop func(h Header) bool
+
+	// Subject, if set, is called with the Subject header of the
+	// message, or nil if it has none, and returns the fields written
+	// in its place.
+	Subject func(h *Header) []Field
+
+	// Body, if not nil, lists the lines written in place of the body
+	// of the message, without dot-stuffing.
+	Body []string
+}
+
+// Message is a message received over SMTP, one line at a time. Lines are
+// kept as received, dot-stuffed, so that those which are not rewritten
+// are written back byte for byte.
+type Message struct {
+	raw    []string
+	lines  []string
+	parser Parser
+}
+
+// Stuff returns line as sent over SMTP, with a leading dot escaped.
+func Stuff(line string) string {
+	if strings.HasPrefix(line, ".") {
+		return "." + line
+	}
+	return line
+}
+
+// Unstuff returns line as received over SMTP with its leading dot
+// unescaped.
+func Unstuff(line string) string {
+	return strings.TrimPrefix(line, ".")
+}
+
+// Limit bounds the header block parsed, as Parser.MaxLines and
+// Parser.MaxLineLength do. It must be called before any line is appended.
+func (m *Message) Limit(maxLines int, maxLineLength int) {
+	m.parser.MaxLines = maxLines
+	m.parser.MaxLineLength = maxLineLength
+}
+
+// Truncated returns whether the header block was only partly parsed.
+func (m *Message) Truncated() bool {
+	return m.parser.Truncated
+}
+
+// Append adds the next line of the message, as received over SMTP.
+func (m *Message) Append(raw string) {
+	line := Unstuff(raw)
+	m.raw = append(m.raw, raw)
+	m.lines = append(m.lines, line)
+	m.parser.Feed(line)
+}
+
+// InHeaders returns true until the end of the header block is reached.
+func (m *Message) InHeaders() bool {
+	return !m.parser.Done
+}
+
+// Raw returns the lines of the message as received.
+func (m *Message) Raw() []string {
+	return m.raw
+}
+
+// Lines returns the lines of the message with dot-stuffing removed.
+func (m *Message) Lines() []string {
+	return m.lines
+}
+
+// Headers returns the header fields of the message.
+func (m *Message) Headers() []Header {
+	return m.parser.Headers
+}
+
+// HeaderEnd returns the index of the line which ends the header block.
+func (m *Message) HeaderEnd() int {
+	return m.parser.End()
+}
+
+// Write passes the lines of the message, dot-stuffed and with e applied,
+// to w. The terminating dot is not written.
+func (m *Message) Write(w func(line string), e Edit) {
+	writeFields(w, e.Add)
+
+	hasSubject := false
+	for _, h := range Remove(m.parser.Headers, e.Remove) {
+		if e.Drop != nil && h.Name != "" && e.Drop(h) {
+			continue
+		}
+		if e.Subject != nil && strings.EqualFold(h.Name, "Subject") {
+			hasSubject = true
+			h := h
+			writeFields(w, e.Subject(&h))
+			continue
+		}
+		for _, line := range m.raw[h.Start:h.End()] {
+			w(line)
+		}
+	}
+	// a Subject may lie beyond the part of the header block parsed
+	if e.Subject != nil && !hasSubject && !m.parser.Truncated {
+		writeFields(w, e.Subject(nil))
+	}
+
+	if e.Body == nil {
+		for _, line := range m.raw[m.parser.End():] {
+			w(line)
+		}
+		return
+	}
+
+	w("")
+	for _, line := range e.Body {
+		w(Stuff(line))
+	}
+}
+
+func writeFields(w func(line string), fields []Field) {
+	for _, f := range fields {
+		for _, line := range Fold(f.Name, f.Value) {
+			w(Stuff(line))
+		}
+	}
+}
@@ -0,0 +1,232 @@
+//
+// Copyright (c) 2019 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package mailrewrite
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// newMessage returns a message made of lines, as received over SMTP.
+func newMessage(lines []string) *Message {
+	m := &Message{}
+	for _, line := range lines {
+		m.Append(line)
+	}
+	return m
+}
+
+// write returns the lines of m as written with e applied.
+func write(m *Message, e Edit) []string {
+	var out []string
+	m.Write(func(line string) {
+		out = append(out, line)
+	}, e)
+	return out
+}
+
+func TestWriteRemove(t *testing.T) {
+	message := []string{
+		"X-Spam: first",
+		"\tfolded",
+		"Subject: hello",
+		"x-spam: second",
+		"X-Other: one",
+		" two",
+		"X-SPAM: third",
+		"  folded",
+		"\tagain",
+		"",
+		"X-Spam: in the body",
+	}
+
+	tests := []struct {
+		name   string
+		remove map[string]int
+		out    []string
+	}{
+		{
+			name:   "every occurrence with continuations",
+			remove: map[string]int{"x-spam": 0},
+			out: []string{
+				"Subject: hello",
+				"X-Other: one",
+				" two",
+				"",
+				"X-Spam: in the body",
+			},
+		},
+		{
+			name:   "first, folded",
+			remove: map[string]int{"X-Spam": 1},
+			out: []string{
+				"Subject: hello",
+				"x-spam: second",
+				"X-Other: one",
+				" two",
+				"X-SPAM: third",
+				"  folded",
+				"\tagain",
+				"",
+				"X-Spam: in the body",
+			},
+		},
+		{
+			name:   "last, folded twice",
+			remove: map[string]int{"X-Spam": -1},
+			out: []string{
+				"X-Spam: first",
+				"\tfolded",
+				"Subject: hello",
+				"x-spam: second",
+				"X-Other: one",
+				" two",
+				"",
+				"X-Spam: in the body",
+			},
+		},
+		{
+			name:   "interleaved",
+			remove: map[string]int{"X-SPAM": 2, "x-other": 0, "SUBJECT": -1},
+			out: []string{
+				"X-Spam: first",
+				"\tfolded",
+				"X-SPAM: third",
+				"  folded",
+				"\tagain",
+				"",
+				"X-Spam: in the body",
+			},
+		},
+		{
+			name:   "nth beyond the count",
+			remove: map[string]int{"X-Spam": 4},
+			out:    message,
+		},
+		{
+			name:   "header of the body",
+			remove: map[string]int{"X-Spam": 0, "Subject": 0, "X-Other": 0},
+			out: []string{
+				"",
+				"X-Spam: in the body",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			out := write(newMessage(message), Edit{Remove: test.remove})
+			if !reflect.DeepEqual(out, test.out) {
+				t.Errorf("got %q, want %q", out, test.out)
+			}
+		})
+	}
+}
+
+func TestWriteDrop(t *testing.T) {
+	message := []string{
+		"Not a header",
+		"X-Spam: yes",
+		"\tfolded",
+		"From: a@example.org",
+		"",
+		"body",
+	}
+
+	out := write(newMessage(message), Edit{
+		Drop: func(h Header) bool {
+			return h.Name == "X-Spam" || h.Name == ""
+		},
+	})
+	want := []string{
+		"Not a header",
+		"From: a@example.org",
+		"",
+		"body",
+	}
+	if !reflect.DeepEqual(out, want) {
+		t.Errorf("got %q, want %q", out, want)
+	}
+}
+
+// readMessage returns the lines of a message of testdata, dot-stuffed as
+// smtpd hands them over.
+func readMessage(t *testing.T, path string) []string {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lines []string
+	for _, line := range strings.Split(strings.TrimSuffix(string(data), "\n"), "\n") {
+		lines = append(lines, Stuff(line))
+	}
+	return lines
+}
+
+// unstuffed returns the bytes of a message written as lines.
+func unstuffed(lines []string) []byte {
+	var buf bytes.Buffer
+	for _, line := range lines {
+		buf.WriteString(Unstuff(line) + "\n")
+	}
+	return buf.Bytes()
+}
+
+// TestWritePassThrough checks that the messages of testdata come out byte
+// for byte as they went in when nothing is to be changed, and that only
+// the lines which are changed differ otherwise.
+func TestWritePassThrough(t *testing.T) {
+	paths, err := filepath.Glob(filepath.Join("testdata", "*.eml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) == 0 {
+		t.Fatal("no message in testdata")
+	}
+
+	for _, path := range paths {
+		t.Run(filepath.Base(path), func(t *testing.T) {
+			golden, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			lines := readMessage(t, path)
+
+			out := write(newMessage(lines), Edit{})
+			if !bytes.Equal(unstuffed(out), golden) {
+				t.Errorf("got %q, want %q", unstuffed(out), golden)
+			}
+
+			out = write(newMessage(lines), Edit{Remove: map[string]int{"X-Absent": 0}})
+			if !bytes.Equal(unstuffed(out), golden) {
+				t.Errorf("removing an absent header: got %q, want %q", unstuffed(out), golden)
+			}
+
+			out = write(newMessage(lines), Edit{Add: []Field{{Name: "X-Spam", Value: "yes"}}})
+			if len(out) == 0 || out[0] != "X-Spam: yes" {
+				t.Fatalf("header not added: %q", out)
+			}
+			if !bytes.Equal(unstuffed(out[1:]), golden) {
+				t.Errorf("adding a header: got %q, want %q", unstuffed(out[1:]), golden)
+			}
+		})
+	}
+}
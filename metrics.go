@@ -0,0 +1,60 @@
+//
+// Copyright (c) 2019 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package main
+
+import (
+	"log"
+	"sort"
+	"sync"
+)
+
+// counters are kept for the lifetime of the process and logged on exit.
+var counters = struct {
+	sync.Mutex
+	values map[string]uint64
+}{values: make(map[string]uint64)}
+
+func metricInc(name string) {
+	counters.Lock()
+	counters.values[name]++
+	counters.Unlock()
+}
+
+func metricsSnapshot() map[string]uint64 {
+	counters.Lock()
+	defer counters.Unlock()
+
+	snapshot := make(map[string]uint64, len(counters.values))
+	for k, v := range counters.values {
+		snapshot[k] = v
+	}
+	return snapshot
+}
+
+func logMetrics() {
+	snapshot := metricsSnapshot()
+
+	names := make([]string, 0, len(snapshot))
+	for k := range snapshot {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	for _, k := range names {
+		log.Printf("%s: %d", k, snapshot[k])
+	}
+}
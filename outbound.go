@@ -0,0 +1,123 @@
+//
+// Copyright (c) 2019 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package main
+
+import (
+	"log"
+	"strings"
+)
+
+// With -smtp-out, the filter also follows outgoing deliveries, which are
+// reported on sessions of their own.  The recipients of the messages
+// delivered are recorded in the storage as correspondents, whose mail is
+// then known to be part of an exchange.
+
+type outSession struct {
+	rcpts []string
+}
+
+// outSessions are only used by the main goroutine.
+var outSessions = make(map[string]*outSession)
+
+var outReporters = map[string]func(*outSession, []string){
+	"tx-begin":    outTxBegin,
+	"tx-rcpt":     outTxRcpt,
+	"tx-commit":   outTxCommit,
+	"tx-rollback": outTxRollback,
+}
+
+func reportOut(atoms []string) {
+	id := atoms[5]
+	if atoms[4] == "link-disconnect" {
+		delete(outSessions, id)
+		return
+	}
+
+	s, ok := outSessions[id]
+	if !ok {
+		s = &outSession{}
+		outSessions[id] = s
+	}
+
+	if v, ok := outReporters[atoms[4]]; ok {
+		v(s, atoms[6:])
+	} else {
+		log.Fatalf("invalid phase: %s", atoms[4])
+	}
+}
+
+func outTxBegin(s *outSession, params []string) {
+	if len(params) != 1 {
+		log.Fatal("invalid input, shouldn't happen")
+	}
+	s.rcpts = nil
+}
+
+func outTxRcpt(s *outSession, params []string) {
+	if len(params) < 3 {
+		log.Fatal("invalid input, shouldn't happen")
+	}
+	if params[1] == "ok" {
+		s.rcpts = append(s.rcpts, strings.Join(params[2:], "|"))
+	}
+}
+
+func outTxCommit(s *outSession, params []string) {
+	if len(params) < 1 {
+		log.Fatal("invalid input, shouldn't happen")
+	}
+	metricInc("outbound.delivered")
+
+	// the storage may be remote, it is not to hold the main goroutine
+	rcpts := s.rcpts
+	s.rcpts = nil
+	go func() {
+		for _, rcpt := range rcpts {
+			metricInc("outbound.recipients")
+			if err := store.Set(correspondentKey(rcpt), "1", *correspondentTTL); err != nil {
+				metricInc("outbound.errors")
+				log.Printf("correspondent %s storage err: %s", rcpt, err)
+			}
+		}
+	}()
+}
+
+func outTxRollback(s *outSession, params []string) {
+	if len(params) < 1 {
+		log.Fatal("invalid input, shouldn't happen")
+	}
+	metricInc("outbound.failed")
+	s.rcpts = nil
+}
+
+func correspondentKey(address string) string {
+	return "correspondent:" + strings.ToLower(canonicalAddress(address))
+}
+
+// isCorrespondent returns whether mail was delivered to address within
+// the -correspondent-ttl.
+func isCorrespondent(address string) bool {
+	if !*smtpOut || address == "" || store == nil {
+		return false
+	}
+	_, ok, err := store.Get(correspondentKey(address))
+	if err != nil {
+		metricInc("outbound.errors")
+		log.Printf("correspondent %s storage err: %s", address, err)
+	}
+	return ok
+}
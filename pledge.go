@@ -1,4 +1,6 @@
+//go:build !openbsd && !(linux && (amd64 || arm64))
 // +build !openbsd
+// +build !linux !amd64,!arm64
 
 package main
 
@@ -0,0 +1,193 @@
+//
+// Copyright (c) 2019 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+//go:build amd64 || arm64
+// +build amd64 arm64
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	seccompSetModeFilter   = 1
+	seccompFilterFlagTsync = 1
+
+	seccompRetKillProcess = 0x80000000
+	seccompRetErrno       = 0x00050000
+	seccompRetAllow       = 0x7fff0000
+
+	prSetNoNewPrivs = 38
+
+	// offsets of the fields of struct seccomp_data
+	seccompDataNr   = 0
+	seccompDataArch = 4
+)
+
+// promiseSyscalls are the system calls allowed by each pledge promise,
+// along with those listed for the architecture in archSyscalls. Without
+// looking at arguments, inet and unix sockets cannot be told apart, and
+// neither can files opened for reading or writing.
+var promiseSyscalls = map[string][]uintptr{
+	"stdio": {
+		syscall.SYS_READ, syscall.SYS_WRITE, syscall.SYS_READV,
+		syscall.SYS_WRITEV, syscall.SYS_PREAD64, syscall.SYS_PWRITE64,
+		syscall.SYS_CLOSE, syscall.SYS_FSTAT, syscall.SYS_LSEEK,
+		syscall.SYS_MMAP, syscall.SYS_MUNMAP, syscall.SYS_MPROTECT,
+		syscall.SYS_MADVISE, syscall.SYS_MREMAP, syscall.SYS_BRK,
+		syscall.SYS_RT_SIGACTION, syscall.SYS_RT_SIGPROCMASK,
+		syscall.SYS_RT_SIGRETURN, syscall.SYS_SIGALTSTACK,
+		syscall.SYS_IOCTL, syscall.SYS_FCNTL, syscall.SYS_DUP,
+		syscall.SYS_DUP3, syscall.SYS_PIPE2, syscall.SYS_FUTEX,
+		syscall.SYS_CLONE, syscall.SYS_SCHED_YIELD,
+		syscall.SYS_SCHED_GETAFFINITY, syscall.SYS_NANOSLEEP,
+		syscall.SYS_CLOCK_GETTIME, syscall.SYS_CLOCK_NANOSLEEP,
+		syscall.SYS_GETTIMEOFDAY, syscall.SYS_SETITIMER,
+		syscall.SYS_TIMER_CREATE, syscall.SYS_TIMER_SETTIME,
+		syscall.SYS_TIMER_DELETE, syscall.SYS_GETPID, syscall.SYS_GETTID,
+		syscall.SYS_GETPPID, syscall.SYS_GETUID, syscall.SYS_GETEUID,
+		syscall.SYS_GETGID, syscall.SYS_GETEGID, syscall.SYS_TGKILL,
+		syscall.SYS_TKILL, syscall.SYS_EXIT, syscall.SYS_EXIT_GROUP,
+		syscall.SYS_RESTART_SYSCALL, syscall.SYS_EPOLL_CREATE1,
+		syscall.SYS_EPOLL_CTL, syscall.SYS_EPOLL_PWAIT,
+		syscall.SYS_EVENTFD2, syscall.SYS_PPOLL, syscall.SYS_PSELECT6,
+		syscall.SYS_UNAME, syscall.SYS_GETRLIMIT, syscall.SYS_PRLIMIT64,
+		syscall.SYS_SET_ROBUST_LIST, syscall.SYS_SENDTO,
+		syscall.SYS_RECVFROM, syscall.SYS_SENDMSG, syscall.SYS_RECVMSG,
+		syscall.SYS_GETSOCKOPT, syscall.SYS_SETSOCKOPT,
+		syscall.SYS_GETSOCKNAME, syscall.SYS_GETPEERNAME,
+		syscall.SYS_SHUTDOWN, syscall.SYS_FSYNC, syscall.SYS_FDATASYNC,
+		syscall.SYS_FTRUNCATE,
+	},
+	"rpath": {
+		syscall.SYS_OPENAT, syscall.SYS_READLINKAT, syscall.SYS_GETDENTS64,
+		syscall.SYS_FACCESSAT, syscall.SYS_STATFS, syscall.SYS_FSTATFS,
+		syscall.SYS_GETCWD, syscall.SYS_CHDIR, syscall.SYS_FCHDIR,
+	},
+	"wpath": {
+		syscall.SYS_OPENAT,
+	},
+	"cpath": {
+		syscall.SYS_OPENAT, syscall.SYS_MKDIRAT, syscall.SYS_UNLINKAT,
+		syscall.SYS_RENAMEAT, syscall.SYS_LINKAT, syscall.SYS_SYMLINKAT,
+	},
+	"inet": {
+		syscall.SYS_SOCKET, syscall.SYS_CONNECT, syscall.SYS_BIND,
+		syscall.SYS_LISTEN, syscall.SYS_ACCEPT4,
+	},
+	"unix": {
+		syscall.SYS_SOCKET, syscall.SYS_CONNECT, syscall.SYS_BIND,
+		syscall.SYS_LISTEN, syscall.SYS_ACCEPT4,
+	},
+	"dns": {
+		syscall.SYS_SOCKET, syscall.SYS_CONNECT, syscall.SYS_OPENAT,
+	},
+	"fattr": {
+		syscall.SYS_FCHMOD, syscall.SYS_FCHMODAT, syscall.SYS_FCHOWN,
+		syscall.SYS_FCHOWNAT, syscall.SYS_UTIMENSAT,
+	},
+	"proc": {
+		syscall.SYS_KILL, syscall.SYS_WAIT4, syscall.SYS_WAITID,
+		syscall.SYS_SETPGID, syscall.SYS_GETPGID, syscall.SYS_SETSID,
+	},
+}
+
+// PledgePromises restricts the process to the system calls needed by
+// promises, using a seccomp filter applied to every thread. Calls outside
+// of them fail with EPERM rather than killing the process. Filters stack,
+// so that promises may only ever be reduced.
+//
+// Programs executed inherit the filter, which pledge does not do: the
+// exec promise leaves the process unrestricted.
+func PledgePromises(promises string) error {
+	// further filters may be installed, as promises may be reduced
+	allowed := map[uintptr]bool{
+		syscall.SYS_PRCTL: true,
+		sysSeccomp:        true,
+	}
+	for _, promise := range strings.Fields(promises) {
+		if promise == "exec" {
+			return nil
+		}
+		for _, nr := range promiseSyscalls[promise] {
+			allowed[nr] = true
+		}
+		for _, nr := range archSyscalls[promise] {
+			allowed[nr] = true
+		}
+	}
+
+	syscalls := make([]int, 0, len(allowed))
+	for nr := range allowed {
+		syscalls = append(syscalls, int(nr))
+	}
+	sort.Ints(syscalls)
+
+	filter := []syscall.SockFilter{
+		bpfStmt(syscall.BPF_LD|syscall.BPF_W|syscall.BPF_ABS, seccompDataArch),
+		bpfJump(syscall.BPF_JMP|syscall.BPF_JEQ|syscall.BPF_K, auditArch, 1, 0),
+		bpfStmt(syscall.BPF_RET|syscall.BPF_K, seccompRetKillProcess),
+		bpfStmt(syscall.BPF_LD|syscall.BPF_W|syscall.BPF_ABS, seccompDataNr),
+	}
+	for _, nr := range syscalls {
+		filter = append(filter,
+			bpfJump(syscall.BPF_JMP|syscall.BPF_JEQ|syscall.BPF_K, uint32(nr), 0, 1),
+			bpfStmt(syscall.BPF_RET|syscall.BPF_K, seccompRetAllow))
+	}
+	filter = append(filter,
+		bpfStmt(syscall.BPF_RET|syscall.BPF_K, seccompRetErrno|uint32(syscall.EPERM)))
+
+	prog := syscall.SockFprog{
+		Len:    uint16(len(filter)),
+		Filter: &filter[0],
+	}
+
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prSetNoNewPrivs, 1, 0); errno != 0 {
+		return errno
+	}
+	r, _, errno := syscall.RawSyscall(sysSeccomp, seccompSetModeFilter,
+		seccompFilterFlagTsync, uintptr(unsafe.Pointer(&prog)))
+	if errno != 0 {
+		return errno
+	}
+	if r != 0 {
+		return fmt.Errorf("could not synchronize thread %d", r)
+	}
+	return nil
+}
+
+func bpfStmt(code uint16, k uint32) syscall.SockFilter {
+	return syscall.SockFilter{Code: code, K: k}
+}
+
+func bpfJump(code uint16, k uint32, jt uint8, jf uint8) syscall.SockFilter {
+	return syscall.SockFilter{Code: code, Jt: jt, Jf: jf, K: k}
+}
+
+// Unveil and UnveilBlock have no equivalent here: the paths which may be
+// opened are only restricted through the promises.
+func Unveil(path string, flags string) error {
+	return nil
+}
+
+func UnveilBlock() error {
+	return nil
+}
@@ -0,0 +1,82 @@
+//
+// Copyright (c) 2019 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// runPolicyHook runs the -policy-hook program with the verdict as JSON on
+// its standard input, and returns the action printed on the first line of
+// its standard output, or the action of the verdict if it prints none.  A
+// non-zero exit status, or an unknown action, is an error.
+func runPolicyHook(v verdict) (string, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *policyHookTimeout)
+	defer cancel()
+
+	// Programs started by the hook may keep its standard output open
+	// after it is killed, so the output is read with a deadline rather
+	// than until it is closed.
+	r, w, err := os.Pipe()
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+
+	cmd := exec.CommandContext(ctx, *policyHook)
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.Stdout = w
+	cmd.Stderr = os.Stderr
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		return "", err
+	}
+
+	deadline, _ := ctx.Deadline()
+	r.SetReadDeadline(deadline)
+	action, _ := bufio.NewReader(io.LimitReader(r, 1024)).ReadString('\n')
+
+	if err := cmd.Wait(); err != nil {
+		if ctx.Err() != nil {
+			return "", fmt.Errorf("timed out after %s", *policyHookTimeout)
+		}
+		return "", err
+	}
+
+	action = strings.TrimSpace(action)
+	if action == "" {
+		return v.Action, nil
+	}
+	if !validAction(action) {
+		return "", fmt.Errorf("invalid action: %s", action)
+	}
+	return action, nil
+}
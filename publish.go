@@ -0,0 +1,71 @@
+//
+// Copyright (c) 2019 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"log"
+)
+
+// verdictPublisher publishes verdicts to a redis channel, one JSON object
+// per message, from a single goroutine.  Verdicts are dropped rather than
+// queued without bound while redis is slow or down.
+type verdictPublisher struct {
+	client  *redisClient
+	channel string
+	events  chan []byte
+}
+
+const publishQueueSize = 1024
+
+var publisher *verdictPublisher
+
+func newVerdictPublisher(rawurl string, channel string) (*verdictPublisher, error) {
+	client, err := newRedisClient(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	return &verdictPublisher{
+		client:  client,
+		channel: channel,
+		events:  make(chan []byte, publishQueueSize),
+	}, nil
+}
+
+func (p *verdictPublisher) publish(v verdict) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+
+	select {
+	case p.events <- data:
+	default:
+		metricInc("publish.dropped")
+	}
+}
+
+func (p *verdictPublisher) run() {
+	for data := range p.events {
+		if _, err := p.client.Do("PUBLISH", p.channel, string(data)); err != nil {
+			metricInc("publish.errors")
+			log.Printf("publish err: %s", err)
+			continue
+		}
+		metricInc("publish.events")
+	}
+}
@@ -0,0 +1,437 @@
+//
+// Copyright (c) 2019 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The quarantine is laid out like a maildir: messages are written to tmp/
+// and moved to new/ once complete, so that a partial message is never
+// seen, and their metadata is kept in meta/ under the same name.
+//
+// So that the size cap is enforced without reading every metadata file
+// on each message, the filter keeps an index of the quarantined messages,
+// oldest first, which is only reloaded from the disk every
+// quarantineSyncInterval, to account for messages released meanwhile.
+type quarantine struct {
+	sync.Mutex
+	dir     string
+	maxSize int64
+	maxAge  time.Duration
+
+	index []quarantineEntry
+	total int64
+}
+
+type quarantineEntry struct {
+	id   string
+	size int64
+	time time.Time
+}
+
+const quarantineSyncInterval = 10 * time.Minute
+
+type quarantineMeta struct {
+	Id   string `json:"id"`
+	Size int64  `json:"size"`
+	verdict
+}
+
+var quarantined *quarantine
+
+func openQuarantine(dir string, maxSize int64, maxAge time.Duration) (*quarantine, error) {
+	for _, sub := range []string{"tmp", "new", "meta"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0700); err != nil {
+			return nil, err
+		}
+	}
+	q := &quarantine{dir: dir, maxSize: maxSize, maxAge: maxAge}
+	if err := q.sync(); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// sync reloads the index from the disk.
+func (q *quarantine) sync() error {
+	metas, err := q.list()
+	if err != nil {
+		return err
+	}
+
+	index := make([]quarantineEntry, 0, len(metas))
+	var total int64
+	for _, meta := range metas {
+		index = append(index, quarantineEntry{id: meta.Id, size: meta.Size, time: meta.Time})
+		total += meta.Size
+	}
+
+	q.Lock()
+	q.index, q.total = index, total
+	q.Unlock()
+	return nil
+}
+
+// maintain prunes the quarantine and reloads its index every interval, so
+// that old messages go even when no new one comes in.
+func (q *quarantine) maintain(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := q.sync(); err != nil {
+			log.Printf("quarantine sync err: %s", err)
+			continue
+		}
+		q.Lock()
+		q.prune(time.Now())
+		q.Unlock()
+	}
+}
+
+func (q *quarantine) messagePath(id string) string {
+	return filepath.Join(q.dir, "new", id)
+}
+
+func (q *quarantine) metaPath(id string) string {
+	return filepath.Join(q.dir, "meta", id+".json")
+}
+
+// writeFile writes data to tmp/ before moving it to path.
+func (q *quarantine) writeFile(path string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Join(q.dir, "tmp"), ".quarantine")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// errQuarantineTooLarge is returned for messages larger than the size cap
+// of the quarantine, which would only be pruned at once along with every
+// other message.
+var errQuarantineTooLarge = errors.New("message larger than the quarantine")
+
+// add stores a message and its verdict, and returns its quarantine id.
+func (q *quarantine) add(message []string, v verdict) (string, error) {
+	// Ids sort in the order messages were quarantined.
+	id := fmt.Sprintf("%d.%s", v.Time.UnixNano(), v.QueueId)
+
+	var data []byte
+	for _, line := range message {
+		data = append(data, line...)
+		data = append(data, '\n')
+	}
+	if q.maxSize != 0 && int64(len(data)) > q.maxSize {
+		return "", errQuarantineTooLarge
+	}
+
+	meta, err := json.Marshal(quarantineMeta{Id: id, Size: int64(len(data)), verdict: v})
+	if err != nil {
+		return "", err
+	}
+
+	q.Lock()
+	defer q.Unlock()
+
+	if err := q.writeFile(q.messagePath(id), data); err != nil {
+		return "", err
+	}
+	if err := q.writeFile(q.metaPath(id), meta); err != nil {
+		os.Remove(q.messagePath(id))
+		return "", err
+	}
+
+	q.index = append(q.index, quarantineEntry{id: id, size: int64(len(data)), time: v.Time})
+	q.total += int64(len(data))
+	q.prune(time.Now())
+	return id, nil
+}
+
+// list returns the metadata of the quarantined messages, oldest first.
+func (q *quarantine) list() ([]quarantineMeta, error) {
+	files, err := ioutil.ReadDir(filepath.Join(q.dir, "meta"))
+	if err != nil {
+		return nil, err
+	}
+
+	metas := make([]quarantineMeta, 0, len(files))
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+		meta, err := q.meta(strings.TrimSuffix(f.Name(), ".json"))
+		if err != nil {
+			return nil, err
+		}
+		metas = append(metas, meta)
+	}
+	sort.Slice(metas, func(i, j int) bool {
+		return metas[i].Time.Before(metas[j].Time)
+	})
+	return metas, nil
+}
+
+func (q *quarantine) meta(id string) (quarantineMeta, error) {
+	var meta quarantineMeta
+
+	if id == "" || strings.ContainsAny(id, "/\\") || strings.HasPrefix(id, ".") {
+		return meta, fmt.Errorf("invalid quarantine id: %s", id)
+	}
+
+	data, err := ioutil.ReadFile(q.metaPath(id))
+	if err != nil {
+		return meta, err
+	}
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return meta, fmt.Errorf("%s: %s", q.metaPath(id), err)
+	}
+	return meta, nil
+}
+
+func (q *quarantine) remove(id string) error {
+	if err := os.Remove(q.messagePath(id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.Remove(q.metaPath(id))
+}
+
+// prune removes the messages which are too old, then the oldest ones
+// until the quarantine fits in its size cap.  It is called with the lock
+// held, and only reads the index.
+func (q *quarantine) prune(now time.Time) {
+	if q.maxSize == 0 && q.maxAge == 0 {
+		return
+	}
+
+	pruned := 0
+	for _, entry := range q.index {
+		tooOld := q.maxAge != 0 && now.Sub(entry.time) > q.maxAge
+		tooBig := q.maxSize != 0 && q.total > q.maxSize
+		if !tooOld && !tooBig {
+			break
+		}
+		if err := q.remove(entry.id); err != nil && !os.IsNotExist(err) {
+			log.Printf("quarantine remove '%s' err: %s", entry.id, err)
+		}
+		q.total -= entry.size
+		pruned++
+	}
+	q.index = q.index[pruned:]
+}
+
+// quarantineMessage keeps the message of the current transaction if the
+// quarantine is enabled.
+func quarantineMessage(s *session, action string) {
+	if quarantined == nil {
+		return
+	}
+
+	id, err := quarantined.add(s.tx.msg.Lines(), newVerdict(s, action))
+	if err == errQuarantineTooLarge {
+		metricInc("quarantine.too_large")
+	}
+	if err != nil {
+		log.Printf("%s: message %s could not be quarantined: %s", s.logID(), s.tx.msgid, err)
+		return
+	}
+	metricInc("quarantine.added")
+	log.Printf("%s: message %s quarantined as %s", s.logID(), s.tx.msgid, id)
+}
+
+// release re-injects a quarantined message to its original recipients and
+// removes it from the quarantine.
+func (q *quarantine) release(id string, sendmail string) error {
+	meta, err := q.meta(id)
+	if err != nil {
+		return err
+	}
+
+	data, err := ioutil.ReadFile(q.messagePath(id))
+	if err != nil {
+		return err
+	}
+
+	from := meta.From
+	if from == "" {
+		from = "<>"
+	}
+	args := append([]string{"-f", from, "--"}, meta.Rcpts...)
+
+	cmd := exec.Command(sendmail, args...)
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s: %s", sendmail, err)
+	}
+
+	return q.remove(id)
+}
+
+// rescan scans a quarantined message again with the current rules of
+// rspamd, as if it was received again from the same client, and returns
+// the session it was scanned in along with the result answered to smtpd.
+// The rescan takes over the output of the filter to read that result, so
+// it only runs in the process of the quarantine command, never in a
+// running filter through its control socket.
+func (q *quarantine) rescan(meta quarantineMeta) (*session, string, error) {
+	f, err := os.Open(q.messagePath(meta.Id))
+	if err != nil {
+		return nil, "", err
+	}
+	defer f.Close()
+
+	s := &session{
+		id:       "rescan",
+		src:      meta.Src,
+		heloName: meta.Helo,
+		userName: meta.User,
+	}
+	s.tx.msgid = meta.QueueId
+	s.tx.scanID = newScanID()
+	s.tx.mailFrom = meta.From
+	s.tx.rcptTo = meta.Rcpts
+
+	result, _, err := scanMessage(s, f)
+	if err != nil {
+		return nil, "", err
+	}
+	return s, result, nil
+}
+
+// symbolsDiff returns the symbols of after which are not in before.
+func symbolsDiff(after []string, before []string) []string {
+	seen := make(map[string]bool, len(before))
+	for _, symbol := range before {
+		seen[symbol] = true
+	}
+	diff := []string{}
+	for _, symbol := range after {
+		if !seen[symbol] {
+			diff = append(diff, symbol)
+		}
+	}
+	sort.Strings(diff)
+	return diff
+}
+
+// rescanCommand rescans a quarantined message and shows its new verdict
+// along with the original one.  With release, the message is released if
+// it would now be accepted.
+func rescanCommand(q *quarantine, id string, release bool) error {
+	meta, err := q.meta(id)
+	if err != nil {
+		return err
+	}
+	s, result, err := q.rescan(meta)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%-8s %-24s %s\n", "", "original", "rescan")
+	fmt.Printf("%-8s %-24s %s\n", "action", meta.Action, s.tx.verdict)
+	fmt.Printf("%-8s %-24s %s\n", "score",
+		fmt.Sprintf("%.2f/%.2f", meta.Score, meta.Required),
+		fmt.Sprintf("%.2f/%.2f", s.tx.score, s.tx.requiredScore))
+	fmt.Printf("symbols added: %s\n", strings.Join(symbolsDiff(s.tx.symbols, meta.Symbols), ", "))
+	fmt.Printf("symbols removed: %s\n", strings.Join(symbolsDiff(meta.Symbols, s.tx.symbols), ", "))
+	fmt.Printf("result: %s\n", result)
+
+	if !release {
+		return nil
+	}
+	if result != "proceed" && result != "junk" {
+		return fmt.Errorf("%s still not accepted, not released", id)
+	}
+	if err := q.release(id, *sendmail); err != nil {
+		return err
+	}
+	fmt.Printf("%s released\n", id)
+	return nil
+}
+
+func quarantineCommand(args []string) error {
+	if *quarantineDir == "" {
+		return fmt.Errorf("no quarantine directory")
+	}
+	q := &quarantine{dir: *quarantineDir}
+
+	switch {
+	case len(args) == 1 && args[0] == "list":
+		metas, err := q.list()
+		if err != nil {
+			return err
+		}
+		for _, meta := range metas {
+			fmt.Printf("%s\t%s\t%s\t%.2f/%.2f\t%s\t%s\n", meta.Id,
+				meta.Time.Format(time.RFC3339), meta.Action, meta.Score,
+				meta.Required, meta.From, strings.Join(meta.Rcpts, ","))
+		}
+		return nil
+
+	case len(args) == 2 && args[0] == "show":
+		meta, err := q.meta(args[1])
+		if err != nil {
+			return err
+		}
+		data, err := ioutil.ReadFile(q.messagePath(args[1]))
+		if err != nil {
+			return err
+		}
+		out, err := json.MarshalIndent(meta, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s\n\n%s", out, data)
+		return nil
+
+	case len(args) == 2 && args[0] == "release":
+		if err := q.release(args[1], *sendmail); err != nil {
+			return err
+		}
+		fmt.Printf("%s released\n", args[1])
+		return nil
+
+	case len(args) == 2 && args[0] == "rescan":
+		return rescanCommand(q, args[1], false)
+
+	case len(args) == 3 && args[0] == "rescan" && args[1] == "-release":
+		return rescanCommand(q, args[2], true)
+
+	default:
+		return fmt.Errorf("usage: quarantine list | show id | release id | rescan [-release] id")
+	}
+}
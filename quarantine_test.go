@@ -0,0 +1,239 @@
+//
+// Copyright (c) 2019 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// quarantineVerdict returns the verdict of a message quarantined at t.
+func quarantineVerdict(queueId string, t time.Time) verdict {
+	return verdict{
+		Time:    t,
+		QueueId: queueId,
+		Src:     "198.51.100.1:1234",
+		From:    "sender@example.org",
+		Rcpts:   []string{"rcpt1@example.net", "rcpt2@example.net"},
+		Action:  "reject",
+		Symbols: []string{"TEST_SYMBOL"},
+	}
+}
+
+// quarantineIds returns the ids of the quarantined messages, oldest first.
+func quarantineIds(t *testing.T, q *quarantine) []string {
+	metas, err := q.list()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := []string{}
+	for _, meta := range metas {
+		ids = append(ids, meta.Id)
+	}
+	return ids
+}
+
+// message100 is a message of 100 bytes once quarantined.
+var message100 = []string{"Subject: hello", "", strings.Repeat("x", 83)}
+
+func TestQuarantineAdd(t *testing.T) {
+	dir := t.TempDir()
+	q, err := openQuarantine(dir, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v := quarantineVerdict("0000000a", time.Now())
+	id, err := q.add(message100, v)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "new", id))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != strings.Join(message100, "\n")+"\n" {
+		t.Errorf("message: got %q", data)
+	}
+
+	meta, err := q.meta(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Id != id || meta.Size != 100 || meta.QueueId != v.QueueId ||
+		meta.From != v.From || !reflect.DeepEqual(meta.Rcpts, v.Rcpts) {
+		t.Errorf("meta: got %+v", meta)
+	}
+
+	files, err := ioutil.ReadDir(filepath.Join(dir, "tmp"))
+	if err != nil || len(files) != 0 {
+		t.Errorf("tmp/ not empty: %v %v", files, err)
+	}
+
+	// the index is rebuilt from the disk
+	q, err = openQuarantine(dir, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(q.index) != 1 || q.index[0].id != id || q.total != 100 {
+		t.Errorf("index: got %+v, total %d", q.index, q.total)
+	}
+
+	if _, err := q.meta("../meta/" + id); err == nil {
+		t.Error("id outside of the quarantine accepted")
+	}
+}
+
+func TestQuarantinePruneSize(t *testing.T) {
+	q, err := openQuarantine(t.TempDir(), 250, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	var ids []string
+	for i, queueId := range []string{"0000000a", "0000000b", "0000000c"} {
+		id, err := q.add(message100, quarantineVerdict(queueId, now.Add(time.Duration(i)*time.Second)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+
+	// the oldest message goes to make room for the new one
+	if got := quarantineIds(t, q); !reflect.DeepEqual(got, ids[1:]) {
+		t.Errorf("got %v, want %v", got, ids[1:])
+	}
+	if q.total != 200 {
+		t.Errorf("total: got %d, want 200", q.total)
+	}
+	if _, err := os.Stat(q.messagePath(ids[0])); !os.IsNotExist(err) {
+		t.Errorf("pruned message still there: %v", err)
+	}
+}
+
+func TestQuarantineTooLarge(t *testing.T) {
+	q, err := openQuarantine(t.TempDir(), 150, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := q.add(message100, quarantineVerdict("0000000a", time.Now()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a message larger than the cap is skipped, rather than emptying
+	// the quarantine
+	large := append(message100, strings.Repeat("x", 99))
+	if _, err := q.add(large, quarantineVerdict("0000000b", time.Now())); err != errQuarantineTooLarge {
+		t.Errorf("got error %v, want %v", err, errQuarantineTooLarge)
+	}
+	if got := quarantineIds(t, q); !reflect.DeepEqual(got, []string{id}) {
+		t.Errorf("got %v, want [%s]", got, id)
+	}
+	files, err := ioutil.ReadDir(filepath.Join(q.dir, "new"))
+	if err != nil || len(files) != 1 {
+		t.Errorf("new/: got %d files, want 1 (%v)", len(files), err)
+	}
+}
+
+func TestQuarantinePruneAge(t *testing.T) {
+	q, err := openQuarantine(t.TempDir(), 0, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	old, err := q.add(message100, quarantineVerdict("0000000a", now.Add(-50*time.Minute)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	recent, err := q.add(message100, quarantineVerdict("0000000b", now))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q.prune(now.Add(30 * time.Minute))
+	if got := quarantineIds(t, q); !reflect.DeepEqual(got, []string{recent}) {
+		t.Errorf("got %v, want [%s] without %s", got, recent, old)
+	}
+	if q.total != 100 {
+		t.Errorf("total: got %d, want 100", q.total)
+	}
+}
+
+func TestQuarantineRelease(t *testing.T) {
+	dir := t.TempDir()
+	q, err := openQuarantine(filepath.Join(dir, "quarantine"), 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the fake sendmail keeps its arguments and the message it is given
+	sendmail := filepath.Join(dir, "sendmail")
+	script := "#!/bin/sh\necho \"$@\" > " + dir + "/args\ncat > " + dir + "/message\n"
+	if err := ioutil.WriteFile(sendmail, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	v := quarantineVerdict("0000000a", time.Now())
+	v.From = ""
+	id, err := q.add(message100, v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := q.release(id, sendmail); err != nil {
+		t.Fatal(err)
+	}
+
+	args, err := ioutil.ReadFile(filepath.Join(dir, "args"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "-f <> -- rcpt1@example.net rcpt2@example.net\n"; string(args) != want {
+		t.Errorf("args: got %q, want %q", args, want)
+	}
+	message, err := ioutil.ReadFile(filepath.Join(dir, "message"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(message) != strings.Join(message100, "\n")+"\n" {
+		t.Errorf("message: got %q", message)
+	}
+	if got := quarantineIds(t, q); len(got) != 0 {
+		t.Errorf("released message still quarantined: %v", got)
+	}
+
+	// a failed release keeps the message
+	id, err = q.add(message100, quarantineVerdict("0000000b", time.Now()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := q.release(id, "/nonexistent/sendmail"); err == nil {
+		t.Error("release with a missing sendmail succeeded")
+	}
+	if got := quarantineIds(t, q); !reflect.DeepEqual(got, []string{id}) {
+		t.Errorf("got %v, want [%s]", got, id)
+	}
+}
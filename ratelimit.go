@@ -0,0 +1,84 @@
+//
+// Copyright (c) 2019 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// rateLimiter counts the transactions of every client address over a
+// sliding window, keeping the time of those which were allowed.
+type rateLimiter struct {
+	sync.Mutex
+	limit   int
+	window  time.Duration
+	clients map[string][]time.Time
+}
+
+var limiter *rateLimiter
+
+func newRateLimiter(limit int, window time.Duration) *rateLimiter {
+	return &rateLimiter{
+		limit:   limit,
+		window:  window,
+		clients: make(map[string][]time.Time),
+	}
+}
+
+// prune drops the times which fell out of the window.
+func (l *rateLimiter) prune(times []time.Time, now time.Time) []time.Time {
+	i := 0
+	for i < len(times) && now.Sub(times[i]) >= l.window {
+		i++
+	}
+	return times[i:]
+}
+
+// allow returns whether a new transaction of ip is within the limit, and
+// counts it if so.
+func (l *rateLimiter) allow(ip string) bool {
+	now := time.Now()
+
+	l.Lock()
+	defer l.Unlock()
+
+	times := l.prune(l.clients[ip], now)
+	if len(times) >= l.limit {
+		l.clients[ip] = times
+		return false
+	}
+	l.clients[ip] = append(times, now)
+	return true
+}
+
+// expire forgets the addresses with no transaction in the window, as they
+// would otherwise accumulate for as long as the filter runs.
+func (l *rateLimiter) expire() {
+	for range time.Tick(l.window) {
+		now := time.Now()
+		l.Lock()
+		for ip, times := range l.clients {
+			if times = l.prune(times, now); len(times) == 0 {
+				delete(l.clients, ip)
+			} else {
+				l.clients[ip] = times
+			}
+		}
+		l.Unlock()
+	}
+}
@@ -0,0 +1,151 @@
+//
+// Copyright (c) 2019 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+)
+
+// The settings of rspamd may differ for every mailbox, while a message
+// sent to several recipients gets a single verdict.  Each of them may
+// also have the message scanned for them alone, and the verdicts are
+// reported in X-Spam-Recipient headers.
+
+type recipientVerdict struct {
+	rcpt string
+	rr   *rspamd
+}
+
+// recipientScans scans the message for each of its first -recipient-scans
+// recipients alone.  The verdicts are delivered on the returned channel,
+// in the order of the recipients, without those whose scan failed.
+func recipientScans(ctx context.Context, s *session, body string, settingsId string) <-chan []recipientVerdict {
+	rcpts := scannedRcpts(s)
+	if len(rcpts) > *recipientScanCount {
+		rcpts = rcpts[:*recipientScanCount]
+	}
+
+	// the requests capture the session now, it may be gone by the time
+	// rspamd answers
+	id, msgid := s.logID(), s.tx.msgid
+	backends := make([]*backend, len(rcpts))
+	requests := make([]*http.Request, len(rcpts))
+	for i, rcpt := range rcpts {
+		b := pickBackend(clientIP(s.src))
+		if b == nil {
+			continue
+		}
+		req, err := checkRequest(ctx, b, s, body, settingsId)
+		if err != nil {
+			// the backend may have been picked for the probe of its
+			// circuit breaker, which must be reported
+			b.failure()
+			log.Printf("%s: message %s scan for %s failed: %s", id, msgid, rcpt, err)
+			continue
+		}
+		req.Header.Del("Rcpt")
+		req.Header.Add("Rcpt", requestHeaderValue(rcpt))
+		req.Header.Add("Deliver-To", requestHeaderValue(rcpt))
+		backends[i], requests[i] = b, req
+	}
+
+	result := make(chan []recipientVerdict, 1)
+	go func() {
+		verdicts := make([]recipientVerdict, len(rcpts))
+
+		var wg sync.WaitGroup
+		for i := range requests {
+			if requests[i] == nil {
+				metricInc("recipients.errors")
+				continue
+			}
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+
+				rr, err := recipientCheck(backends[i], requests[i])
+				if err != nil {
+					metricInc("recipients.errors")
+					log.Printf("%s: message %s scan for %s failed: %s", id, msgid, rcpts[i], err)
+					return
+				}
+				metricInc("recipients.scans")
+				verdicts[i] = recipientVerdict{rcpt: rcpts[i], rr: rr}
+			}(i)
+		}
+		wg.Wait()
+
+		scanned := []recipientVerdict{}
+		for _, v := range verdicts {
+			if v.rr != nil {
+				scanned = append(scanned, v)
+			}
+		}
+		result <- scanned
+	}()
+	return result
+}
+
+func recipientCheck(b *backend, req *http.Request) (*rspamd, error) {
+	resp, err := b.client().Do(req)
+	if err != nil {
+		b.failure()
+		return nil, err
+	}
+	defer closeResponse(resp)
+
+	if resp.StatusCode >= 500 {
+		b.failure()
+	} else {
+		b.success()
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+
+	body, err := responseBody(resp)
+	if err != nil {
+		return nil, err
+	}
+
+	rr := &rspamd{}
+	if err := json.NewDecoder(body).Decode(rr); err != nil {
+		return nil, err
+	}
+	return rr, nil
+}
+
+// writeRecipientHeaders writes the verdicts of the recipient scans, once
+// they are all known.
+func writeRecipientHeaders(ctx context.Context, s *session, result <-chan []recipientVerdict) {
+	select {
+	case verdicts := <-result:
+		for _, v := range verdicts {
+			writeFilterHeader(s, "X-Spam-Recipient", fmt.Sprintf("%s; action=%s; score=%.2f/%.2f",
+				v.rcpt, v.rr.Action, v.rr.Score, v.rr.RequiredScore))
+		}
+	case <-ctx.Done():
+		metricInc("recipients.errors")
+		log.Printf("%s: message %s scans for recipients timed out", s.logID(), s.tx.msgid)
+	}
+}
@@ -0,0 +1,65 @@
+//
+// Copyright (c) 2019 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+var rejectLogMu sync.Mutex
+
+// rejected records a rejection in the -reject-log, and in the count of
+// rejects of the client kept for the tarpit.
+func rejected(id string, ip string, reason string) {
+	logReject(id, ip, reason)
+	countReject(ip)
+}
+
+// logReject appends a line to the -reject-log file for every rejection, in
+// a stable format meant to be matched by fail2ban or blocklistd:
+//
+//	2019-11-20T10:04:05Z reject ip=192.0.2.1 reason=spam session=1a2b3c4d5e6f7a8b
+//
+// The file is opened for every line so that it may be rotated at any time.
+func logReject(id string, ip string, reason string) {
+	// there is nothing to block without an address
+	if *rejectLog == "" || ip == "" {
+		return
+	}
+
+	line := fmt.Sprintf("%s reject ip=%s reason=%s session=%s\n",
+		time.Now().UTC().Format(time.RFC3339), ip, reason, id)
+
+	rejectLogMu.Lock()
+	defer rejectLogMu.Unlock()
+
+	f, err := os.OpenFile(*rejectLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err == nil {
+		_, err = f.WriteString(line)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		metricInc("rejectlog.errors")
+		log.Printf("reject log '%s' err: %s", *rejectLog, err)
+	}
+}
@@ -0,0 +1,93 @@
+//
+// Copyright (c) 2019 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+)
+
+// The resolver of Go reads /etc/resolv.conf, which chroots and some
+// containers lack or keep elsewhere.  With -resolver, names are resolved
+// through the name server given instead, or the first one listed by the
+// resolv.conf file given.
+
+// resolverConf returns the path of the resolv.conf file named by
+// -resolver, if any.
+func resolverConf() string {
+	if strings.HasPrefix(*resolverSpec, "/") {
+		return *resolverSpec
+	}
+	return ""
+}
+
+// nameServer returns the address of the name server of -resolver, port 53
+// unless one is given.  A resolv.conf file is read each time, so that
+// changes are picked up.
+func nameServer() (string, error) {
+	server := *resolverSpec
+	if path := resolverConf(); path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return "", err
+		}
+
+		server = ""
+		for _, line := range strings.Split(string(data), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) >= 2 && fields[0] == "nameserver" {
+				server = fields[1]
+				break
+			}
+		}
+		if server == "" {
+			return "", fmt.Errorf("no nameserver in %s", path)
+		}
+	}
+
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "53")
+	}
+	return server, nil
+}
+
+// setupResolver makes the name server of -resolver, if any, the one every
+// lookup goes through.
+func setupResolver() error {
+	if *resolverSpec == "" {
+		return nil
+	}
+	if _, err := nameServer(); err != nil {
+		return err
+	}
+
+	net.DefaultResolver = &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network string, _ string) (net.Conn, error) {
+			server, err := nameServer()
+			if err != nil {
+				return nil, err
+			}
+			var d net.Dialer
+			return d.DialContext(ctx, network, server)
+		},
+	}
+	return nil
+}
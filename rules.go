@@ -0,0 +1,528 @@
+//
+// Copyright (c) 2019 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+/**
+ * Rules are read from the -rules file, one per line:
+ *
+ *	symbols contains "FORGED_SENDER" && !authenticated -> reject
+ *	score > 5 && from matches "@example\\.org$" -> header X-Local-Policy: suspicious
+ *
+ * The condition is an expression over the verdict and the session, typed
+ * when the file is loaded so that evaluation cannot fail.  The first
+ * matching rule with an action overrides the action of rspamd; the headers
+ * of all matching rules are added to the message.
+ */
+
+type ruleType int
+
+const (
+	ruleBool ruleType = iota
+	ruleNumber
+	ruleString
+	ruleList
+)
+
+func (t ruleType) String() string {
+	switch t {
+	case ruleBool:
+		return "boolean"
+	case ruleNumber:
+		return "number"
+	case ruleString:
+		return "string"
+	}
+	return "list"
+}
+
+// ruleEnv holds the values a rule condition is evaluated against.
+type ruleEnv struct {
+	score         float64
+	required      float64
+	action        string
+	symbols       []string
+	from          string
+	rcpts         []string
+	helo          string
+	hostname      string
+	ip            string
+	user          string
+	authenticated bool
+}
+
+func newRuleEnv(s *session, rr *rspamd) *ruleEnv {
+	return &ruleEnv{
+		score:         float64(rr.Score),
+		required:      float64(rr.RequiredScore),
+		action:        rr.Action,
+		symbols:       s.tx.symbols,
+		from:          s.tx.mailFrom,
+		rcpts:         s.tx.rcptTo,
+		helo:          s.heloName,
+		hostname:      s.hostname(),
+		ip:            requestIP(s.src),
+		user:          s.userName,
+		authenticated: s.userName != "",
+	}
+}
+
+var ruleVariables = map[string]struct {
+	typ ruleType
+	get func(e *ruleEnv) interface{}
+}{
+	"score":         {ruleNumber, func(e *ruleEnv) interface{} { return e.score }},
+	"required":      {ruleNumber, func(e *ruleEnv) interface{} { return e.required }},
+	"action":        {ruleString, func(e *ruleEnv) interface{} { return e.action }},
+	"symbols":       {ruleList, func(e *ruleEnv) interface{} { return e.symbols }},
+	"from":          {ruleString, func(e *ruleEnv) interface{} { return e.from }},
+	"rcpts":         {ruleList, func(e *ruleEnv) interface{} { return e.rcpts }},
+	"helo":          {ruleString, func(e *ruleEnv) interface{} { return e.helo }},
+	"hostname":      {ruleString, func(e *ruleEnv) interface{} { return e.hostname }},
+	"ip":            {ruleString, func(e *ruleEnv) interface{} { return e.ip }},
+	"user":          {ruleString, func(e *ruleEnv) interface{} { return e.user }},
+	"authenticated": {ruleBool, func(e *ruleEnv) interface{} { return e.authenticated }},
+	"correspondent": {ruleBool, func(e *ruleEnv) interface{} { return isCorrespondent(e.from) }},
+}
+
+type ruleExpr interface {
+	typ() ruleType
+	eval(e *ruleEnv) interface{}
+}
+
+type ruleLiteral struct {
+	t ruleType
+	v interface{}
+}
+
+func (x ruleLiteral) typ() ruleType               { return x.t }
+func (x ruleLiteral) eval(e *ruleEnv) interface{} { return x.v }
+
+type ruleVariable struct {
+	t   ruleType
+	get func(e *ruleEnv) interface{}
+}
+
+func (x ruleVariable) typ() ruleType               { return x.t }
+func (x ruleVariable) eval(e *ruleEnv) interface{} { return x.get(e) }
+
+type ruleNot struct {
+	x ruleExpr
+}
+
+func (x ruleNot) typ() ruleType               { return ruleBool }
+func (x ruleNot) eval(e *ruleEnv) interface{} { return !x.x.eval(e).(bool) }
+
+type ruleLogical struct {
+	op   string
+	x, y ruleExpr
+}
+
+func (x ruleLogical) typ() ruleType { return ruleBool }
+func (x ruleLogical) eval(e *ruleEnv) interface{} {
+	if x.op == "&&" {
+		return x.x.eval(e).(bool) && x.y.eval(e).(bool)
+	}
+	return x.x.eval(e).(bool) || x.y.eval(e).(bool)
+}
+
+type ruleCompare struct {
+	op   string
+	x, y ruleExpr
+}
+
+func (x ruleCompare) typ() ruleType { return ruleBool }
+func (x ruleCompare) eval(e *ruleEnv) interface{} {
+	a, b := x.x.eval(e), x.y.eval(e)
+	switch x.op {
+	case "==":
+		return a == b
+	case "!=":
+		return a != b
+	case "<":
+		return a.(float64) < b.(float64)
+	case "<=":
+		return a.(float64) <= b.(float64)
+	case ">":
+		return a.(float64) > b.(float64)
+	}
+	return a.(float64) >= b.(float64)
+}
+
+type ruleContains struct {
+	x, y ruleExpr
+}
+
+func (x ruleContains) typ() ruleType { return ruleBool }
+func (x ruleContains) eval(e *ruleEnv) interface{} {
+	needle := x.y.eval(e).(string)
+	if x.x.typ() == ruleString {
+		return strings.Contains(x.x.eval(e).(string), needle)
+	}
+	for _, v := range x.x.eval(e).([]string) {
+		if v == needle {
+			return true
+		}
+	}
+	return false
+}
+
+type ruleMatches struct {
+	x  ruleExpr
+	re *regexp.Regexp
+}
+
+func (x ruleMatches) typ() ruleType { return ruleBool }
+func (x ruleMatches) eval(e *ruleEnv) interface{} {
+	if x.x.typ() == ruleString {
+		return x.re.MatchString(x.x.eval(e).(string))
+	}
+	for _, v := range x.x.eval(e).([]string) {
+		if x.re.MatchString(v) {
+			return true
+		}
+	}
+	return false
+}
+
+type ruleToken struct {
+	kind byte // 'i'dentifier, 'n'umber, 's'tring, 'o'perator or 0 at the end
+	text string
+}
+
+var ruleOperators = []string{"->", "&&", "||", "==", "!=", "<=", ">=", "<", ">", "!", "(", ")"}
+
+// lexRule splits the condition of a rule into tokens, and returns them
+// along with what follows the arrow.
+func lexRule(line string) ([]ruleToken, string, error) {
+	tokens := []ruleToken{}
+
+	i := 0
+next:
+	for i < len(line) {
+		c := line[i]
+		switch {
+		case c == ' ' || c == '\t':
+			i++
+
+		case c == '"':
+			j := i + 1
+			for j < len(line) && line[j] != '"' {
+				if line[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(line) {
+				return nil, "", fmt.Errorf("unterminated string")
+			}
+			s, err := strconv.Unquote(line[i : j+1])
+			if err != nil {
+				return nil, "", fmt.Errorf("invalid string %s", line[i:j+1])
+			}
+			tokens = append(tokens, ruleToken{'s', s})
+			i = j + 1
+
+		case c >= '0' && c <= '9' || c == '.':
+			j := i
+			for j < len(line) && (line[j] >= '0' && line[j] <= '9' || line[j] == '.') {
+				j++
+			}
+			tokens = append(tokens, ruleToken{'n', line[i:j]})
+			i = j
+
+		case c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_':
+			j := i
+			for j < len(line) && (line[j] >= 'a' && line[j] <= 'z' || line[j] >= 'A' && line[j] <= 'Z' || line[j] >= '0' && line[j] <= '9' || line[j] == '_') {
+				j++
+			}
+			tokens = append(tokens, ruleToken{'i', line[i:j]})
+			i = j
+
+		default:
+			for _, op := range ruleOperators {
+				if strings.HasPrefix(line[i:], op) {
+					if op == "->" {
+						return tokens, strings.TrimSpace(line[i+2:]), nil
+					}
+					tokens = append(tokens, ruleToken{'o', op})
+					i += len(op)
+					continue next
+				}
+			}
+			return nil, "", fmt.Errorf("unexpected character %q", c)
+		}
+	}
+	return nil, "", fmt.Errorf("missing ->")
+}
+
+type ruleParser struct {
+	tokens []ruleToken
+	pos    int
+}
+
+func (p *ruleParser) peek() ruleToken {
+	if p.pos == len(p.tokens) {
+		return ruleToken{}
+	}
+	return p.tokens[p.pos]
+}
+
+func (p *ruleParser) next() ruleToken {
+	t := p.peek()
+	if t.kind != 0 {
+		p.pos++
+	}
+	return t
+}
+
+func (p *ruleParser) parseLogical(op string, operand func() (ruleExpr, error)) (ruleExpr, error) {
+	x, err := operand()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == (ruleToken{'o', op}) {
+		p.next()
+		y, err := operand()
+		if err != nil {
+			return nil, err
+		}
+		if x.typ() != ruleBool || y.typ() != ruleBool {
+			return nil, fmt.Errorf("%s requires booleans", op)
+		}
+		x = ruleLogical{op, x, y}
+	}
+	return x, nil
+}
+
+func (p *ruleParser) parseOr() (ruleExpr, error) {
+	return p.parseLogical("||", p.parseAnd)
+}
+
+func (p *ruleParser) parseAnd() (ruleExpr, error) {
+	return p.parseLogical("&&", p.parseNot)
+}
+
+func (p *ruleParser) parseNot() (ruleExpr, error) {
+	if p.peek() != (ruleToken{'o', "!"}) {
+		return p.parseComparison()
+	}
+	p.next()
+	x, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	if x.typ() != ruleBool {
+		return nil, fmt.Errorf("! requires a boolean")
+	}
+	return ruleNot{x}, nil
+}
+
+func (p *ruleParser) parseComparison() (ruleExpr, error) {
+	x, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+
+	op := p.peek()
+	switch {
+	case op.kind == 'o' && (op.text == "==" || op.text == "!="):
+		p.next()
+		y, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		if x.typ() != y.typ() || x.typ() == ruleList {
+			return nil, fmt.Errorf("cannot compare %s and %s", x.typ(), y.typ())
+		}
+		return ruleCompare{op.text, x, y}, nil
+
+	case op.kind == 'o' && (op.text == "<" || op.text == "<=" || op.text == ">" || op.text == ">="):
+		p.next()
+		y, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		if x.typ() != ruleNumber || y.typ() != ruleNumber {
+			return nil, fmt.Errorf("%s requires numbers", op.text)
+		}
+		return ruleCompare{op.text, x, y}, nil
+
+	case op == ruleToken{'i', "contains"}:
+		p.next()
+		y, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		if (x.typ() != ruleString && x.typ() != ruleList) || y.typ() != ruleString {
+			return nil, fmt.Errorf("contains requires a string or a list, and a string")
+		}
+		return ruleContains{x, y}, nil
+
+	case op == ruleToken{'i', "matches"}:
+		p.next()
+		y := p.next()
+		if y.kind != 's' {
+			return nil, fmt.Errorf("matches requires a string literal")
+		}
+		if x.typ() != ruleString && x.typ() != ruleList {
+			return nil, fmt.Errorf("matches requires a string or a list")
+		}
+		re, err := regexp.Compile(y.text)
+		if err != nil {
+			return nil, err
+		}
+		return ruleMatches{x, re}, nil
+	}
+	return x, nil
+}
+
+func (p *ruleParser) parseOperand() (ruleExpr, error) {
+	t := p.next()
+	switch t.kind {
+	case 's':
+		return ruleLiteral{ruleString, t.text}, nil
+
+	case 'n':
+		v, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %s", t.text)
+		}
+		return ruleLiteral{ruleNumber, v}, nil
+
+	case 'i':
+		switch t.text {
+		case "true":
+			return ruleLiteral{ruleBool, true}, nil
+		case "false":
+			return ruleLiteral{ruleBool, false}, nil
+		}
+		v, ok := ruleVariables[t.text]
+		if !ok {
+			return nil, fmt.Errorf("unknown variable %s", t.text)
+		}
+		return ruleVariable{v.typ, v.get}, nil
+
+	case 'o':
+		if t.text == "(" {
+			x, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			if p.next() != (ruleToken{'o', ")"}) {
+				return nil, fmt.Errorf("missing )")
+			}
+			return x, nil
+		}
+		return nil, fmt.Errorf("unexpected %s", t.text)
+	}
+	return nil, fmt.Errorf("unexpected end of condition")
+}
+
+type rule struct {
+	cond        ruleExpr
+	action      string
+	headerName  string
+	headerValue string
+}
+
+var rules []rule
+
+func parseRule(line string) (rule, error) {
+	tokens, result, err := lexRule(line)
+	if err != nil {
+		return rule{}, err
+	}
+
+	p := &ruleParser{tokens: tokens}
+	cond, err := p.parseOr()
+	if err != nil {
+		return rule{}, err
+	}
+	if t := p.peek(); t.kind != 0 {
+		return rule{}, fmt.Errorf("unexpected %s", t.text)
+	}
+	if cond.typ() != ruleBool {
+		return rule{}, fmt.Errorf("condition is a %s, not a boolean", cond.typ())
+	}
+
+	r := rule{cond: cond}
+	if strings.HasPrefix(result, "header ") {
+		kv := strings.SplitN(strings.TrimPrefix(result, "header "), ":", 2)
+		if len(kv) != 2 || !validHeaderName(strings.TrimSpace(kv[0])) {
+			return rule{}, fmt.Errorf("invalid header: %s", result)
+		}
+		r.headerName = strings.TrimSpace(kv[0])
+		r.headerValue = strings.TrimSpace(kv[1])
+	} else if result == "accept" {
+		r.action = "no action"
+	} else if validAction(result) {
+		r.action = result
+	} else {
+		return rule{}, fmt.Errorf("invalid action: %s", result)
+	}
+	return r, nil
+}
+
+func loadRules(path string) ([]rule, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	rules := []rule{}
+	scanner := bufio.NewScanner(f)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		r, err := parseRule(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", lineno, err)
+		}
+		rules = append(rules, r)
+	}
+	return rules, scanner.Err()
+}
+
+// evalRules returns the action of the first matching rule, if any, and
+// the headers of all matching rules.
+func evalRules(e *ruleEnv) (string, [][2]string) {
+	action := ""
+	headers := [][2]string{}
+	for _, r := range rules {
+		if !r.cond.eval(e).(bool) {
+			continue
+		}
+		if r.headerName != "" {
+			headers = append(headers, [2]string{r.headerName, r.headerValue})
+		} else if action == "" {
+			action = r.action
+		}
+	}
+	return action, headers
+}
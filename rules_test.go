@@ -0,0 +1,227 @@
+//
+// Copyright (c) 2019 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var testRuleEnv = &ruleEnv{
+	score:    7.5,
+	required: 15,
+	action:   "add header",
+	symbols:  []string{"BAYES_SPAM", "FORGED_SENDER"},
+	from:     "joe@example.org",
+	rcpts:    []string{"a@example.net", "b@example.com"},
+	helo:     "mail.example.org",
+	hostname: "mail.example.org",
+	ip:       "192.0.2.1",
+}
+
+func TestParseRuleErrors(t *testing.T) {
+	tests := []struct {
+		rule string
+		err  string
+	}{
+		{`score > 5`, "missing ->"},
+		{`from == "joe -> reject`, "unterminated string"},
+		{`from == "\q" -> reject`, "invalid string"},
+		{`score > 5 $ -> reject`, "unexpected character"},
+		{`spam -> reject`, "unknown variable spam"},
+		{`(score > 5 -> reject`, "missing )"},
+		{`score > 5 score -> reject`, "unexpected score"},
+		{`score > -> reject`, "unexpected end of condition"},
+		{`score > 1.2.3 -> reject`, "invalid number 1.2.3"},
+		{`) -> reject`, "unexpected )"},
+		{`score > 5 -> junk`, "invalid action: junk"},
+		{`score > 5 -> header X Spam: yes`, "invalid header"},
+		{`score > 5 -> header X-Spam`, "invalid header"},
+		{`score -> reject`, "condition is a number, not a boolean"},
+		{`from matches from -> reject`, "matches requires a string literal"},
+		{`from matches "(" -> reject`, "missing closing )"},
+	}
+
+	for _, test := range tests {
+		_, err := parseRule(test.rule)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: got error %v, want %q", test.rule, err, test.err)
+		}
+	}
+}
+
+func TestParseRuleTypes(t *testing.T) {
+	tests := []struct {
+		cond string
+		err  string
+	}{
+		{`score == "5"`, "cannot compare number and string"},
+		{`symbols == "BAYES_SPAM"`, "cannot compare list and string"},
+		{`symbols == symbols`, "cannot compare list and list"},
+		{`from < 5`, "< requires numbers"},
+		{`score >= from`, ">= requires numbers"},
+		{`score && true`, "&& requires booleans"},
+		{`true || from`, "|| requires booleans"},
+		{`!score`, "! requires a boolean"},
+		{`score contains "5"`, "contains requires a string or a list, and a string"},
+		{`symbols contains 5`, "contains requires a string or a list, and a string"},
+		{`authenticated matches "yes"`, "matches requires a string or a list"},
+	}
+
+	for _, test := range tests {
+		_, err := parseRule(test.cond + " -> reject")
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: got error %v, want %q", test.cond, err, test.err)
+		}
+	}
+}
+
+func TestEvalRuleConditions(t *testing.T) {
+	tests := []struct {
+		cond string
+		want bool
+	}{
+		// && binds tighter than ||, and ! tighter than both
+		{`true || false && false`, true},
+		{`(true || false) && false`, false},
+		{`false && false || true`, true},
+		{`!false && false`, false},
+		{`!(false && false)`, true},
+		{`!!true`, true},
+
+		{`score > 5`, true},
+		{`score >= 7.5`, true},
+		{`score < 7.5`, false},
+		{`score <= required`, true},
+		{`score == 7.5 && required != 10`, true},
+		{`authenticated == false`, true},
+
+		{`action == "add header"`, true},
+		{`action != "reject"`, true},
+		{`from contains "@example.org"`, true},
+		{`from contains "@example.net"`, false},
+		{`symbols contains "FORGED_SENDER"`, true},
+		{`symbols contains "FORGED"`, false},
+		{`from matches "^joe@"`, true},
+		{`from matches "^JOE@"`, false},
+		{`from matches "(?i)^JOE@"`, true},
+		{`rcpts matches "@example\\.com$"`, true},
+		{`rcpts matches "@example\\.info$"`, false},
+		{`helo == "mail.example.org" && ip matches "^192\\.0\\.2\\."`, true},
+		{`user == "" && !authenticated`, true},
+	}
+
+	for _, test := range tests {
+		r, err := parseRule(test.cond + " -> reject")
+		if err != nil {
+			t.Errorf("%s: %s", test.cond, err)
+			continue
+		}
+		if got := r.cond.eval(testRuleEnv).(bool); got != test.want {
+			t.Errorf("%s: got %t, want %t", test.cond, got, test.want)
+		}
+	}
+}
+
+func TestEvalRules(t *testing.T) {
+	tests := []struct {
+		name    string
+		rules   []string
+		action  string
+		headers [][2]string
+	}{
+		{
+			"no match",
+			[]string{`score > 10 -> reject`},
+			"",
+			[][2]string{},
+		},
+		{
+			"first action wins",
+			[]string{
+				`score > 10 -> discard`,
+				`symbols contains "BAYES_SPAM" -> soft reject`,
+				`score > 5 -> reject`,
+			},
+			"soft reject",
+			[][2]string{},
+		},
+		{
+			"accept",
+			[]string{`from matches "@example\\.org$" -> accept`},
+			"no action",
+			[][2]string{},
+		},
+		{
+			"headers of every match",
+			[]string{
+				`score > 5 -> header X-Policy: suspect`,
+				`score > 10 -> header X-Policy: spam`,
+				`symbols contains "FORGED_SENDER" -> header X-Forged:   yes`,
+				`true -> rewrite subject`,
+			},
+			"rewrite subject",
+			[][2]string{{"X-Policy", "suspect"}, {"X-Forged", "yes"}},
+		},
+	}
+
+	saved := rules
+	t.Cleanup(func() { rules = saved })
+
+	for _, test := range tests {
+		rules = nil
+		for _, line := range test.rules {
+			r, err := parseRule(line)
+			if err != nil {
+				t.Fatalf("%s: %s: %s", test.name, line, err)
+			}
+			rules = append(rules, r)
+		}
+
+		action, headers := evalRules(testRuleEnv)
+		if action != test.action {
+			t.Errorf("%s: action: got %q, want %q", test.name, action, test.action)
+		}
+		if !reflect.DeepEqual(headers, test.headers) {
+			t.Errorf("%s: headers: got %q, want %q", test.name, headers, test.headers)
+		}
+	}
+}
+
+func TestLoadRules(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules")
+	data := "# local policy\n\nscore > 5 -> reject\n  \nscore > -> reject\n"
+	if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := loadRules(path)
+	if err == nil || !strings.HasPrefix(err.Error(), "line 5: ") {
+		t.Fatalf("got error %v, want one on line 5", err)
+	}
+
+	if err := ioutil.WriteFile(path, []byte(data[:strings.LastIndex(data, "score")]), 0600); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := loadRules(path)
+	if err != nil || len(loaded) != 1 || loaded[0].action != "reject" {
+		t.Fatalf("got %v, %v", loaded, err)
+	}
+}
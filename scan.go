@@ -0,0 +1,124 @@
+//
+// Copyright (c) 2019 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// scanCommand runs a message through the same pipeline as the filter, as
+// if it had been received by smtpd, and prints the result along with the
+// message as it would have been delivered.
+func scanCommand(args []string) error {
+	var rcpts listFlag
+
+	fs := flag.NewFlagSet("scan", flag.ContinueOnError)
+	from := fs.String("from", "", "envelope sender")
+	fs.Var(&rcpts, "rcpt", "envelope recipient, may be repeated")
+	ip := fs.String("ip", "127.0.0.1", "IP address of the client")
+	hostname := fs.String("hostname", "", "host name of the client")
+	helo := fs.String("helo", "", "HELO name of the client")
+	user := fs.String("user", "", "authenticated user")
+	operands, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(operands) != 1 {
+		return fmt.Errorf("usage: scan [-from address] [-rcpt address] [-ip address] [-hostname name] [-helo name] [-user user] file")
+	}
+
+	var r io.Reader = os.Stdin
+	if operands[0] != "-" {
+		f, err := os.Open(operands[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	src := *ip + ":0"
+	if strings.Contains(*ip, ":") {
+		src = "[" + *ip + "]:0"
+	}
+	s := &session{
+		id:       "scan",
+		rdns:     *hostname,
+		src:      src,
+		heloName: *helo,
+		userName: *user,
+	}
+	s.tx.scanID = newScanID()
+	s.tx.mailFrom = *from
+	s.tx.rcptTo = rcpts
+
+	result, message, err := scanMessage(s, r)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("result: %s\n", result)
+	fmt.Printf("score: %.2f / %.2f\n", s.tx.score, s.tx.requiredScore)
+	fmt.Printf("symbols: %s\n", strings.Join(s.tx.symbols, ", "))
+	fmt.Println()
+	for _, line := range message {
+		fmt.Println(line)
+	}
+	return nil
+}
+
+// scanMessage feeds the message read from r to the filter in session s,
+// and returns the result answered to smtpd along with the message as it
+// would have been delivered.
+func scanMessage(s *session, r io.Reader) (string, []string, error) {
+	version = "0.7"
+	outputChannel = make(chan string, 4096)
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSuffix(scanner.Text(), "\r")
+		// smtpd hands over dot-stuffed lines
+		if strings.HasPrefix(line, ".") {
+			line = "." + line
+		}
+		dataLine(s, []string{s.id, line})
+	}
+	if err := scanner.Err(); err != nil {
+		return "", nil, err
+	}
+	dataLine(s, []string{s.id, "."})
+
+	prefix := "filter-dataline|" + s.id + "|" + s.id + "|"
+	var message []string
+	for line := range outputChannel {
+		line = strings.TrimPrefix(line, prefix)
+		if line == "." {
+			break
+		}
+		message = append(message, strings.TrimPrefix(line, "."))
+	}
+
+	dataCommit(s, []string{s.id, "ok"})
+	result := strings.TrimPrefix(<-outputChannel, "filter-result|"+s.id+"|"+s.id+"|")
+	return result, message, nil
+}
@@ -0,0 +1,73 @@
+//
+// Copyright (c) 2019 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package main
+
+import "syscall"
+
+const (
+	auditArch = 0xc000003e // AUDIT_ARCH_X86_64
+
+	sysSeccomp = 317
+)
+
+// archSyscalls are the system calls allowed by each pledge promise which
+// only exist on some architectures, or which syscall does not define.
+var archSyscalls = map[string][]uintptr{
+	"stdio": {
+		syscall.SYS_ARCH_PRCTL, syscall.SYS_POLL, syscall.SYS_SELECT,
+		syscall.SYS_PIPE, syscall.SYS_DUP2, syscall.SYS_EPOLL_WAIT,
+		syscall.SYS_EPOLL_CREATE, syscall.SYS_TIME,
+		318, // getrandom
+		441, // epoll_pwait2
+		334, // rseq
+		435, // clone3
+	},
+	"rpath": {
+		syscall.SYS_OPEN, syscall.SYS_STAT, syscall.SYS_LSTAT,
+		syscall.SYS_NEWFSTATAT, syscall.SYS_ACCESS, syscall.SYS_READLINK,
+		syscall.SYS_GETDENTS,
+		332, // statx
+		439, // faccessat2
+	},
+	"wpath": {
+		syscall.SYS_OPEN,
+	},
+	"cpath": {
+		syscall.SYS_OPEN, syscall.SYS_CREAT, syscall.SYS_MKDIR,
+		syscall.SYS_RMDIR, syscall.SYS_UNLINK, syscall.SYS_RENAME,
+		syscall.SYS_LINK, syscall.SYS_SYMLINK,
+		316, // renameat2
+	},
+	"fattr": {
+		syscall.SYS_CHMOD, syscall.SYS_CHOWN, syscall.SYS_LCHOWN,
+	},
+	"inet": {
+		syscall.SYS_ACCEPT,
+	},
+	"unix": {
+		syscall.SYS_ACCEPT,
+	},
+	"dns": {
+		syscall.SYS_OPEN, syscall.SYS_STAT, syscall.SYS_NEWFSTATAT,
+		332, // statx
+	},
+	"proc": {
+		syscall.SYS_FORK, syscall.SYS_VFORK,
+		424, // pidfd_send_signal
+		434, // pidfd_open
+	},
+}
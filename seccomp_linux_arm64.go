@@ -0,0 +1,52 @@
+//
+// Copyright (c) 2019 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package main
+
+import "syscall"
+
+const (
+	auditArch = 0xc00000b7 // AUDIT_ARCH_AARCH64
+
+	sysSeccomp = syscall.SYS_SECCOMP
+)
+
+// archSyscalls are the system calls allowed by each pledge promise which
+// only exist on some architectures, or which syscall does not define.
+var archSyscalls = map[string][]uintptr{
+	"stdio": {
+		syscall.SYS_GETRANDOM,
+		441, // epoll_pwait2
+		293, // rseq
+		435, // clone3
+	},
+	"rpath": {
+		syscall.SYS_FSTATAT,
+		291, // statx
+		439, // faccessat2
+	},
+	"dns": {
+		syscall.SYS_FSTATAT,
+		291, // statx
+	},
+	"cpath": {
+		276, // renameat2
+	},
+	"proc": {
+		424, // pidfd_send_signal
+		434, // pidfd_open
+	},
+}
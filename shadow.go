@@ -0,0 +1,163 @@
+//
+// Copyright (c) 2019 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The shadow instance receives a copy of every scan, typically to test
+// new rules.  Its verdicts are compared to those of the primary instances,
+// disagreements are logged, and summed up in a periodic report.
+var shadow *backend
+
+// shadowStats are the comparisons since the last report.
+var shadowStats = struct {
+	sync.Mutex
+	compared int
+	actions  map[string]int
+	scores   int
+}{actions: make(map[string]int)}
+
+// shadowScan sends a copy of a scan to the shadow instance.  The verdict is
+// delivered on the returned channel, or nil if the scan failed.
+func shadowScan(s *session, body string, settingsId string, deadline time.Time) <-chan *rspamd {
+	result := make(chan *rspamd, 1)
+
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+
+	// the request captures the session now, it may be gone by the time
+	// the shadow instance answers
+	req, err := checkRequest(ctx, shadow, s, body, settingsId)
+	if err != nil {
+		cancel()
+		log.Printf("%s: message %s shadow scan failed: %s", s.logID(), s.tx.msgid, err)
+		result <- nil
+		return result
+	}
+	id, msgid := s.logID(), s.tx.msgid
+
+	go func() {
+		defer cancel()
+
+		rr, err := shadowCheck(req)
+		if err != nil {
+			metricInc("shadow.errors")
+			log.Printf("%s: message %s shadow scan failed: %s", id, msgid, err)
+		} else {
+			metricInc("shadow.scans")
+			log.Printf("%s: message %s shadow verdict: action=%s score=%.2f/%.2f",
+				id, msgid, rr.Action, rr.Score, rr.RequiredScore)
+		}
+		result <- rr
+	}()
+	return result
+}
+
+// shadowCompare compares the verdicts of the primary and shadow instances
+// once the latter is known.
+func shadowCompare(s *session, primary *rspamd, result <-chan *rspamd) {
+	id, msgid := s.logID(), s.tx.msgid
+	action, score := primary.Action, primary.Score
+
+	go func() {
+		rr := <-result
+		if rr == nil {
+			return
+		}
+
+		delta := rr.Score - score
+		actionDiffers := rr.Action != action
+		scoreDiffers := *shadowScoreDelta > 0 && math.Abs(float64(delta)) >= *shadowScoreDelta
+
+		shadowStats.Lock()
+		shadowStats.compared++
+		if actionDiffers {
+			shadowStats.actions[action+" -> "+rr.Action]++
+		}
+		if scoreDiffers {
+			shadowStats.scores++
+		}
+		shadowStats.Unlock()
+
+		if actionDiffers || scoreDiffers {
+			metricInc("shadow.disagreements")
+			log.Printf("%s: message %s shadow disagreement: action=%s/%s score=%.2f/%.2f (%+.2f)",
+				id, msgid, action, rr.Action, score, rr.Score, delta)
+		}
+	}()
+}
+
+// shadowReport logs a summary of the comparisons every interval.
+func shadowReport(interval time.Duration) {
+	for range time.Tick(interval) {
+		shadowStats.Lock()
+		compared, scores, actions := shadowStats.compared, shadowStats.scores, shadowStats.actions
+		shadowStats.compared, shadowStats.scores = 0, 0
+		shadowStats.actions = make(map[string]int)
+		shadowStats.Unlock()
+
+		if compared == 0 {
+			continue
+		}
+
+		disagreements := 0
+		changes := make([]string, 0, len(actions))
+		for k, v := range actions {
+			disagreements += v
+			changes = append(changes, fmt.Sprintf("%s: %d", k, v))
+		}
+		sort.Strings(changes)
+
+		log.Printf("shadow report: %d messages compared, %d different actions, %d score deltas over %.2f",
+			compared, disagreements, scores, *shadowScoreDelta)
+		for _, change := range changes {
+			log.Printf("shadow report: %s", change)
+		}
+	}
+}
+
+func shadowCheck(req *http.Request) (*rspamd, error) {
+	resp, err := shadow.client().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer closeResponse(resp)
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+
+	body, err := responseBody(resp)
+	if err != nil {
+		return nil, err
+	}
+
+	rr := &rspamd{}
+	if err := json.NewDecoder(body).Decode(rr); err != nil {
+		return nil, err
+	}
+	return rr, nil
+}
@@ -0,0 +1,69 @@
+//
+// Copyright (c) 2019 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// The -state-dir holds the state of the filter which outlives it: the
+// storage, unless another one is configured, which keeps the tarpit counts
+// of rejects, the correspondents and the history, and the verdict cache.
+// Greylisting is left to rspamd, which keeps its own state, and the
+// quarantine keeps its index in its own directory, rebuilt from the
+// metadata of its messages, so neither has state of its own here.
+//
+// The files it holds carry the version of their format.  Every format is
+// still at its first version, so there is nothing to migrate yet: a file
+// of a later version, written by a newer filter, is refused rather than
+// overwritten, and a format which changes gets its version bumped along
+// with the code reading the previous one.
+
+const stateSaveInterval = time.Minute
+
+func openStateDir(dir string) error {
+	return os.MkdirAll(dir, 0700)
+}
+
+func stateStoragePath(dir string) string {
+	return filepath.Join(dir, "storage.json")
+}
+
+func stateVerdictsPath(dir string) string {
+	return filepath.Join(dir, "verdicts.json")
+}
+
+// persistVerdicts saves the verdict cache to the state directory every
+// stateSaveInterval, for it to be loaded when the filter restarts.
+func persistVerdicts(dir string) {
+	for range time.Tick(stateSaveInterval) {
+		saveState(dir)
+	}
+}
+
+func saveState(dir string) {
+	if verdicts == nil {
+		return
+	}
+	if err := verdicts.save(stateVerdictsPath(dir)); err != nil {
+		metricInc("state.errors")
+		log.Printf("state '%s' err: %s", dir, err)
+	}
+}
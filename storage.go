@@ -0,0 +1,710 @@
+//
+// Copyright (c) 2019 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// storage is the key/value store shared by the features which need state
+// to outlive a transaction, or to be shared between filter instances: the
+// tarpit counts of rejects, the correspondents and the history.
+//
+// The verdict cache and the rate limiter are not in it.  Both are bounded
+// structures of the instance, looked up on every transaction or command,
+// which a remote storage would slow down: the verdict cache is saved to
+// the -state-dir instead, and the rate limit is meant to be counted by
+// each instance.  Greylisting and the reputation of clients are kept by
+// rspamd, the filter only asks it.
+// A zero ttl means that the key never expires.  Incr adds one to the
+// integer value of a key and returns the result: a missing key starts
+// from 0 and expires after ttl, and an existing one keeps its expiry, so
+// that a count covers a window starting with its first increment.
+type storage interface {
+	Get(key string) (string, bool, error)
+	Set(key string, value string, ttl time.Duration) error
+	Incr(key string, ttl time.Duration) (int64, error)
+	Expire(key string, ttl time.Duration) error
+	Scan(prefix string, fn func(key string, value string) bool) error
+}
+
+var store storage
+
+// openStorage returns the storage described by spec, which is either
+// "memory", "file:<path>", "sqlite:<path>" or a redis:// URL.  A readOnly
+// SQLite database is opened as such, and not swept.
+func openStorage(spec string, readOnly bool) (storage, error) {
+	switch {
+	case spec == "memory":
+		return newMemoryStorage(), nil
+	case strings.HasPrefix(spec, "file:"):
+		return newFileStorage(strings.TrimPrefix(spec, "file:"))
+	case strings.HasPrefix(spec, "sqlite:"):
+		return newSQLiteStorage(strings.TrimPrefix(spec, "sqlite:"), readOnly)
+	case strings.HasPrefix(spec, "redis://"):
+		return newRedisStorage(spec)
+	default:
+		return nil, fmt.Errorf("unsupported storage: %s", spec)
+	}
+}
+
+// storagePath returns the path of the file of a local storage, if spec
+// describes one.
+func storagePath(spec string) string {
+	for _, scheme := range []string{"file:", "sqlite:"} {
+		if strings.HasPrefix(spec, scheme) {
+			return strings.TrimPrefix(spec, scheme)
+		}
+	}
+	return ""
+}
+
+// readOnlyStorage consults the state shared with other instances but
+// never modifies it, as expected from a secondary MX.
+type readOnlyStorage struct {
+	storage
+}
+
+func (readOnlyStorage) Set(key string, value string, ttl time.Duration) error {
+	return nil
+}
+
+func (readOnlyStorage) Expire(key string, ttl time.Duration) error {
+	return nil
+}
+
+// Incr returns the count kept by the other instances, plus the increment
+// which is not recorded.
+func (r readOnlyStorage) Incr(key string, ttl time.Duration) (int64, error) {
+	value, _, err := r.Get(key)
+	if err != nil {
+		return 0, err
+	}
+	count, _ := strconv.ParseInt(value, 10, 64)
+	return count + 1, nil
+}
+
+type storageEntry struct {
+	Value   string    `json:"value"`
+	Expires time.Time `json:"expires,omitempty"`
+}
+
+func (e storageEntry) expired(now time.Time) bool {
+	return !e.Expires.IsZero() && now.After(e.Expires)
+}
+
+func expiry(ttl time.Duration) time.Time {
+	if ttl == 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(ttl)
+}
+
+type memoryStorage struct {
+	mu      sync.Mutex
+	entries map[string]storageEntry
+}
+
+func newMemoryStorage() *memoryStorage {
+	return &memoryStorage{entries: make(map[string]storageEntry)}
+}
+
+func (m *memoryStorage) Get(key string) (string, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e, ok := m.entries[key]
+	if !ok {
+		return "", false, nil
+	}
+	if e.expired(time.Now()) {
+		delete(m.entries, key)
+		return "", false, nil
+	}
+	return e.Value, true, nil
+}
+
+func (m *memoryStorage) Set(key string, value string, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.entries[key] = storageEntry{Value: value, Expires: expiry(ttl)}
+	return nil
+}
+
+func (m *memoryStorage) Incr(key string, ttl time.Duration) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, count := m.incr(key, ttl)
+	return count, nil
+}
+
+// incr increments the value of key, and returns the entry it leaves along
+// with the new count.  It is called with mu held.
+func (m *memoryStorage) incr(key string, ttl time.Duration) (storageEntry, int64) {
+	e, ok := m.entries[key]
+	if !ok || e.expired(time.Now()) {
+		e = storageEntry{Expires: expiry(ttl)}
+	}
+	count, _ := strconv.ParseInt(e.Value, 10, 64)
+	count++
+	e.Value = strconv.FormatInt(count, 10)
+	m.entries[key] = e
+	return e, count
+}
+
+func (m *memoryStorage) Expire(key string, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if e, ok := m.entries[key]; ok {
+		e.Expires = expiry(ttl)
+		m.entries[key] = e
+	}
+	return nil
+}
+
+func (m *memoryStorage) Scan(prefix string, fn func(string, string) bool) error {
+	m.mu.Lock()
+	now := time.Now()
+	matches := make(map[string]string)
+	for k, e := range m.entries {
+		if e.expired(now) {
+			delete(m.entries, k)
+		} else if strings.HasPrefix(k, prefix) {
+			matches[k] = e.Value
+		}
+	}
+	m.mu.Unlock()
+
+	// fn may call back into the storage, so it runs without the lock
+	for k, v := range matches {
+		if !fn(k, v) {
+			break
+		}
+	}
+	return nil
+}
+
+// fileStorage is a memoryStorage backed by a log of JSON records, one per
+// line, following a header which gives the version of the format.  Every
+// change appends the entry it leaves, the last record of a key winning
+// when the file is read back.  Once the file holds more than
+// compactionRatio times as many records as there are entries, it is
+// compacted: rewritten with a single record per live entry.
+type fileStorage struct {
+	*memoryStorage
+	path string
+
+	fileMu  sync.Mutex
+	file    *os.File
+	records int
+	// info describes the file as it was when loaded
+	info os.FileInfo
+	// rewrite is set when the file must be compacted before records
+	// may be appended, as it ends with a record cut short
+	rewrite bool
+}
+
+// storageVersion is the version of the format of storage files, given by
+// their header.
+const storageVersion = 1
+
+const (
+	compactionRatio   = 2
+	compactionMinimum = 1024
+)
+
+type storageHeader struct {
+	Version int `json:"version"`
+}
+
+type storageRecord struct {
+	Key string `json:"key"`
+	storageEntry
+}
+
+func newFileStorage(path string) (*fileStorage, error) {
+	f := &fileStorage{memoryStorage: newMemoryStorage(), path: path}
+
+	// stat before reading, so that a change made in between is not missed
+	f.info, _ = os.Stat(path)
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) || (err == nil && len(data) == 0) {
+		return f, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := f.load(data); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return f, nil
+}
+
+func (f *fileStorage) load(data []byte) error {
+	lines := bytes.Split(data, []byte("\n"))
+
+	var header storageHeader
+	if err := json.Unmarshal(lines[0], &header); err != nil {
+		return fmt.Errorf("invalid header: %s", err)
+	}
+	if header.Version != storageVersion {
+		return fmt.Errorf("unsupported storage version %d", header.Version)
+	}
+
+	for n, line := range lines[1:] {
+		if len(line) == 0 {
+			continue
+		}
+		var record storageRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			// a record cut short by a crash can only be the last one
+			if n == len(lines)-2 {
+				log.Printf("%s: incomplete last record ignored", f.path)
+				f.rewrite = true
+				break
+			}
+			return fmt.Errorf("line %d: %s", n+2, err)
+		}
+		f.entries[record.Key] = record.storageEntry
+		f.records++
+	}
+	return nil
+}
+
+// storageReloadInterval is the interval at which a read-only instance
+// checks whether the file storage it shares was changed.
+const storageReloadInterval = 10 * time.Second
+
+// follow reloads the file every interval if it was changed since it was
+// last loaded, so that a read-only instance sees the state kept by the
+// instance which writes it.
+func (f *fileStorage) follow(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := f.reload(); err != nil {
+			log.Printf("storage '%s' reload err: %s", f.path, err)
+		}
+	}
+}
+
+func (f *fileStorage) reload() error {
+	info, err := os.Stat(f.path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if info != nil && f.info != nil && os.SameFile(info, f.info) &&
+		info.Size() == f.info.Size() && info.ModTime().Equal(f.info.ModTime()) {
+		return nil
+	}
+
+	loaded, err := newFileStorage(f.path)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	f.entries = loaded.entries
+	f.mu.Unlock()
+	f.info = loaded.info
+	return nil
+}
+
+func (f *fileStorage) Set(key string, value string, ttl time.Duration) error {
+	e := storageEntry{Value: value, Expires: expiry(ttl)}
+
+	f.mu.Lock()
+	f.entries[key] = e
+	f.mu.Unlock()
+
+	return f.append(key, e)
+}
+
+// Incr holds fileMu from the increment until its record is written, so
+// that the records of concurrent increments are appended in order.
+func (f *fileStorage) Incr(key string, ttl time.Duration) (int64, error) {
+	f.fileMu.Lock()
+	defer f.fileMu.Unlock()
+
+	f.mu.Lock()
+	e, count := f.incr(key, ttl)
+	f.mu.Unlock()
+
+	return count, f.appendRecord(key, e)
+}
+
+func (f *fileStorage) Expire(key string, ttl time.Duration) error {
+	f.mu.Lock()
+	e, ok := f.entries[key]
+	if ok {
+		e.Expires = expiry(ttl)
+		f.entries[key] = e
+	}
+	f.mu.Unlock()
+
+	if !ok {
+		return nil
+	}
+	return f.append(key, e)
+}
+
+// append writes the record of an entry at the end of the file, after
+// compacting it if it is due, or if it is in an older format.
+func (f *fileStorage) append(key string, e storageEntry) error {
+	f.fileMu.Lock()
+	defer f.fileMu.Unlock()
+
+	return f.appendRecord(key, e)
+}
+
+// appendRecord is append, called with fileMu held.
+func (f *fileStorage) appendRecord(key string, e storageEntry) error {
+	f.mu.Lock()
+	live := len(f.entries)
+	f.mu.Unlock()
+
+	if f.rewrite || (f.file == nil && f.records == 0) ||
+		(f.records >= compactionMinimum && f.records > compactionRatio*live) {
+		// the entry is already in memory, and written with the others
+		return f.compact()
+	}
+
+	if f.file == nil {
+		file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			return err
+		}
+		f.file = file
+	}
+
+	data, err := json.Marshal(storageRecord{Key: key, storageEntry: e})
+	if err != nil {
+		return err
+	}
+	if _, err := f.file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	f.records++
+	return nil
+}
+
+// compact rewrites the file with a record per live entry.  It is called
+// with fileMu held.
+func (f *fileStorage) compact() error {
+	var buf bytes.Buffer
+	header, err := json.Marshal(storageHeader{Version: storageVersion})
+	if err != nil {
+		return err
+	}
+	buf.Write(header)
+	buf.WriteByte('\n')
+
+	f.mu.Lock()
+	now := time.Now()
+	records := 0
+	for k, e := range f.entries {
+		if e.expired(now) {
+			delete(f.entries, k)
+			continue
+		}
+		data, err := json.Marshal(storageRecord{Key: k, storageEntry: e})
+		if err != nil {
+			f.mu.Unlock()
+			return err
+		}
+		buf.Write(data)
+		buf.WriteByte('\n')
+		records++
+	}
+	f.mu.Unlock()
+
+	if err := replaceFile(f.path, buf.Bytes()); err != nil {
+		return err
+	}
+
+	// later records go to the new file
+	if f.file != nil {
+		f.file.Close()
+		f.file = nil
+	}
+	f.records, f.rewrite = records, false
+	return nil
+}
+
+// replaceFile writes data to a temporary file moved to path once complete,
+// so that path is never seen partially written.
+func replaceFile(path string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// sqliteStorage keeps its entries in a table of an SQLite database, which
+// suits large states better than a file loaded in memory.  Expired
+// entries are removed as they are read, and swept every
+// sqliteSweepInterval.
+type sqliteStorage struct {
+	db *sql.DB
+}
+
+const sqliteSweepInterval = time.Hour
+
+func newSQLiteStorage(path string, readOnly bool) (*sqliteStorage, error) {
+	dsn := "file:" + path + "?_pragma=busy_timeout(5000)"
+	if readOnly {
+		dsn += "&mode=ro"
+	}
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+	// writers would only wait on each other
+	db.SetMaxOpenConns(1)
+
+	if !readOnly {
+		_, err = db.Exec(`CREATE TABLE IF NOT EXISTS storage (
+			key TEXT PRIMARY KEY,
+			value TEXT NOT NULL,
+			expires INTEGER NOT NULL DEFAULT 0)`)
+	} else {
+		err = db.Ping()
+	}
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	q := &sqliteStorage{db: db}
+	if !readOnly {
+		go q.sweep(sqliteSweepInterval)
+	}
+	return q, nil
+}
+
+// sqliteExpiry returns the expiry of a ttl as stored in the database: in
+// nanoseconds since the epoch, 0 for never.
+func sqliteExpiry(ttl time.Duration) int64 {
+	if ttl == 0 {
+		return 0
+	}
+	return expiry(ttl).UnixNano()
+}
+
+func (q *sqliteStorage) Get(key string) (string, bool, error) {
+	var value string
+	err := q.db.QueryRow(`SELECT value FROM storage
+		WHERE key = ? AND (expires = 0 OR expires > ?)`,
+		key, time.Now().UnixNano()).Scan(&value)
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	} else if err != nil {
+		return "", false, err
+	}
+	return value, true, nil
+}
+
+func (q *sqliteStorage) Set(key string, value string, ttl time.Duration) error {
+	_, err := q.db.Exec(`INSERT INTO storage (key, value, expires) VALUES (?, ?, ?)
+		ON CONFLICT (key) DO UPDATE SET value = excluded.value, expires = excluded.expires`,
+		key, value, sqliteExpiry(ttl))
+	return err
+}
+
+// Incr restarts the count of an expired row which was not swept yet.
+func (q *sqliteStorage) Incr(key string, ttl time.Duration) (int64, error) {
+	var count int64
+	err := q.db.QueryRow(`INSERT INTO storage (key, value, expires) VALUES (?, '1', ?)
+		ON CONFLICT (key) DO UPDATE SET
+			value = CASE WHEN expires != 0 AND expires <= ?
+				THEN '1' ELSE CAST(CAST(value AS INTEGER) + 1 AS TEXT) END,
+			expires = CASE WHEN expires != 0 AND expires <= ?
+				THEN excluded.expires ELSE expires END
+		RETURNING CAST(value AS INTEGER)`,
+		key, sqliteExpiry(ttl), time.Now().UnixNano(), time.Now().UnixNano()).Scan(&count)
+	return count, err
+}
+
+func (q *sqliteStorage) Expire(key string, ttl time.Duration) error {
+	_, err := q.db.Exec(`UPDATE storage SET expires = ? WHERE key = ?`, sqliteExpiry(ttl), key)
+	return err
+}
+
+func (q *sqliteStorage) Scan(prefix string, fn func(string, string) bool) error {
+	rows, err := q.db.Query(`SELECT key, value FROM storage
+		WHERE key >= ? AND (expires = 0 OR expires > ?) ORDER BY key`,
+		prefix, time.Now().UnixNano())
+	if err != nil {
+		return err
+	}
+
+	matches := [][2]string{}
+	for rows.Next() {
+		var key, value string
+		if err := rows.Scan(&key, &value); err != nil {
+			rows.Close()
+			return err
+		}
+		if !strings.HasPrefix(key, prefix) {
+			break
+		}
+		matches = append(matches, [2]string{key, value})
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	// fn may call back into the storage, which has a single connection
+	for _, m := range matches {
+		if !fn(m[0], m[1]) {
+			break
+		}
+	}
+	return nil
+}
+
+func (q *sqliteStorage) sweep(interval time.Duration) {
+	for range time.Tick(interval) {
+		if _, err := q.db.Exec(`DELETE FROM storage WHERE expires != 0 AND expires <= ?`,
+			time.Now().UnixNano()); err != nil {
+			log.Printf("sqlite storage sweep err: %s", err)
+		}
+	}
+}
+
+// redisStorage keeps its keys under a common prefix so that a redis
+// database can be shared with other applications, rspamd included.
+type redisStorage struct {
+	client *redisClient
+}
+
+const redisStoragePrefix = "filter-rspamd:"
+
+func newRedisStorage(rawurl string) (*redisStorage, error) {
+	client, err := newRedisClient(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	return &redisStorage{client: client}, nil
+}
+
+func (r *redisStorage) Get(key string) (string, bool, error) {
+	reply, err := r.client.Do("GET", redisStoragePrefix+key)
+	if err != nil || reply == nil {
+		return "", false, err
+	}
+	value, ok := reply.(string)
+	return value, ok, nil
+}
+
+func (r *redisStorage) Set(key string, value string, ttl time.Duration) error {
+	args := []string{"SET", redisStoragePrefix + key, value}
+	if ttl > 0 {
+		args = append(args, "PX", strconv.FormatInt(int64(ttl/time.Millisecond), 10))
+	}
+	_, err := r.client.Do(args...)
+	return err
+}
+
+// Incr only sets the expiry of keys which have none, with the NX option
+// of PEXPIRE, so that a key whose expiry was never set, the filter having
+// stopped in between, gets it on the next increment.
+func (r *redisStorage) Incr(key string, ttl time.Duration) (int64, error) {
+	reply, err := r.client.Do("INCR", redisStoragePrefix+key)
+	if err != nil {
+		return 0, err
+	}
+	count, ok := reply.(int64)
+	if !ok {
+		return 0, fmt.Errorf("redis: unexpected INCR reply")
+	}
+	if ttl > 0 {
+		_, err = r.client.Do("PEXPIRE", redisStoragePrefix+key,
+			strconv.FormatInt(int64(ttl/time.Millisecond), 10), "NX")
+	}
+	return count, err
+}
+
+func (r *redisStorage) Expire(key string, ttl time.Duration) error {
+	var err error
+	if ttl > 0 {
+		_, err = r.client.Do("PEXPIRE", redisStoragePrefix+key,
+			strconv.FormatInt(int64(ttl/time.Millisecond), 10))
+	} else {
+		_, err = r.client.Do("PERSIST", redisStoragePrefix+key)
+	}
+	return err
+}
+
+func (r *redisStorage) Scan(prefix string, fn func(string, string) bool) error {
+	pattern := redisStoragePrefix + redisGlobEscaper.Replace(prefix) + "*"
+
+	cursor := "0"
+	for {
+		reply, err := r.client.Do("SCAN", cursor, "MATCH", pattern, "COUNT", "100")
+		if err != nil {
+			return err
+		}
+		values, ok := reply.([]interface{})
+		if !ok || len(values) != 2 {
+			return fmt.Errorf("redis: unexpected SCAN reply")
+		}
+		cursor, _ = values[0].(string)
+		keys, _ := values[1].([]interface{})
+
+		for _, k := range keys {
+			key, _ := k.(string)
+			value, found, err := r.Get(strings.TrimPrefix(key, redisStoragePrefix))
+			if err != nil {
+				return err
+			}
+			if found && !fn(strings.TrimPrefix(key, redisStoragePrefix), value) {
+				return nil
+			}
+		}
+
+		if cursor == "0" {
+			return nil
+		}
+	}
+}
+
+var redisGlobEscaper = strings.NewReplacer(
+	"\\", "\\\\", "*", "\\*", "?", "\\?", "[", "\\[", "]", "\\]")
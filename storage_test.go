@@ -0,0 +1,466 @@
+//
+// Copyright (c) 2019 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis serves the commands of the redis storage over RESP, keeping
+// its keys in memory.
+type fakeRedis struct {
+	listener net.Listener
+
+	mu      sync.Mutex
+	values  map[string]string
+	expires map[string]time.Time
+}
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &fakeRedis{listener: l, values: map[string]string{}, expires: map[string]time.Time{}}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go r.serve(conn)
+		}
+	}()
+	return r
+}
+
+func (r *fakeRedis) url() string {
+	return "redis://" + r.listener.Addr().String()
+}
+
+func (r *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	rd := bufio.NewReader(conn)
+	for {
+		args, err := readRESPCommand(rd)
+		if err != nil {
+			return
+		}
+		if _, err := io.WriteString(conn, r.do(args)); err != nil {
+			return
+		}
+	}
+}
+
+func readRESPCommand(rd *bufio.Reader) ([]string, error) {
+	line, err := rd.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "*")))
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		if line, err = rd.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "$")))
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(rd, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
+
+func bulkString(s string) string {
+	return fmt.Sprintf("$%d\r\n%s\r\n", len(s), s)
+}
+
+func (r *fakeRedis) do(args []string) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for k, t := range r.expires {
+		if time.Now().After(t) {
+			delete(r.values, k)
+			delete(r.expires, k)
+		}
+	}
+
+	switch strings.ToUpper(args[0]) {
+	case "GET":
+		if v, ok := r.values[args[1]]; ok {
+			return bulkString(v)
+		}
+		return "$-1\r\n"
+	case "SET":
+		r.values[args[1]] = args[2]
+		delete(r.expires, args[1])
+		if len(args) == 5 && args[3] == "PX" {
+			ms, _ := strconv.Atoi(args[4])
+			r.expires[args[1]] = time.Now().Add(time.Duration(ms) * time.Millisecond)
+		}
+		return "+OK\r\n"
+	case "INCR":
+		n, _ := strconv.Atoi(r.values[args[1]])
+		r.values[args[1]] = strconv.Itoa(n + 1)
+		return fmt.Sprintf(":%d\r\n", n+1)
+	case "PEXPIRE":
+		if _, ok := r.values[args[1]]; !ok {
+			return ":0\r\n"
+		}
+		if _, ok := r.expires[args[1]]; ok && len(args) == 4 && args[3] == "NX" {
+			return ":0\r\n"
+		}
+		ms, _ := strconv.Atoi(args[2])
+		r.expires[args[1]] = time.Now().Add(time.Duration(ms) * time.Millisecond)
+		return ":1\r\n"
+	case "PERSIST":
+		delete(r.expires, args[1])
+		return ":1\r\n"
+	case "SCAN":
+		keys := []string{}
+		for k := range r.values {
+			if ok, _ := path.Match(args[3], k); ok {
+				keys = append(keys, k)
+			}
+		}
+		reply := fmt.Sprintf("*2\r\n%s*%d\r\n", bulkString("0"), len(keys))
+		for _, k := range keys {
+			reply += bulkString(k)
+		}
+		return reply
+	}
+	return "-ERR unknown command\r\n"
+}
+
+// testStorage runs the operations of the storage interface against st.
+func testStorage(t *testing.T, st storage) {
+	if _, found, err := st.Get("missing"); found || err != nil {
+		t.Fatalf("missing key: got %t, %v", found, err)
+	}
+
+	for k, v := range map[string]string{"a:1": "one", "a:2": "two", "b:1": "three", "version": "4"} {
+		if err := st.Set(k, v, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := st.Set("a:1", "uno", 0); err != nil {
+		t.Fatal(err)
+	}
+	if value, found, err := st.Get("a:1"); value != "uno" || !found || err != nil {
+		t.Fatalf("got %q, %t, %v", value, found, err)
+	}
+
+	scanned := []string{}
+	err := st.Scan("a:", func(k string, v string) bool {
+		scanned = append(scanned, k+"="+v)
+		return true
+	})
+	sort.Strings(scanned)
+	if err != nil || strings.Join(scanned, ",") != "a:1=uno,a:2=two" {
+		t.Fatalf("scan: got %q, %v", scanned, err)
+	}
+
+	stopped := 0
+	st.Scan("", func(string, string) bool {
+		stopped++
+		return false
+	})
+	if stopped != 1 {
+		t.Fatalf("scan went on after being stopped: %d keys", stopped)
+	}
+
+	if err := st.Set("ttl", "x", 50*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.Expire("a:2", 50*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.Expire("missing", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if _, found, _ := st.Get("ttl"); !found {
+		t.Fatalf("key expired early")
+	}
+	time.Sleep(100 * time.Millisecond)
+	for _, k := range []string{"ttl", "a:2", "missing"} {
+		if _, found, _ := st.Get(k); found {
+			t.Errorf("key %s not expired", k)
+		}
+	}
+
+	// a zero ttl lifts the expiry
+	st.Set("ttl", "x", 50*time.Millisecond)
+	if err := st.Expire("ttl", 0); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if _, found, _ := st.Get("ttl"); !found {
+		t.Errorf("key expired after its expiry was lifted")
+	}
+
+	// increments keep the expiry set by the first one
+	for i := int64(1); i <= 3; i++ {
+		if count, err := st.Incr("count", 100*time.Millisecond); count != i || err != nil {
+			t.Fatalf("increment %d: got %d, %v", i, count, err)
+		}
+		time.Sleep(40 * time.Millisecond)
+	}
+	if _, found, _ := st.Get("count"); found {
+		t.Errorf("count not expired after its first increment")
+	}
+	if count, err := st.Incr("count", time.Hour); count != 1 || err != nil {
+		t.Errorf("increment after expiry: got %d, %v", count, err)
+	}
+
+	// concurrent increments are all counted
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := st.Incr("concurrent", time.Hour); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if value, _, _ := st.Get("concurrent"); value != "20" {
+		t.Errorf("concurrent increments: got %q, want 20", value)
+	}
+}
+
+func TestMemoryStorage(t *testing.T) {
+	testStorage(t, newMemoryStorage())
+}
+
+func TestFileStorage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "storage.json")
+	st, err := newFileStorage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStorage(t, st)
+
+	reopened, err := newFileStorage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range map[string]string{"a:1": "uno", "b:1": "three", "version": "4", "ttl": "x", "concurrent": "20"} {
+		if value, found, _ := reopened.Get(k); !found || value != v {
+			t.Errorf("%s after reopening: got %q, %t", k, value, found)
+		}
+	}
+	if _, found, _ := reopened.Get("a:2"); found {
+		t.Errorf("expired key back after reopening")
+	}
+}
+
+func TestSQLiteStorage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "storage.db")
+	st, err := newSQLiteStorage(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStorage(t, st)
+
+	ro, err := newSQLiteStorage(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, found, _ := ro.Get("a:1"); !found || value != "uno" {
+		t.Errorf("read-only: got %q, %t", value, found)
+	}
+	if err := ro.Set("a:1", "one", 0); err == nil {
+		t.Errorf("read-only database written")
+	}
+}
+
+func TestRedisStorage(t *testing.T) {
+	st, err := newRedisStorage(newFakeRedis(t).url())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStorage(t, st)
+}
+
+// storageLines returns the lines of a storage file.
+func storageLines(t *testing.T, path string) []string {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+}
+
+func TestFileStorageCompaction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "storage.json")
+	st, err := newFileStorage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	st.Set("kept", "1", 0)
+	for i := 0; i < compactionMinimum-1; i++ {
+		if err := st.Set("counter", strconv.Itoa(i), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if lines := storageLines(t, path); len(lines) <= compactionMinimum {
+		t.Fatalf("compacted early, %d lines", len(lines))
+	}
+
+	// the next change finds more records than allowed for two entries
+	st.Set("counter", "last", 0)
+	if lines := storageLines(t, path); len(lines) != 3 {
+		t.Fatalf("not compacted, %d lines", len(lines))
+	}
+
+	reopened, err := newFileStorage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, _, _ := reopened.Get("counter"); value != "last" {
+		t.Errorf("counter: got %q after compaction", value)
+	}
+	if value, _, _ := reopened.Get("kept"); value != "1" {
+		t.Errorf("kept: got %q after compaction", value)
+	}
+}
+
+func TestFileStorageTruncated(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "storage.json")
+	data := `{"version":1}` + "\n" +
+		`{"key":"a","value":"1"}` + "\n" +
+		`{"key":"b","val`
+	if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	st, err := newFileStorage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, found, _ := st.Get("a"); !found || value != "1" {
+		t.Fatalf("a: got %q, %t", value, found)
+	}
+	if _, found, _ := st.Get("b"); found {
+		t.Fatalf("incomplete record loaded")
+	}
+
+	// the cut record is dropped before anything is appended to it
+	if err := st.Set("c", "3", 0); err != nil {
+		t.Fatal(err)
+	}
+	reopened, err := newFileStorage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range map[string]string{"a": "1", "c": "3"} {
+		if value, _, _ := reopened.Get(k); value != v {
+			t.Errorf("%s: got %q after the crash", k, value)
+		}
+	}
+	if reopened.rewrite {
+		t.Errorf("file still damaged")
+	}
+
+	// only the last record may be cut short
+	data = `{"version":1}` + "\n" + `{"key":"b","val` + "\n" + `{"key":"a","value":"1"}` + "\n"
+	ioutil.WriteFile(path, []byte(data), 0600)
+	if _, err := newFileStorage(path); err == nil {
+		t.Errorf("damaged file loaded")
+	}
+}
+
+func TestFileStorageVersion(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "storage.json")
+	for _, data := range []string{
+		`{"version":2}` + "\n",
+		`{"version":{"value":"1"}}`,
+		`{"a":{"value":"1"}}`,
+	} {
+		ioutil.WriteFile(path, []byte(data), 0600)
+		if _, err := newFileStorage(path); err == nil {
+			t.Errorf("%s: loaded", data)
+		}
+	}
+}
+
+func TestFileStorageReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "storage.json")
+
+	primary, err := newFileStorage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secondary, err := newFileStorage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ro := readOnlyStorage{secondary}
+
+	if err := primary.Set("greylist:a", "1", 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := secondary.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if value, found, _ := ro.Get("greylist:a"); !found || value != "1" {
+		t.Fatalf("got %q %t after a change of the primary", value, found)
+	}
+
+	if err := ro.Set("greylist:b", "2", 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, found, _ := primary.Get("greylist:b"); found {
+		t.Fatalf("read-only storage written")
+	}
+
+	// appended records are seen as well as compactions
+	if err := primary.Set("greylist:c", "3", 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := secondary.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if value, found, _ := ro.Get("greylist:c"); !found || value != "3" {
+		t.Fatalf("got %q %t after an append of the primary", value, found)
+	}
+}
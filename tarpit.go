@@ -0,0 +1,94 @@
+//
+// Copyright (c) 2019 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package main
+
+import (
+	"log"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Sessions are tarpitted, their filter results delayed, for every strike
+// against them: each of their messages scoring over -tarpit-score, and
+// each reject of their address beyond -tarpit-rejects in the last
+// -tarpit-window.  The delay starts at -tarpit-delay and grows by as much
+// with every further strike, up to -tarpit-max-delay.
+
+func tarpitEnabled() bool {
+	return *tarpitDelay > 0 && (*tarpitScore > 0 || *tarpitRejects > 0)
+}
+
+// countReject records a reject of ip in the storage, so that it is shared
+// with other instances of the filter.  The count expires -tarpit-window
+// after the first reject it holds.  There is no storage in the commands,
+// which scan messages without the state of the filter.
+func countReject(ip string) {
+	if *tarpitDelay <= 0 || *tarpitRejects <= 0 || ip == "" || store == nil {
+		return
+	}
+
+	go func() {
+		if _, err := store.Incr("tarpit:"+ip, *tarpitWindow); err != nil {
+			metricInc("tarpit.errors")
+			log.Printf("tarpit storage err: %s", err)
+		}
+	}()
+}
+
+// tarpitStrikes returns the number of strikes against a session.
+func tarpitStrikes(ip string, strikes int) int {
+	if *tarpitRejects > 0 && ip != "" && store != nil {
+		value, ok, err := store.Get("tarpit:" + ip)
+		if err != nil {
+			metricInc("tarpit.errors")
+			log.Printf("tarpit storage err: %s", err)
+		} else if count, _ := strconv.Atoi(value); ok && count >= *tarpitRejects {
+			strikes += count - *tarpitRejects + 1
+		}
+	}
+	return strikes
+}
+
+func tarpitDuration(strikes int) time.Duration {
+	if strikes == 0 {
+		return 0
+	}
+	delay := *tarpitDelay * time.Duration(strikes)
+	if delay > *tarpitMaxDelay || delay < 0 {
+		delay = *tarpitMaxDelay
+	}
+	return delay
+}
+
+// filterResult sends the result of a filter, delayed if the session is
+// tarpitted, which the local enqueuer never is.
+func filterResult(s *session, token string, format string, a ...interface{}) {
+	if !tarpitEnabled() || isDryRun() || isLocal(s.src) {
+		produceOutput("filter-result", s.id, token, format, a...)
+		return
+	}
+
+	id, ip, strikes := s.id, clientIP(s.src), int(atomic.LoadInt32(&s.strikes))
+	go func() {
+		if delay := tarpitDuration(tarpitStrikes(ip, strikes)); delay > 0 {
+			metricInc("tarpit.delayed")
+			time.Sleep(delay)
+		}
+		produceOutput("filter-result", id, token, format, a...)
+	}()
+}
@@ -0,0 +1,230 @@
+//
+// Copyright (c) 2019 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// verdict is the outcome of a scan, as kept for later inspection.
+type verdict struct {
+	Time     time.Time `json:"time"`
+	Session  string    `json:"session"`
+	QueueId  string    `json:"queue-id"`
+	ScanId   string    `json:"scan-id,omitempty"`
+	Src      string    `json:"src"`
+	Helo     string    `json:"helo"`
+	From     string    `json:"from"`
+	Rcpts    []string  `json:"rcpts"`
+	User     string    `json:"user,omitempty"`
+	Action   string    `json:"action"`
+	Score    float32   `json:"score"`
+	Required float32   `json:"required"`
+	Symbols  []string  `json:"symbols"`
+	// DryRun is set when the action was not enforced, the message
+	// being accepted in a dry run.
+	DryRun bool `json:"dry-run,omitempty"`
+}
+
+// verdictCache keeps the most recent verdicts, indexed by queue id, and
+// evicts the least recently recorded ones.
+type verdictCache struct {
+	sync.Mutex
+	size    int
+	order   *list.List
+	entries map[string]*list.Element
+	changed bool
+}
+
+var verdicts *verdictCache
+
+func newVerdictCache(size int) *verdictCache {
+	return &verdictCache{
+		size:    size,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+func (c *verdictCache) add(v verdict) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.changed = true
+	if e, ok := c.entries[v.QueueId]; ok {
+		e.Value = v
+		c.order.MoveToFront(e)
+		return
+	}
+
+	c.entries[v.QueueId] = c.order.PushFront(v)
+	for c.order.Len() > c.size {
+		e := c.order.Back()
+		c.order.Remove(e)
+		delete(c.entries, e.Value.(verdict).QueueId)
+	}
+}
+
+func (c *verdictCache) get(queueId string) (verdict, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	e, ok := c.entries[queueId]
+	if !ok {
+		return verdict{}, false
+	}
+	return e.Value.(verdict), true
+}
+
+func (c *verdictCache) flush() {
+	c.Lock()
+	defer c.Unlock()
+
+	c.order.Init()
+	c.entries = make(map[string]*list.Element)
+	c.changed = true
+}
+
+func (c *verdictCache) len() int {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.order.Len()
+}
+
+// verdictsVersion is the version of the format of the file the verdict
+// cache is saved to in the -state-dir.
+const verdictsVersion = 1
+
+type verdictsFile struct {
+	Version  int       `json:"version"`
+	Verdicts []verdict `json:"verdicts"`
+}
+
+// load adds the verdicts saved to path to the cache, if any.
+func (c *verdictCache) load(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var file verdictsFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return err
+	}
+	// there is no earlier version to migrate from
+	if file.Version < 1 || file.Version > verdictsVersion {
+		return fmt.Errorf("unsupported verdicts version %d", file.Version)
+	}
+	for _, v := range file.Verdicts {
+		c.add(v)
+	}
+
+	c.Lock()
+	c.changed = false
+	c.Unlock()
+	return nil
+}
+
+// save writes the verdicts of the cache to path, oldest first, if they
+// changed since they were last saved.
+func (c *verdictCache) save(path string) error {
+	c.Lock()
+	if !c.changed {
+		c.Unlock()
+		return nil
+	}
+	file := verdictsFile{Version: verdictsVersion, Verdicts: make([]verdict, 0, c.order.Len())}
+	for e := c.order.Back(); e != nil; e = e.Prev() {
+		file.Verdicts = append(file.Verdicts, e.Value.(verdict))
+	}
+	c.changed = false
+	c.Unlock()
+
+	data, err := json.Marshal(file)
+	if err == nil {
+		err = replaceFile(path, data)
+	}
+	if err != nil {
+		// saved again next time, with the changes made meanwhile
+		c.Lock()
+		c.changed = true
+		c.Unlock()
+	}
+	return err
+}
+
+func newVerdict(s *session, action string) verdict {
+	return verdict{
+		Time:     time.Now(),
+		Session:  s.id,
+		QueueId:  s.tx.msgid,
+		ScanId:   s.tx.scanID,
+		Src:      s.src,
+		Helo:     s.heloName,
+		From:     s.tx.mailFrom,
+		Rcpts:    append([]string(nil), s.tx.rcptTo...),
+		User:     s.userName,
+		Action:   action,
+		Score:    s.tx.score,
+		Required: s.tx.requiredScore,
+		Symbols:  s.tx.symbols,
+		DryRun:   isDryRun(),
+	}
+}
+
+// recordVerdict keeps the verdict of the current transaction in the
+// verdict cache, the journal and the history, publishes it and notifies
+// the webhook, if they are enabled.
+func recordVerdict(s *session, action string) {
+	s.tx.verdict = action
+	if verdicts == nil && journal == nil && *historyRetention == 0 && publisher == nil && webhook == nil {
+		return
+	}
+
+	v := newVerdict(s, action)
+	if verdicts != nil {
+		verdicts.add(v)
+	}
+	if journal != nil {
+		if err := journal.write(v); err != nil {
+			metricInc("journal.errors")
+			log.Printf("%s: message %s could not be journaled: %s", s.logID(), s.tx.msgid, err)
+		}
+	}
+	if *historyRetention > 0 && store != nil {
+		if err := keepHistory(v); err != nil {
+			metricInc("history.errors")
+			log.Printf("%s: message %s could not be kept in the history: %s", s.logID(), s.tx.msgid, err)
+		}
+	}
+	if publisher != nil {
+		publisher.publish(v)
+	}
+	if webhook != nil {
+		webhook.notify(v)
+	}
+}
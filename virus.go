@@ -0,0 +1,59 @@
+//
+// Copyright (c) 2019 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+// virusSymbols holds the uppercased prefixes of the symbols reported by the
+// rspamd antivirus module, as given by -virus-symbols.
+var virusSymbols []string
+
+// virusName returns the name of the virus reported by the antivirus symbols
+// of a verdict, or the symbol itself if the antivirus gave none, and an
+// empty string if the message is clean.
+func virusName(rr *rspamd) string {
+	names := make([]string, 0, len(rr.Symbols))
+	for name := range rr.Symbols {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		for _, prefix := range virusSymbols {
+			if !strings.HasPrefix(strings.ToUpper(name), prefix) {
+				continue
+			}
+			if options := rr.Symbols[name].Options; len(options) > 0 && options[0] != "" {
+				return options[0]
+			}
+			return name
+		}
+	}
+	return ""
+}
+
+func writeVirusHeaders(s *session) {
+	writeFilterHeader(s, "X-Virus-Scanned", "rspamd")
+	if s.tx.virus != "" {
+		writeFilterHeader(s, "X-Virus-Status", "Infected ("+s.tx.virus+")")
+	} else {
+		writeFilterHeader(s, "X-Virus-Status", "Clean")
+	}
+}
@@ -0,0 +1,124 @@
+//
+// Copyright (c) 2019 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// webhookNotifier POSTs the verdict of rejected messages to a webhook,
+// signed with an HMAC-SHA256 in the X-Signature header.  The signature
+// covers the X-Timestamp and X-Nonce headers along with the body, so that
+// receivers may turn away notifications which are too old or replayed.  As
+// for the publisher, notifications are dropped rather than queued without
+// bound while the webhook is slow or down.
+type webhookNotifier struct {
+	url    string
+	secret []byte
+	client *http.Client
+	events chan []byte
+}
+
+const webhookQueueSize = 256
+
+var webhook *webhookNotifier
+
+func newWebhookNotifier(url string, secret string) *webhookNotifier {
+	return &webhookNotifier{
+		url:    url,
+		secret: []byte(secret),
+		client: &http.Client{Timeout: 10 * time.Second},
+		events: make(chan []byte, webhookQueueSize),
+	}
+}
+
+func (w *webhookNotifier) notify(v verdict) {
+	// a dry run rejects nothing
+	if v.DryRun || (v.Action != "reject" && v.Action != "soft reject") {
+		return
+	}
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+
+	select {
+	case w.events <- data:
+	default:
+		metricInc("webhook.dropped")
+	}
+}
+
+// sign returns the signature of a notification: the HMAC of its
+// timestamp, nonce and body, separated by dots.
+func (w *webhookNotifier) sign(timestamp string, nonce string, data []byte) string {
+	mac := hmac.New(sha256.New, w.secret)
+	mac.Write([]byte(timestamp + "." + nonce + "."))
+	mac.Write(data)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (w *webhookNotifier) post(data []byte) error {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	req, err := http.NewRequest("POST", w.url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", userAgent())
+	req.Header.Set("X-Timestamp", timestamp)
+	req.Header.Set("X-Nonce", hex.EncodeToString(nonce))
+	req.Header.Set("X-Signature", w.sign(timestamp, req.Header.Get("X-Nonce"), data))
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer closeResponse(resp)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	return nil
+}
+
+func (w *webhookNotifier) run() {
+	for data := range w.events {
+		if err := w.post(data); err != nil {
+			metricInc("webhook.errors")
+			log.Printf("webhook err: %s", err)
+			continue
+		}
+		metricInc("webhook.events")
+	}
+}
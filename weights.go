@@ -0,0 +1,140 @@
+//
+// Copyright (c) 2019 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// symbolWeights holds the adjustments of the -weights file, by lowercased
+// symbol, and actionThresholds the scores from which the actions apply
+// once the scores are adjusted.
+var symbolWeights map[string]float32
+var actionThresholds map[string]float32
+
+// loadWeights reads a weights file: one "symbol adjustment" or "threshold
+// action score" entry per line, with blank lines and comments starting
+// with # ignored.
+func loadWeights(path string) (map[string]float32, map[string]float32, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	weights := make(map[string]float32)
+	thresholds := make(map[string]float32)
+	scanner := bufio.NewScanner(f)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 2 || (fields[0] != "threshold" && len(fields) != 2) {
+			return nil, nil, fmt.Errorf("line %d: invalid entry", lineno)
+		}
+
+		value, err := strconv.ParseFloat(fields[len(fields)-1], 32)
+		if err != nil {
+			return nil, nil, fmt.Errorf("line %d: invalid score: %s", lineno, fields[len(fields)-1])
+		}
+
+		if fields[0] != "threshold" {
+			weights[strings.ToLower(fields[0])] = float32(value)
+			continue
+		}
+		action := strings.Join(fields[1:len(fields)-1], " ")
+		if !validAction(action) || action == "no action" {
+			return nil, nil, fmt.Errorf("line %d: invalid action: %s", lineno, action)
+		}
+		thresholds[action] = float32(value)
+	}
+	return weights, thresholds, scanner.Err()
+}
+
+// applyWeights adjusts the scores of the symbols of a verdict, and its
+// total score, and decides the action again if any was adjusted and the
+// action followed from the score.
+func applyWeights(rr *rspamd) bool {
+	forced := forcedAction(rr)
+	adjusted := false
+	for name, symbol := range rr.Symbols {
+		weight, ok := symbolWeights[strings.ToLower(name)]
+		if !ok {
+			continue
+		}
+		symbol.Score += weight
+		rr.Symbols[name] = symbol
+		rr.Score += weight
+		adjusted = true
+	}
+	if adjusted && !forced {
+		rr.Action = thresholdAction(rr)
+	}
+	return adjusted
+}
+
+// forcedAction returns whether the action of a verdict does not follow
+// from its score: the rate limits and greylisting of rspamd soft reject
+// messages whatever their score, and its force_actions module may impose
+// any action.
+func forcedAction(rr *rspamd) bool {
+	switch rr.Action {
+	case "soft reject", "discard":
+		return true
+	case "reject":
+		return rr.Score < rr.RequiredScore
+	}
+	return false
+}
+
+// threshold returns the threshold of an action, if known: the one set in
+// the weights file or, for reject, the required score reported by rspamd.
+func threshold(rr *rspamd, action string) (float32, bool) {
+	threshold, ok := actionThresholds[action]
+	if !ok && action == "reject" && rr.RequiredScore > 0 {
+		threshold, ok = rr.RequiredScore, true
+	}
+	return threshold, ok
+}
+
+// thresholdAction returns the action of a verdict once its score is
+// adjusted.  The action of rspamd is kept unless a known threshold is
+// crossed: it no longer applies below its own threshold, and a more severe
+// action applies from its threshold on.  Once an action no longer applies,
+// the most severe action whose threshold the score still reaches does, or
+// no action if there is none.
+func thresholdAction(rr *rspamd) string {
+	action := rr.Action
+	if t, ok := threshold(rr, action); ok && rr.Score < t {
+		action = "no action"
+	}
+	for _, a := range actionSeverity {
+		if t, ok := threshold(rr, a); ok && rr.Score >= t && severity(a) > severity(action) {
+			action = a
+		}
+	}
+	return action
+}